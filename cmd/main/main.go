@@ -1,20 +1,71 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/bootloop"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/devicehistory"
+	"grafana-extract-go/internal/esindex"
+	"grafana-extract-go/internal/export"
 	"grafana-extract-go/internal/googleapi"
+	"grafana-extract-go/internal/htmlreport"
+	"grafana-extract-go/internal/installbase"
 	"grafana-extract-go/internal/localexcel"
+	"grafana-extract-go/internal/metrics"
+	"grafana-extract-go/internal/notify"
+	"grafana-extract-go/internal/ownership"
+	"grafana-extract-go/internal/redact"
+	"grafana-extract-go/internal/report"
+	"grafana-extract-go/internal/store"
+	"grafana-extract-go/internal/ticket"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// The install base loaded from the -b flag, nil if not provided
+var installBase *installbase.InstallBase
+
+// The team ownership loaded from the -o flag, nil leaves the crashes unassigned
+var owners *ownership.Owners
+
+// The redactor built from the -redact flags, nil keeps the crash logs as they are
+var redactor *redact.Redactor
+
+// The chat webhook URL from the -notify flag, empty disables notifications
+var notifyURL string
+
+// The enriched crash index sink built from the -es-url flags, nil if not configured
+var enrichSink *esindex.Sink
+
+// The crash store opened from the -db flag, nil keeps nothing
+var crashStore *store.Store
+
+// The mode the runs are kept with in the store, the -mode flag or webhook
+var runMode = "webhook"
+
+// Where the Excel file is saved, from the -out, -name and -merge flags
+var output report.Output
+
+// The Google Sheets auth from the -google-* flags, or the GOOGLE_SHEETS_* environment variables
+var googleAuth = googleapi.DefaultAuth()
+
+// The Drive folder and the sharing of the spreadsheets from the -drive-folder and -share-* flags
+var googleDrive googleapi.Drive
+
 func getLocalIP() (string, error) {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -37,22 +88,52 @@ func getLocalIP() (string, error) {
 	return "127.0.0.1", nil
 }
 
+// parseCrashLogQuery reads the query and the dedup policy from the query parameters
+func parseCrashLogQuery(r *http.Request) (report.Query, report.Dedup, error) {
+	// Get the product line and date from query parameters
+	params := r.URL.Query()
+	query := report.Query{
+		ProductLine: params.Get("productLine"),
+		Date:        params.Get("date"),
+		To:          params.Get("to"),
+		Version:     params.Get("version"),
+		Model:       params.Get("model"),
+	}
+	query.Size, _ = strconv.Atoi(params.Get("size"))
+
+	// One crash log per device unless another dedup policy is asked for
+	dedup := report.Dedup{Policy: report.DedupDevice}
+	if policy := params.Get("dedup"); policy != "" {
+		var err error
+		dedup.Policy, err = report.ParsePolicy(policy)
+		if err != nil {
+			return query, dedup, err
+		}
+		dedup.Samples, _ = strconv.Atoi(params.Get("samples"))
+	}
+	return query, dedup, nil
+}
+
 func crashlogHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO: parser response from Grafana webhook
-	// Get the product line and date from query parameters
-	productLine := r.URL.Query().Get("productLine")
-	date := r.URL.Query().Get("date")
-	version := r.URL.Query().Get("version")
-	model := r.URL.Query().Get("model")
-	sizeStr := r.URL.Query().Get("size")
-	size, err := strconv.Atoi(sizeStr)
-	// if err != nil {
-	// 	// Handle the error condition and return an error
-	// 	log.Println("Get size error")
-	// 	return
-	// }
-	// Fetch crash logs based on the product line and date
-	crashLogs, err := crashlog.FetchCrashLogs(productLine, date, version, model, size)
+	query, dedup, err := parseCrashLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := negotiateFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sinks, err := parseSinks(r.URL.Query().Get("sink"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Fetch crash logs based on the product line and date, the run is kept
+	// in the -db store by the plain-text answer or the db sink only
+	crashLogs, err := fetchRedacted(query.ProductLine, query.Date, query.To, query.Version, query.Model, query.Size)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to fetch crash logs: %s", err), http.StatusInternalServerError)
 		return
@@ -63,18 +144,35 @@ func crashlogHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	opts := report.Options{
+		Dedup:       dedup,
+		InstallBase: installBase,
+		Owners:      owners,
+		Query:       query,
+		Output:      output,
+	}
+
+	// Answer with the crash groups or a download, writing only to the asked sinks
+	if format != "" {
+		respondCrashLogs(w, r, format, crashLogs, opts, sinks)
+		return
+	}
+	saveRun(query, crashLogs)
+	var spreadsheetURL string
+	defer func() { sendNotification(crashLogs, spreadsheetURL) }()
+
 	// Attempt to write crash logs to Google Sheets
-	err = googleapi.WriteCrashLogs(crashLogs)
+	spreadsheetURL, err = googleapi.WriteCrashLogs(crashLogs, opts, googleAuth, googleDrive)
 	if err == nil {
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Crash logs written to Google Sheets"))
-		//return
-	} else {
-		log.Println("Create Google Sheets failed with: ", err)
+		w.Write([]byte("Crash logs written to Google Sheets: " + spreadsheetURL))
+		writeRates(w, crashLogs)
+		return
 	}
+	log.Println("Create Google Sheets failed with: ", err)
 
 	// If writing to Google Sheets failed, create a local Excel file
-	err = localexcel.CreateExcel(crashLogs, true)
+	err = localexcel.CreateExcel(crashLogs, opts)
 	if err != nil {
 		log.Println("Create excel failed with: ", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -83,6 +181,349 @@ func crashlogHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Crash logs written to local Excel file"))
+	writeRates(w, crashLogs)
+}
+
+// The response formats of /crashlogs besides the plain-text sentence
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+	formatXLSX = "xlsx"
+)
+
+// The content types of the response formats, also matched against the Accept header
+var formatContentTypes = map[string]string{
+	formatJSON: "application/json",
+	formatCSV:  "text/csv",
+	formatXLSX: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// The sinks /crashlogs writes to when asked by the sink parameter, ex: sink=google,notify
+var crashLogSinks = []string{"google", "excel", "notify", "es", "db"}
+
+// negotiateFormat returns the format parameter, or the first format the Accept
+// header asks for. Empty keeps the plain-text answer of the Google Sheets or Excel write.
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", fmt.Errorf("unknown format: %s, ex: json, csv or xlsx", format)
+		}
+		return format, nil
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		for format, contentType := range formatContentTypes {
+			if strings.EqualFold(mediaType, contentType) {
+				return format, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// parseSinks parses the comma separated sink parameter
+func parseSinks(list string) ([]string, error) {
+	var sinks []string
+	for _, sink := range strings.Split(list, ",") {
+		sink = strings.ToLower(strings.TrimSpace(sink))
+		if sink == "" {
+			continue
+		}
+		known := false
+		for _, s := range crashLogSinks {
+			known = known || s == sink
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown sink: %s, ex: %s", sink, strings.Join(crashLogSinks, ","))
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// crashLogResponse is the JSON answer of /crashlogs
+type crashLogResponse struct {
+	Query   report.Query       `json:"query"`
+	Crashes int                `json:"crashes"`
+	Devices int                `json:"devices"`
+	Groups  []groupResponse    `json:"groups"`
+	Rates   []installbase.Rate `json:"rates,omitempty"`
+	// Breakdown is the rates of all signatures per model, then per model and version
+	Breakdown []installbase.Rate `json:"breakdown,omitempty"`
+	// Sinks maps every asked sink to "ok" or the error writing to it
+	Sinks map[string]string `json:"sinks,omitempty"`
+	// Spreadsheet is the URL of the spreadsheet the google sink wrote
+	Spreadsheet string `json:"spreadsheet,omitempty"`
+}
+
+// groupResponse is a crash group and the crash logs the dedup policy keeps
+type groupResponse struct {
+	report.Group
+	Subsystem string              `json:"subsystem"`
+	Module    string              `json:"module"`
+	Written   []crashlog.CrashLog `json:"written"`
+}
+
+// respondCrashLogs answers with the crash groups as JSON, the kept crash logs
+// as CSV or the workbook as an xlsx download. Nothing is written anywhere else
+// but the asked sinks.
+func respondCrashLogs(w http.ResponseWriter, r *http.Request, format string, crashLogs []crashlog.CrashLog, opts report.Options, sinks []string) {
+	columns, err := export.ParseColumns(r.URL.Query().Get("columns"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, spreadsheetURL := writeSinks(crashLogs, opts, sinks)
+	groups := report.Groups(crashLogs, opts)
+
+	switch format {
+	case formatJSON:
+		response := crashLogResponse{
+			Query:       opts.Query,
+			Crashes:     len(crashLogs),
+			Groups:      make([]groupResponse, 0, len(groups)),
+			Sinks:       results,
+			Spreadsheet: spreadsheetURL,
+		}
+		devices := make(map[string]bool)
+		for _, log := range crashLogs {
+			devices[log.AnonymousDeviceID] = true
+		}
+		response.Devices = len(devices)
+		for _, group := range groups {
+			attribution := ownership.Attribute(group.CrashLog, owners)
+			response.Groups = append(response.Groups, groupResponse{
+				Group:     group,
+				Subsystem: attribution.Subsystem,
+				Module:    attribution.Module,
+				Written:   group.Written,
+			})
+		}
+		if installBase != nil {
+			response.Rates = installbase.ComputeRates(crashLogs, installBase, owners)
+			response.Breakdown = installbase.ComputeBreakdown(crashLogs, installBase)
+		}
+
+		w.Header().Set("Content-Type", formatContentTypes[formatJSON])
+		err = json.NewEncoder(w).Encode(response)
+		if err != nil {
+			log.Println("Write JSON response failed with: ", err)
+		}
+
+	case formatCSV:
+		var written []crashlog.CrashLog
+		for _, group := range groups {
+			written = append(written, group.Written...)
+		}
+		setDownload(w, format, crashLogs, opts)
+		err = export.Write(w, export.CSV, written, columns, owners)
+		if err != nil {
+			log.Println("Write CSV response failed with: ", err)
+		}
+
+	case formatXLSX:
+		setDownload(w, format, crashLogs, opts)
+		err = localexcel.WriteExcel(w, crashLogs, opts)
+		if err != nil {
+			log.Println("Write xlsx response failed with: ", err)
+		}
+	}
+}
+
+// setDownload names the download after the Excel file of the crash logs
+func setDownload(w http.ResponseWriter, format string, crashLogs []crashlog.CrashLog, opts report.Options) {
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	fileName, err := opts.Output.Path(crashLogs, opts.Query, "."+format)
+	if err != nil {
+		fileName = "CrashLogs." + format
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(fileName)))
+}
+
+// writeSinks writes the crash logs to the asked sinks and returns the outcome
+// of each, and the spreadsheet URL of the google sink. The notification goes
+// last so it links the spreadsheet.
+func writeSinks(crashLogs []crashlog.CrashLog, opts report.Options, sinks []string) (map[string]string, string) {
+	if len(sinks) == 0 {
+		return nil, ""
+	}
+	results := make(map[string]string, len(sinks))
+	var spreadsheetURL string
+	notifying := false
+	for _, sink := range sinks {
+		var err error
+		switch sink {
+		case "google":
+			spreadsheetURL, err = googleapi.WriteCrashLogs(crashLogs, opts, googleAuth, googleDrive)
+		case "excel":
+			err = localexcel.CreateExcel(crashLogs, opts)
+		case "es":
+			err = writeEnriched(crashLogs)
+		case "db":
+			err = storeRun(opts.Query, crashLogs)
+		case "notify":
+			if notifyURL == "" {
+				err = errors.New("no -notify URL configured")
+			} else {
+				notifying = true
+			}
+		}
+		results[sink] = "ok"
+		if err != nil {
+			log.Printf("Write to %s failed with: %s\n", sink, err)
+			results[sink] = err.Error()
+		}
+	}
+	if notifying {
+		sendNotification(crashLogs, spreadsheetURL)
+	}
+	return results, spreadsheetURL
+}
+
+// ticketHandler renders the report, or the crash group of the group parameter
+// (a fingerprint or sheet name), as Markdown or Jira markup to paste into a ticket
+func ticketHandler(w http.ResponseWriter, r *http.Request) {
+	query, dedup, err := parseCrashLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := ticket.ParseFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	crashLogs, err := fetchCrashLogs(query.ProductLine, query.Date, query.To, query.Version, query.Model, query.Size)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch crash logs: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if len(crashLogs) == 0 {
+		http.Error(w, "no crash logs found", http.StatusNotFound)
+		return
+	}
+
+	text, err := renderTicket(crashLogs, report.Options{Dedup: dedup, Owners: owners, Query: query}, format, r.URL.Query().Get("group"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
+
+// renderTicket renders the whole report, or only the crash groups matching group if set
+func renderTicket(crashLogs []crashlog.CrashLog, opts report.Options, format ticket.Format, group string) (string, error) {
+	if group == "" {
+		return ticket.Report(crashLogs, opts, format), nil
+	}
+	groups := ticket.FindGroups(report.Groups(crashLogs, opts), group)
+	if len(groups) == 0 {
+		return "", fmt.Errorf("no crash group found: %s", group)
+	}
+	var text strings.Builder
+	for _, g := range groups {
+		text.WriteString(ticket.Group(g, format, opts.Owners))
+	}
+	return text.String(), nil
+}
+
+// writeRates appends the crash rates per 1k devices to the response
+func writeRates(w http.ResponseWriter, crashLogs []crashlog.CrashLog) {
+	if installBase == nil {
+		return
+	}
+	for _, rate := range installbase.ComputeBreakdown(crashLogs, installBase) {
+		version := rate.Version
+		if version == "" {
+			version = "all versions"
+		}
+		fmt.Fprintf(w, "\n%s %s: %d crashes, %d devices, %.3f crashes per 1k, %.3f devices per 1k",
+			rate.Model, version, rate.Crashes, rate.Devices, rate.CrashesPer1k, rate.DevicesPer1k)
+	}
+	for _, rate := range installbase.ComputeRates(crashLogs, installBase, owners) {
+		fmt.Fprintf(w, "\n%s %s %s [%s] (%s): %d crashes, %d devices, %.3f crashes per 1k, %.3f devices per 1k",
+			rate.Model, rate.Version, rate.Reason, rate.Fingerprint, rate.Owner, rate.Crashes, rate.Devices, rate.CrashesPer1k, rate.DevicesPer1k)
+	}
+}
+
+// fetchCrashLogs fetches the crash logs of the date, or of every date up to to if provided.
+// The sensitive data is redacted here, before the crash logs reach any writer.
+// The run and its crash logs are kept in the -db store.
+func fetchCrashLogs(productLine, date, to, version, model string, size int) ([]crashlog.CrashLog, error) {
+	crashLogs, err := fetchRedacted(productLine, date, to, version, model, size)
+	if err != nil {
+		return nil, err
+	}
+	saveRun(report.Query{ProductLine: productLine, Date: date, To: to, Version: version, Model: model, Size: size}, crashLogs)
+	return crashLogs, nil
+}
+
+// fetchRedacted is fetchCrashLogs without keeping the run
+func fetchRedacted(productLine, date, to, version, model string, size int) ([]crashlog.CrashLog, error) {
+	var crashLogs []crashlog.CrashLog
+	var err error
+	if to == "" {
+		crashLogs, err = crashlog.FetchCrashLogs(productLine, date, version, model, size)
+	} else {
+		crashLogs, err = crashlog.FetchCrashLogsRange(productLine, date, to, version, model, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return redactor.CrashLogs(crashLogs), nil
+}
+
+// saveRun keeps the run and its crash logs in the -db store, a failure doesn't stop the report
+func saveRun(query report.Query, crashLogs []crashlog.CrashLog) {
+	if crashStore == nil {
+		return
+	}
+	err := storeRun(query, crashLogs)
+	if err != nil {
+		log.Println("Save run failed with: ", err)
+	}
+}
+
+// storeRun keeps the run and its crash logs in the -db store
+func storeRun(query report.Query, crashLogs []crashlog.CrashLog) error {
+	if crashStore == nil {
+		return errors.New("no -db store configured")
+	}
+	run, err := crashStore.SaveRun(store.Run{Mode: runMode, Query: query}, crashLogs, owners)
+	if err != nil {
+		return err
+	}
+	log.Printf("Saved run %d: %d crash logs, %d new\n", run.ID, run.Crashes, run.NewCrashes)
+	return nil
+}
+
+// fetchTargetCrashLogs fetches the crash logs of a metrics target, redacted like every
+// other fetch. The periodic queries aren't report runs, they aren't kept in the store.
+func fetchTargetCrashLogs(target metrics.Target, from, to string, size int) ([]crashlog.CrashLog, error) {
+	return fetchRedacted(target.ProductLine, from, to, target.Version, target.Model, size)
+}
+
+// sendNotification posts the report summary to the chat webhook, boot looping
+// devices first, linking the spreadsheet if its URL isn't empty
+func sendNotification(crashLogs []crashlog.CrashLog, spreadsheetURL string) {
+	if notifyURL == "" || len(crashLogs) == 0 {
+		return
+	}
+
+	title := fmt.Sprintf("Kernel crash report: %s %s %s", crashLogs[0].Model, crashLogs[0].Version, crashLogs[0].SystemTime.Format("2006-01-02"))
+	loops := bootloop.Detect(crashLogs, bootloop.DefaultOptions)
+	// The URL is added after the redaction, it would be taken for a hostname
+	text := redactor.String(notify.Summary(title, crashLogs, loops, owners))
+	if spreadsheetURL != "" {
+		text += "\nSpreadsheet: " + spreadsheetURL + "\n"
+	}
+	err := notify.Send(notifyURL, text)
+	if err != nil {
+		log.Println("Send notification failed with: ", err)
+	}
 }
 
 func webhookHandler(w http.ResponseWriter, r *http.Request) {
@@ -94,52 +535,519 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	crashlogHandler(w, r)
 }
 
-func writeCrashLogsToExcel(productLine, date, version, model string, size int, unique bool) error {
+func writeCrashLogsToExcel(productLine, date, to, version, model string, size int, dedup report.Dedup) error {
 	// Fetch crash logs
-	crashLogs, err := crashlog.FetchCrashLogs(productLine, date, version, model, size)
+	crashLogs, err := fetchCrashLogs(productLine, date, to, version, model, size)
 	if err != nil {
 		return fmt.Errorf("failed to fetch crash logs: %s", err)
 	}
 
 	// Write crash logs to Excel
-	err = localexcel.CreateExcel(crashLogs, unique)
+	err = localexcel.CreateExcel(crashLogs, report.Options{
+		Dedup:       dedup,
+		InstallBase: installBase,
+		Owners:      owners,
+		Query:       report.Query{ProductLine: productLine, Date: date, To: to, Version: version, Model: model, Size: size},
+		Output:      output,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create Excel: %s", err)
 	}
 
 	fmt.Println("Crash logs written to Excel")
+	sendNotification(crashLogs, "")
 	return nil
 }
 
-func writeCrashLogsToGoogleSheets(productLine, date, version, model string, size int) error {
+func writeCrashLogsToGoogleSheets(productLine, date, to, version, model string, size int, dedup report.Dedup) error {
 	// Fetch crash logs
-	crashLogs, err := crashlog.FetchCrashLogs(productLine, date, version, model, size)
+	crashLogs, err := fetchCrashLogs(productLine, date, to, version, model, size)
 	if err != nil {
 		return fmt.Errorf("failed to fetch crash logs: %s", err)
 	}
 
 	// Write crash logs to Google Sheets
-	err = googleapi.WriteCrashLogs(crashLogs)
+	spreadsheetURL, err := googleapi.WriteCrashLogs(crashLogs, report.Options{
+		Dedup:       dedup,
+		InstallBase: installBase,
+		Owners:      owners,
+		Query:       report.Query{ProductLine: productLine, Date: date, To: to, Version: version, Model: model, Size: size},
+		Output:      output,
+	}, googleAuth, googleDrive)
 	if err != nil {
 		return fmt.Errorf("failed to write crash logs to Google Sheets: %s", err)
 	}
 
-	fmt.Println("Crash logs written to Google Sheets")
+	fmt.Println("Crash logs written to Google Sheets:", spreadsheetURL)
+	sendNotification(crashLogs, spreadsheetURL)
+	return nil
+}
+
+func writeCrashLogsToHTML(productLine, date, to, version, model string, size int, dedup report.Dedup) error {
+	// Fetch crash logs
+	crashLogs, err := fetchCrashLogs(productLine, date, to, version, model, size)
+	if err != nil {
+		return fmt.Errorf("failed to fetch crash logs: %s", err)
+	}
+
+	// Write crash logs to a single HTML file
+	err = htmlreport.CreateHTML(crashLogs, report.Options{
+		Dedup:       dedup,
+		InstallBase: installBase,
+		Owners:      owners,
+		Query:       report.Query{ProductLine: productLine, Date: date, To: to, Version: version, Model: model, Size: size},
+		Output:      output,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create HTML: %s", err)
+	}
+
+	fmt.Println("Crash logs written to HTML")
+	sendNotification(crashLogs, "")
+	return nil
+}
+
+// writeCrashLogsToFile exports the crash logs the dedup policy keeps as CSV or NDJSON
+// records, streamed to stdout, or to a file named like the Excel file if -out is set
+func writeCrashLogsToFile(format export.Format, productLine, date, to, version, model string, size int, dedup report.Dedup, columns []string) error {
+	// Fetch crash logs
+	crashLogs, err := fetchCrashLogs(productLine, date, to, version, model, size)
+	if err != nil {
+		return fmt.Errorf("failed to fetch crash logs: %s", err)
+	}
+
+	opts := report.Options{
+		Dedup:  dedup,
+		Owners: owners,
+		Query:  report.Query{ProductLine: productLine, Date: date, To: to, Version: version, Model: model, Size: size},
+		Output: output,
+	}
+	var written []crashlog.CrashLog
+	for _, group := range report.Groups(crashLogs, opts) {
+		written = append(written, group.Written...)
+	}
+
+	out := os.Stdout
+	if output.Dir != "" && len(written) > 0 {
+		fileName, err := output.Path(written, opts.Query, "."+string(format))
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(output.Dir, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create output directory: %s", err)
+		}
+		f, err := os.Create(fileName)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %s", fileName, err)
+		}
+		defer f.Close()
+		out = f
+		log.Println("Writing crash logs to", fileName)
+	}
+
+	err = export.Write(out, format, written, columns, owners)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", format, err)
+	}
+
+	// Stdout holds the records, the notification note goes to the log
+	log.Printf("%d crash logs written as %s\n", len(written), format)
+	sendNotification(crashLogs, "")
+	return nil
+}
+
+// writeCrashLogsToES indexes the enriched crash logs into the -es-url cluster
+func writeCrashLogsToES(productLine, date, to, version, model string, size int) error {
+	// Fetch crash logs
+	crashLogs, err := fetchCrashLogs(productLine, date, to, version, model, size)
+	if err != nil {
+		return fmt.Errorf("failed to fetch crash logs: %s", err)
+	}
+
+	err = writeEnriched(crashLogs)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Crash logs written to Elasticsearch")
+	return nil
+}
+
+// writeEnriched indexes every crash log with its classification, the dedup policy doesn't apply
+func writeEnriched(crashLogs []crashlog.CrashLog) error {
+	if enrichSink == nil {
+		return errors.New("no -es-url configured")
+	}
+	_, err := enrichSink.Write(crashLogs)
+	if err != nil {
+		return fmt.Errorf("failed to index enriched crash logs: %s", err)
+	}
+	return nil
+}
+
+// writeCrashLogsToTicket prints the report, or one crash group, as Markdown or Jira markup to stdout
+func writeCrashLogsToTicket(format ticket.Format, group, productLine, date, to, version, model string, size int, dedup report.Dedup) error {
+	// Fetch crash logs
+	crashLogs, err := fetchCrashLogs(productLine, date, to, version, model, size)
+	if err != nil {
+		return fmt.Errorf("failed to fetch crash logs: %s", err)
+	}
+	if len(crashLogs) == 0 {
+		return fmt.Errorf("no crash logs found")
+	}
+
+	text, err := renderTicket(crashLogs, report.Options{
+		Dedup:  dedup,
+		Owners: owners,
+		Query:  report.Query{ProductLine: productLine, Date: date, To: to, Version: version, Model: model, Size: size},
+	}, format, group)
+	if err != nil {
+		return err
+	}
+	fmt.Print(text)
+	return nil
+}
+
+// lookupDevice prints the crash history of one device across a date range,
+// ex: go run main.go device <id> -p network -from 2023_06_01 -to 2023_06_15
+func lookupDevice(args []string) error {
+	fs := flag.NewFlagSet("device", flag.ExitOnError)
+	productLine := fs.String("p", "network", "The product line, ex: product or network")
+	from := fs.String("from", "", "The first date, ex: 2023_06_01")
+	to := fs.String("to", "", "The last date, ex: 2023_06_15, default is the first date")
+	size := fs.Int("s", 100, "The size(the crash log counts per day), ex: 100")
+	ownersFile := fs.String("o", "", "The ownership file(JSON mapping subsystems and modules to teams), ex: owners.json")
+	dbFile := fs.String("db", "", "Read the crashes from the SQLite store instead of Elasticsearch, -p and -s are then ignored, ex: crashes.db")
+
+	// The device ID may come before or after the flags
+	deviceID := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		deviceID = args[0]
+		args = args[1:]
+	}
+	fs.Parse(args)
+	if deviceID == "" {
+		deviceID = fs.Arg(0)
+	}
+	if deviceID == "" || (*from == "" && *dbFile == "") {
+		return fmt.Errorf("usage: device <id> -p <product line> -from <date> [-to <date>] [-db <file>]")
+	}
+	if *ownersFile != "" {
+		o, err := ownership.Load(*ownersFile)
+		if err != nil {
+			return err
+		}
+		owners = o
+	}
+
+	var crashLogs []crashlog.CrashLog
+	var err error
+	if *dbFile != "" {
+		crashLogs, err = storedCrashLogs(*dbFile, store.Filter{Device: deviceID, From: *from, To: *to})
+	} else {
+		crashLogs, err = crashlog.FetchDeviceCrashLogs(*productLine, *from, *to, deviceID, *size)
+	}
+	if err != nil {
+		return err
+	}
+
+	history := devicehistory.Lookup(crashLogs, deviceID, owners)
+	if history == nil {
+		fmt.Printf("No crash found for device %s\n", deviceID)
+		return nil
+	}
+
+	fmt.Printf("Device: %s\nModel: %s\nCrashes: %d\nRepeat offender: %t\nSignatures: %s\n\n",
+		history.DeviceID, history.Model, len(history.Crashes), history.RepeatOffender, strings.Join(history.Signatures, ", "))
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SYSTEM TIME\tUPTIME\tVERSION\tFINGERPRINT\tOWNER\tREASON")
+	for _, crash := range history.Crashes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			crash.SystemTime.Format(time.RFC3339), crash.FormattedUptime(), crash.Version, crash.Fingerprint, crash.Owner, crash.Reason)
+	}
+	return tw.Flush()
+}
+
+// storedCrashLogs reads the crash logs matching the filter from the SQLite store
+func storedCrashLogs(path string, filter store.Filter) ([]crashlog.CrashLog, error) {
+	st, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+	return st.Crashes(filter)
+}
+
+// queryHistory prints what the SQLite store kept across runs: the signatures
+// with their first and last seen dates, the daily trend, the crashes or the runs,
+// ex: go run main.go history signatures -db crashes.db -m UDMPRO -from 2023_06_01
+func queryHistory(args []string) error {
+	const usage = "usage: history signatures|trend|crashes|runs -db <file> [-m <model>] [-v <version>] [-from <date>] [-to <date>] [-device <id>] [-fingerprint <fingerprint>]"
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New(usage)
+	}
+	kind := args[0]
+
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	dbFile := fs.String("db", "", "The SQLite store, ex: crashes.db")
+	var filter store.Filter
+	fs.StringVar(&filter.Model, "m", "", "The model, ex: UDMPRO")
+	fs.StringVar(&filter.Version, "v", "", "The version, ex: 3.1.9 or v3.1.9")
+	fs.StringVar(&filter.From, "from", "", "The first date, ex: 2023_06_01")
+	fs.StringVar(&filter.To, "to", "", "The last date, ex: 2023_06_15")
+	fs.StringVar(&filter.Device, "device", "", "The anonymous device ID")
+	fs.StringVar(&filter.Fingerprint, "fingerprint", "", "The crash signature fingerprint, ex: 3f2a9c1be07d")
+	fs.IntVar(&filter.Limit, "limit", 0, "The rows printed at most, default is all of them")
+	fs.Parse(args[1:])
+	if *dbFile == "" {
+		return errors.New(usage)
+	}
+
+	st, err := store.Open(*dbFile)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	switch kind {
+	case "signatures":
+		signatures, err := st.Signatures(filter)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "FINGERPRINT\tCRASHES\tDEVICES\tFIRST SEEN\tLAST SEEN\tCATEGORY\tOWNER\tREASON")
+		for _, sig := range signatures {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", sig.Fingerprint, sig.Crashes, sig.Devices,
+				sig.FirstSeen.Format(time.RFC3339), sig.LastSeen.Format(time.RFC3339), sig.Category, sig.Owner, sig.Reason)
+		}
+	case "trend":
+		points, err := st.Trend(filter)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "DATE\tFINGERPRINT\tCRASHES\tDEVICES")
+		for _, p := range points {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", p.Date, p.Fingerprint, p.Crashes, p.Devices)
+		}
+	case "crashes":
+		crashLogs, err := st.Crashes(filter)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "SYSTEM TIME\tDEVICE\tMODEL\tVERSION\tFINGERPRINT\tREASON")
+		for _, log := range crashLogs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", log.SystemTime.Format(time.RFC3339), log.AnonymousDeviceID, log.Model, log.Version,
+				crashlogutil.Fingerprint(log.CrashLog), crashlogutil.Reason(log.CrashLog))
+		}
+	case "runs":
+		runs, err := st.Runs(filter.Limit)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "RUN\tSTARTED\tMODE\tPRODUCT LINE\tDATE\tTO\tMODEL\tVERSION\tCRASHES\tNEW")
+		for _, run := range runs {
+			q := run.Query
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", run.ID, run.StartedAt.Format(time.RFC3339), run.Mode,
+				q.ProductLine, q.Date, q.To, q.Model, q.Version, run.Crashes, run.NewCrashes)
+		}
+	default:
+		return errors.New(usage)
+	}
+	return tw.Flush()
+}
+
+// googleAuthFlags adds the -google-* flags setting googleAuth, the returned
+// function parses the auth mode after the flags are parsed
+func googleAuthFlags(fs *flag.FlagSet) func() error {
+	fs.StringVar(&googleAuth.CredentialsFile, "google-credentials", googleAuth.CredentialsFile, "The Google credentials file(an OAuth client, service account or external account key), or $"+googleapi.CredentialsEnv+", ex: credential/credentials.json")
+	fs.StringVar(&googleAuth.TokenFile, "google-token", googleAuth.TokenFile, "The OAuth token file, refreshed tokens are saved into it, or $"+googleapi.TokenEnv+", ex: credential/token.json")
+	authMode := fs.String("google-auth", string(googleAuth.Mode), "The Google auth, ex: auto(by the credentials file), service-account, oauth(consent in a browser), device(code entered on another device) or default(application default credentials), or $"+googleapi.AuthModeEnv)
+	return func() error {
+		mode, err := googleapi.ParseAuthMode(*authMode)
+		googleAuth.Mode = mode
+		return err
+	}
+}
+
+// googleDriveFlags adds the -drive-folder and -share-* flags setting googleDrive,
+// the returned function parses the grantees after the flags are parsed
+func googleDriveFlags(fs *flag.FlagSet) func() error {
+	fs.StringVar(&googleDrive.FolderID, "drive-folder", "", "The Drive folder ID(the last part of its URL) to create the spreadsheets in, a shared drive folder works with service accounts, ex: 0ABcDeFgHiJkLUk9PVA")
+	readers := fs.String("share-readers", "", "The grantees who may read the spreadsheets, comma separated, an e-mail is a user, ex: alice@example.com,group:kernel@example.com,domain:example.com,anyone")
+	writers := fs.String("share-writers", "", "The grantees who may edit the spreadsheets, comma separated, ex: group:kernel-leads@example.com")
+	fs.BoolVar(&googleDrive.Notify, "share-notify", false, "E-mail the users and groups the spreadsheets are shared with")
+	return func() error {
+		var err error
+		googleDrive.Readers, err = googleapi.ParseGrantees(*readers)
+		if err != nil {
+			return err
+		}
+		googleDrive.Writers, err = googleapi.ParseGrantees(*writers)
+		return err
+	}
+}
+
+// authorizeGoogle gets a Google token and saves it, so the webhook mode needs no consent,
+// ex: go run main.go auth -google-auth device, the Drive flags authorize the Drive API as well
+func authorizeGoogle(args []string) error {
+	fs := flag.NewFlagSet("auth", flag.ExitOnError)
+	parseAuthMode := googleAuthFlags(fs)
+	parseGrantees := googleDriveFlags(fs)
+	fs.Parse(args)
+	err := parseAuthMode()
+	if err != nil {
+		return err
+	}
+	err = parseGrantees()
+	if err != nil {
+		return err
+	}
+
+	err = googleapi.Authorize(context.Background(), googleAuth, googleDrive.Scopes()...)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Google auth ok:", googleAuth.Mode)
 	return nil
 }
 
 func main() {
+	// Sub-commands come before the flags
+	if len(os.Args) > 1 && os.Args[1] == "auth" {
+		err := authorizeGoogle(os.Args[2:])
+		if err != nil {
+			log.Fatal("Google auth failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		err := queryHistory(os.Args[2:])
+		if err != nil {
+			log.Fatal("History query failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "device" {
+		err := lookupDevice(os.Args[2:])
+		if err != nil {
+			log.Fatal("Device lookup failed: ", err)
+		}
+		return
+	}
+
 	// Define command-line flags
-	mode := flag.String("mode", "", "The mode, ex: google mean googlesheet, excel or webhook mean waiting for notify from Grafana, default is webhook ")
+	mode := flag.String("mode", "", "The mode, ex: google mean googlesheet, excel, html, csv or ndjson(records to stdout or -out), markdown or jira(ticket markup to stdout), es(enriched crash logs to -es-url) or webhook mean waiting for notify from Grafana, default is webhook ")
 	productLine := flag.String("p", "", "The product line, ex: product or network")
 	date := flag.String("d", "", "The date, ex: 2023_06_15")
+	to := flag.String("to", "", "The last date of a date range starting from -d, ex: 2023_06_17, default is -d only")
 	version := flag.String("v", "", "The version, ex: 3.1.9 or v3.1.9")
 	model := flag.String("m", "", "The model, ex: UDM,UDMPRO,UDMPROSE,UDR,UDW,UDWPRO,UNASPRO,UCKG2,UCKP,UCKENT,UNVR,UNVRPRO")
 	size := flag.Int("s", 10, "The size(the total crash log counts), ex: 10")
-	unique := flag.Bool("u", true, "Writing unique logs to excel , ex: true")
+	dedupPolicy := flag.String("dedup", "device", "The dedup policy, ex: none, device(one entry per device), device-signature(one entry per device and signature) or samples(first -samples entries per signature)")
+	samples := flag.Int("samples", report.DefaultSamples, "The entries per signature of the samples dedup policy, ex: 3")
+	installBaseFile := flag.String("b", "", "The install-base file(CSV or JSON of model, version and active devices) for crash rates per 1k devices, ex: installbase.csv")
+	ownersFile := flag.String("o", "", "The ownership file(JSON mapping subsystems and modules to teams), ex: owners.json")
+	redactMode := flag.String("redact", "", "Redact MAC, IP, serial numbers, hostnames and user paths before export, ex: mask, hash or drop")
+	redactConfig := flag.String("redact-config", "", "The redaction config file(JSON of detectors, user-defined regexes and modes), ex: redact.json")
+	flag.StringVar(&output.Dir, "out", "", "The directory of the Excel file, default is the working directory, ex: reports")
+	flag.StringVar(&output.FileName, "name", report.DefaultFileName, "The file name template without the extension, fields: .ProductLine .Model .Version .Date .Week, ex: CrashLogs-{{.Model}}-{{.Version}}-{{.Week}}")
+	flag.BoolVar(&output.Merge, "merge", false, "Append only the crashes not recorded yet into the existing Excel file of the same name, ex: a running weekly workbook")
+	columnList := flag.String("columns", "", "The columns of the csv and ndjson modes, comma separated, ex: "+strings.Join(export.DefaultColumns, ","))
+	group := flag.String("group", "", "The crash group of the markdown and jira modes, a fingerprint or sheet name, default is the whole report, ex: 3f2a9c1be07d")
+	metricsFile := flag.String("metrics", "", "The metrics file(JSON of the model and version sets to query periodically) of the /metrics endpoint in webhook mode, ex: metrics.json")
+	esURL := flag.String("es-url", "", "The Elasticsearch or OpenSearch URL to index the enriched crash logs into, user and password may be in the URL, ex: http://localhost:9200")
+	esIndex := flag.String("es-index", esindex.DefaultIndex, "The index prefix of the enriched crash logs, the crash date is appended, ex: crash_enriched_")
+	knownIssuesFile := flag.String("known-issues", "", "The known issues file(JSON mapping fingerprints to issue keys) of the enriched crash logs, ex: known-issues.json")
+	dbFile := flag.String("db", "", "The SQLite file keeping every fetched crash, its analysis and the runs, ex: crashes.db")
+	flag.StringVar(&notifyURL, "notify", "", "The chat webhook URL to post the report summary to, ex: https://hooks.slack.com/services/...")
+	parseAuthMode := googleAuthFlags(flag.CommandLine)
+	parseGrantees := googleDriveFlags(flag.CommandLine)
 	// Parse command-line flags
 	flag.Parse()
 
+	err := parseAuthMode()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = parseGrantees()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Only the CLI modes may wait for the consent of a missing token
+	googleAuth.Interactive = *mode != ""
+
+	policy, err := report.ParsePolicy(*dedupPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dedup := report.Dedup{Policy: policy, Samples: *samples}
+
+	// Load the install base for the crash rates
+	if *installBaseFile != "" {
+		base, err := installbase.Load(*installBaseFile)
+		if err != nil {
+			log.Fatal("Failed to load install base:", err)
+		}
+		installBase = base
+	}
+
+	// Build the redactor, the flag mode overrides the mode of the config file
+	if *redactMode != "" || *redactConfig != "" {
+		var cfg redact.Config
+		if *redactConfig != "" {
+			c, err := redact.LoadConfig(*redactConfig)
+			if err != nil {
+				log.Fatal("Failed to load redaction config:", err)
+			}
+			cfg = c
+		}
+		if *redactMode != "" {
+			cfg.Mode = redact.Mode(*redactMode)
+		}
+		r, err := redact.New(cfg)
+		if err != nil {
+			log.Fatal("Failed to create redactor:", err)
+		}
+		redactor = r
+	}
+
+	// Load the team ownership of the crashes
+	if *ownersFile != "" {
+		o, err := ownership.Load(*ownersFile)
+		if err != nil {
+			log.Fatal("Failed to load ownership file:", err)
+		}
+		owners = o
+	}
+
+	// Open the crash store, every fetch is kept in it
+	if *dbFile != "" {
+		st, err := store.Open(*dbFile)
+		if err != nil {
+			log.Fatal("Failed to open crash store:", err)
+		}
+		defer st.Close()
+		crashStore = st
+	}
+	if *mode != "" {
+		runMode = *mode
+	}
+
+	// Build the enriched crash index sink
+	if *esURL != "" {
+		enrichSink = esindex.New(*esURL, *esIndex)
+		enrichSink.Owners = owners
+		if *knownIssuesFile != "" {
+			issues, err := esindex.LoadKnownIssues(*knownIssuesFile)
+			if err != nil {
+				log.Fatal("Failed to load known issues:", err)
+			}
+			enrichSink.KnownIssues = issues
+		}
+	}
+
 	// Attach prefix 'v' to version if it's not present
 	if *version != "" && !strings.HasPrefix(*version, "v") {
 		*version = "v" + *version
@@ -149,31 +1057,76 @@ func main() {
 	// Check if a command-line mode flag is provided
 	if *mode != "" {
 		// Debug output
-		log.Printf("Parse CLI: mode: %s, productLine: %s, date: %s, version: %s, model: %s, size: %d, unique: %t\n", *mode, *productLine, *date, *version, *model, *size, *unique)
+		log.Printf("Parse CLI: mode: %s, productLine: %s, date: %s, version: %s, model: %s, size: %d, dedup: %s\n", *mode, *productLine, *date, *version, *model, *size, dedup.Policy)
 
 		// Call the CLI function based on the provided command
 		switch *mode {
 		case "excel":
-			err := writeCrashLogsToExcel(*productLine, *date, *version, *model, *size, *unique)
+			err := writeCrashLogsToExcel(*productLine, *date, *to, *version, *model, *size, dedup)
 			if err != nil {
 				fmt.Println("Error writing crash logs to Excel:", err)
 			}
 		case "google":
-			err := writeCrashLogsToGoogleSheets(*productLine, *date, *version, *model, *size)
+			err := writeCrashLogsToGoogleSheets(*productLine, *date, *to, *version, *model, *size, dedup)
 			if err != nil {
 				fmt.Println("Error writing crash logs to Google Sheets:", err)
 			}
+		case "html":
+			err := writeCrashLogsToHTML(*productLine, *date, *to, *version, *model, *size, dedup)
+			if err != nil {
+				fmt.Println("Error writing crash logs to HTML:", err)
+			}
+		case "csv", "ndjson":
+			columns, err := export.ParseColumns(*columnList)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = writeCrashLogsToFile(export.Format(*mode), *productLine, *date, *to, *version, *model, *size, dedup, columns)
+			if err != nil {
+				log.Println("Error exporting crash logs:", err)
+			}
+		case "es":
+			err := writeCrashLogsToES(*productLine, *date, *to, *version, *model, *size)
+			if err != nil {
+				log.Println("Error writing crash logs to Elasticsearch:", err)
+			}
+		case "markdown", "jira":
+			err := writeCrashLogsToTicket(ticket.Format(*mode), *group, *productLine, *date, *to, *version, *model, *size, dedup)
+			if err != nil {
+				log.Println("Error rendering crash logs:", err)
+			}
 		default:
 			log.Println("Invalid command. Usage: go run main.go [command]")
 			log.Println("Available commands:")
 			log.Println("  excel - Write crash logs to Excel")
 			log.Println("  google - Write crash logs to Google Sheets")
+			log.Println("  html - Write crash logs to a single HTML file")
+			log.Println("  csv - Write crash log records as CSV to stdout or -out")
+			log.Println("  ndjson - Write crash log records as NDJSON to stdout or -out")
+			log.Println("  es - Index the enriched crash logs into -es-url")
+			log.Println("  markdown - Print the report or the -group crash group as GitHub-flavored Markdown")
+			log.Println("  jira - Print the report or the -group crash group as Jira wiki markup")
 		}
 	} else {
 		// Webhook mode
 		r := mux.NewRouter()
 		r.HandleFunc("/webhook", webhookHandler).Methods(http.MethodPost)
 		r.HandleFunc("/crashlogs", crashlogHandler).Methods(http.MethodGet)
+		r.HandleFunc("/crashlogs/ticket", ticketHandler).Methods(http.MethodGet)
+
+		// Expose the crash signature metrics of the configured targets to Prometheus
+		if *metricsFile != "" {
+			cfg, err := metrics.Load(*metricsFile)
+			if err != nil {
+				log.Fatal("Failed to load metrics file:", err)
+			}
+			collector, err := metrics.NewCollector(cfg, fetchTargetCrashLogs, owners, installBase)
+			if err != nil {
+				log.Fatal("Failed to create metrics collector:", err)
+			}
+			go collector.Run()
+			r.Handle("/metrics", collector).Methods(http.MethodGet)
+		}
 		//http.HandleFunc("/crashlogs", crashlogHandler)
 		//http.HandleFunc("/webhook", webhook.HandleWebhook)
 
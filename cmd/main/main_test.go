@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/report"
+	"grafana-extract-go/internal/store"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name, target, accept string
+		want                 string
+		wantErr              bool
+	}{
+		{name: "plain text", target: "/crashlogs"},
+		{name: "format parameter", target: "/crashlogs?format=CSV", want: formatCSV},
+		{name: "format parameter wins", target: "/crashlogs?format=xlsx", accept: "application/json", want: formatXLSX},
+		{name: "unknown format", target: "/crashlogs?format=pdf", wantErr: true},
+		{name: "accept", target: "/crashlogs", accept: "application/json", want: formatJSON},
+		{name: "first known accepted type", target: "/crashlogs", accept: "text/html, text/csv;q=0.9, application/json", want: formatCSV},
+		{name: "accept case", target: "/crashlogs", accept: "Application/Vnd.Openxmlformats-Officedocument.Spreadsheetml.Sheet", want: formatXLSX},
+		{name: "browser", target: "/crashlogs", accept: "text/html,application/xhtml+xml,*/*;q=0.8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			got, err := negotiateFormat(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("negotiateFormat error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("negotiateFormat = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSinks(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"google", []string{"google"}, false},
+		{" Excel, notify,,es", []string{"excel", "notify", "es"}, false},
+		{"db", []string{"db"}, false},
+		{"google,s3", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSinks(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSinks(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("parseSinks(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestParseCrashLogQuery(t *testing.T) {
+	tests := []struct {
+		target   string
+		wantSize int
+		want     report.Dedup
+		wantErr  bool
+	}{
+		{"/crashlogs?productLine=network&size=10", 10, report.Dedup{Policy: report.DedupDevice}, false},
+		{"/crashlogs?dedup=samples&samples=5", 0, report.Dedup{Policy: report.DedupSamples, Samples: 5}, false},
+		{"/crashlogs?dedup=unique", 0, report.Dedup{}, true},
+	}
+	for _, tt := range tests {
+		query, dedup, err := parseCrashLogQuery(httptest.NewRequest("GET", tt.target, nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.target, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (dedup != tt.want || query.Size != tt.wantSize) {
+			t.Errorf("%s: dedup = %+v, size %d, want %+v, size %d", tt.target, dedup, query.Size, tt.want, tt.wantSize)
+		}
+	}
+}
+
+func TestRespondCrashLogs(t *testing.T) {
+	crashLogs := []crashlog.CrashLog{
+		{AnonymousDeviceID: "a", SystemTime: time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC), Model: "UNVR", Version: "v3.1.9",
+			CrashLog: "<0>[  12.000100] Kernel panic - not syncing: Fatal exception"},
+		{AnonymousDeviceID: "a", SystemTime: time.Date(2023, 6, 15, 11, 0, 0, 0, time.UTC), Model: "UNVR", Version: "v3.1.9",
+			CrashLog: "<0>[  13.000100] Kernel panic - not syncing: Fatal exception"},
+		{AnonymousDeviceID: "b", SystemTime: time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC), Model: "UNVR", Version: "v3.1.9",
+			CrashLog: "<0>[  12.000100] Kernel panic - not syncing: Attempted to kill init!"},
+	}
+	opts := report.Options{
+		Dedup: report.Dedup{Policy: report.DedupDevice},
+		Query: report.Query{ProductLine: "protect", Date: "2023_06_15", Model: "UNVR", Version: "3.1.9"},
+	}
+
+	tests := []struct {
+		format      string
+		contentType string
+		check       func(t *testing.T, body string)
+	}{
+		{
+			format:      formatJSON,
+			contentType: "application/json",
+			check: func(t *testing.T, body string) {
+				var response crashLogResponse
+				err := json.Unmarshal([]byte(body), &response)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if response.Crashes != 3 || response.Devices != 2 || len(response.Groups) != 2 || response.Sinks != nil {
+					t.Errorf("response = %+v", response)
+				}
+			},
+		},
+		{
+			format:      formatCSV,
+			contentType: "text/csv",
+			check: func(t *testing.T, body string) {
+				records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The device policy writes one crash log per device
+				if len(records) != 3 || strings.Join(records[0], ",") != "anonymous_device_id,fingerprint" {
+					t.Errorf("records = %q", records)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/crashlogs?format="+tt.format+"&columns=anonymous_device_id,fingerprint", nil)
+			respondCrashLogs(w, r, tt.format, crashLogs, opts, nil)
+			if w.Code != 200 {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			tt.check(t, w.Body.String())
+		})
+	}
+}
+
+func TestRespondCrashLogsStore(t *testing.T) {
+	st, err := store.Open(filepath.Join(t.TempDir(), "crashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	crashStore = st
+	defer func() { crashStore = nil }()
+
+	crashLogs := []crashlog.CrashLog{{AnonymousDeviceID: "a", SystemTime: time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC), Model: "UNVR", Version: "v3.1.9",
+		CrashLog: "<0>[  12.000100] Kernel panic - not syncing: Fatal exception"}}
+	opts := report.Options{Query: report.Query{ProductLine: "protect", Date: "2023_06_15"}}
+
+	// The negotiated answer keeps nothing unless the db sink is asked
+	tests := []struct {
+		sinks    []string
+		wantRuns int
+	}{
+		{nil, 0},
+		{[]string{"db"}, 1},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		respondCrashLogs(w, httptest.NewRequest("GET", "/crashlogs?format=json", nil), formatJSON, crashLogs, opts, tt.sinks)
+		if w.Code != 200 {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		runs, err := st.Runs(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) != tt.wantRuns {
+			t.Errorf("sinks %v: got %d runs, want %d", tt.sinks, len(runs), tt.wantRuns)
+		}
+	}
+}
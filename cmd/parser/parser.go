@@ -3,19 +3,84 @@ package main
 import (
 	"flag"
 	"fmt"
+	"grafana-extract-go/internal/storage"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/tealeg/xlsx"
 )
 
+// isCrashSheet reports if the sheet holds a crash log, they start with the reason
+func isCrashSheet(sheet *xlsx.Sheet) bool {
+	if len(sheet.Rows) == 0 || len(sheet.Rows[0].Cells) == 0 {
+		return false
+	}
+	return strings.HasPrefix(sheet.Rows[0].Cells[0].String(), "Reason:")
+}
+
+// sheetLines returns the first column of the sheet
+func sheetLines(sheet *xlsx.Sheet) []string {
+	lines := make([]string, 0, len(sheet.Rows))
+	for _, row := range sheet.Rows {
+		if len(row.Cells) > 0 {
+			lines = append(lines, row.Cells[0].String())
+		}
+	}
+	return lines
+}
+
+// printStorageErrors prints the disk errors of every crash sheet, counted per block device and error class
+func printStorageErrors(xlFile *xlsx.File) {
+	counts := make(map[string]int)
+	sheets := make(map[string]int)
+	for _, sheet := range xlFile.Sheets {
+		if !isCrashSheet(sheet) {
+			continue
+		}
+		result := storage.AnalyzeLines(sheetLines(sheet))
+		found := make(map[string]bool)
+		for _, event := range result.Events {
+			key := fmt.Sprintf("%s\t%s", event.BlockDevice, event.Class)
+			counts[key]++
+			if !found[key] {
+				found[key] = true
+				sheets[key]++
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Println("Block device\tError class\tErrors\tSheets")
+	for _, key := range keys {
+		fmt.Printf("%s\t%d\t%d\n", key, counts[key], sheets[key])
+	}
+}
+
 func main() {
 	// Get keywords from command line arguments
 	keyword1Ptr := flag.String("keyword1", "", "First keyword for searching in Excel")
 	keyword2Ptr := flag.String("keyword2", "", "Second keyword for searching in Excel")
 	filePathPtr := flag.String("file", "", "Excel file path")
+	storagePtr := flag.Bool("storage", false, "Extract the disk errors instead of counting keywords")
 	flag.Parse()
 
+	// The storage analyzer doesn't need keywords
+	if *storagePtr && *filePathPtr != "" {
+		xlFile, err := xlsx.OpenFile(*filePathPtr)
+		if err != nil {
+			fmt.Println("Unable to open Excel file:", err)
+			os.Exit(1)
+		}
+		printStorageErrors(xlFile)
+		return
+	}
+
 	// Check if required parameters are provided
 	if *keyword1Ptr == "" || *filePathPtr == "" {
 		fmt.Println("Please provide the first keyword and Excel file path")
@@ -34,14 +99,11 @@ func main() {
 	keyword2Count := 0
 	bothKeywordsCount := 0
 
-	// #1
-	// Iterate through each sheet in the Excel file
-	//for _, sheet := range xlFile.Sheets {
-	// #2
-	// Iterate through each sheet, starting from 1
-	for i := 1; i < len(xlFile.Sheets)-1; i++ {
-		// Get the current sheet
-		sheet := xlFile.Sheets[i]
+	// Iterate through each crash sheet, the summary and analysis sheets are skipped
+	for _, sheet := range xlFile.Sheets {
+		if !isCrashSheet(sheet) {
+			continue
+		}
 
 		// Flags to track the presence of each keyword in the current sheet
 		keyword1Found := false
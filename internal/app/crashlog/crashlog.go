@@ -37,6 +37,8 @@ type CrashLog struct {
 	APIVersion          string    `json:"apiVersion"`
 	CleanVersion        string    `json:"clean_version"`
 	SortableVersion     int       `json:"sortable_version"`
+	// ID is the Elasticsearch _id of the crash log document
+	ID string `json:"id,omitempty"`
 }
 
 func FetchCrashLogs(productLine, date, version, model string, size int) ([]CrashLog, error) {
@@ -133,27 +135,124 @@ func FetchCrashLogs(productLine, date, version, model string, size int) ([]Crash
 	// 	  }
 	//   }' | jq
 
+	// Construct the query filters
+	must := []map[string]interface{}{
+		{
+			"term": map[string]interface{}{
+				"body.type": "kernel_crash",
+			},
+		},
+		{
+			"wildcard": map[string]interface{}{
+				"body.version": version,
+			},
+		},
+		{
+			"terms": map[string]interface{}{
+				"body.model.keyword": []string{model},
+			},
+		},
+	}
+
+	return search(url, must, size)
+}
+
+// FetchCrashLogsRange fetches the crash logs from every daily index between from and to, both included
+func FetchCrashLogsRange(productLine, from, to, version, model string, size int) ([]CrashLog, error) {
+	dates, err := DateRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var crashLogs []CrashLog
+	for _, date := range dates {
+		logs, err := FetchCrashLogs(productLine, date, version, model, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch crash logs of %s: %s", date, err)
+		}
+		crashLogs = append(crashLogs, logs...)
+	}
+
+	return crashLogs, nil
+}
+
+// FetchDeviceCrashLogs fetches the crash logs of one device from every daily index between from and to
+func FetchDeviceCrashLogs(productLine, from, to, deviceID string, size int) ([]CrashLog, error) {
+	if productLine == "" || deviceID == "" {
+		return nil, fmt.Errorf("productLine and deviceID arguments are required")
+	}
+	if size <= 0 {
+		size = 10
+	}
+
+	dates, err := DateRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	must := []map[string]interface{}{
+		{
+			"term": map[string]interface{}{
+				"body.type": "kernel_crash",
+			},
+		},
+		{
+			"term": map[string]interface{}{
+				"body.anonymous_device_id.keyword": deviceID,
+			},
+		},
+	}
+
+	var crashLogs []CrashLog
+	for _, date := range dates {
+		url := fmt.Sprintf("%s/%s_logs_%s/_search", ESBaseURL, productLine, date)
+		log.Println("Elasticsearch URL:", url)
+
+		logs, err := search(url, must, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch crash logs of %s: %s", date, err)
+		}
+		crashLogs = append(crashLogs, logs...)
+	}
+
+	return crashLogs, nil
+}
+
+// DateRange returns the index dates between from and to, ex: 2023_06_14, 2023_06_15.
+// An empty to means the same day as from.
+func DateRange(from, to string) ([]string, error) {
+	const layout = "2006_01_02"
+
+	if to == "" {
+		to = from
+	}
+	start, err := time.Parse(layout, from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from date: %s", err)
+	}
+	end, err := time.Parse(layout, to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to date: %s", err)
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("to date %s is before from date %s", to, from)
+	}
+
+	var dates []string
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Format(layout))
+	}
+
+	return dates, nil
+}
+
+// search sends the query to the Elasticsearch index url and returns the matched crash logs
+func search(url string, must []map[string]interface{}, size int) ([]CrashLog, error) {
 	// Construct the request body
 	requestBody := map[string]interface{}{
 		"query": map[string]interface{}{
 			"bool": map[string]interface{}{
-				"must": []map[string]interface{}{
-					{
-						"term": map[string]interface{}{
-							"body.type": "kernel_crash",
-						},
-					},
-					{
-						"wildcard": map[string]interface{}{
-							"body.version": version,
-						},
-					},
-					{
-						"terms": map[string]interface{}{
-							"body.model.keyword": []string{model},
-						},
-					},
-				},
+				"must": must,
 			},
 		},
 		"size": size,
@@ -187,6 +286,7 @@ func FetchCrashLogs(productLine, date, version, model string, size int) ([]Crash
 	var response struct {
 		Hits struct {
 			Hits []struct {
+				ID     string `json:"_id"`
 				Source struct {
 					CrashLog `json:"body"`
 				} `json:"_source"`
@@ -206,13 +306,17 @@ func FetchCrashLogs(productLine, date, version, model string, size int) ([]Crash
 	crashLogs := make([]CrashLog, len(response.Hits.Hits))
 	for i, hit := range response.Hits.Hits {
 		crashLogs[i] = hit.Source.CrashLog
+		crashLogs[i].ID = hit.ID
 	}
 
 	return crashLogs, nil
 }
 
+// PanicKeyword starts the kernel panic message, the reason of a crash
+const PanicKeyword = "Kernel panic - "
+
 func IdentifyKernelPanic(crashLog []string) string {
-	panicKeyword := "Kernel panic - "
+	panicKeyword := PanicKeyword
 
 	for _, line := range crashLog {
 		if strings.Contains(line, panicKeyword) {
@@ -0,0 +1,135 @@
+package bootloop
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Options tunes what counts as a crash/reboot loop
+type Options struct {
+	// A crash counts toward a loop only if the device was up for less than MaxUptime
+	MaxUptime time.Duration
+	// Consecutive crashes of a loop are at most MaxGap apart
+	MaxGap time.Duration
+	// A loop has at least MinCrashes crashes, at least 1
+	MinCrashes int
+}
+
+var DefaultOptions = Options{
+	MaxUptime:  10 * time.Minute,
+	MaxGap:     30 * time.Minute,
+	MinCrashes: 3,
+}
+
+// Loop is a device stuck in crash/reboot loop
+type Loop struct {
+	DeviceID     string        `json:"device_id"`
+	Model        string        `json:"model"`
+	Version      string        `json:"version"`
+	Count        int           `json:"count"`
+	Start        time.Time     `json:"start"`
+	End          time.Time     `json:"end"`
+	Span         time.Duration `json:"span"`
+	Fingerprints []string      `json:"fingerprints"`
+}
+
+// Detect finds the devices stuck in crash/reboot loops, the longest loop first.
+// The crash logs may come from one or more daily indices.
+func Detect(data []crashlog.CrashLog, opts Options) []Loop {
+	devices := make(map[string][]crashlog.CrashLog)
+	for _, log := range data {
+		devices[log.AnonymousDeviceID] = append(devices[log.AnonymousDeviceID], log)
+	}
+
+	var loops []Loop
+	for _, logs := range devices {
+		sort.Slice(logs, func(i, j int) bool {
+			return logs[i].SystemTime.Before(logs[j].SystemTime)
+		})
+
+		// Split the short uptime crashes into runs of close crashes, a crash of
+		// unknown uptime can't tell a loop and breaks the run
+		var run []crashlog.CrashLog
+		for _, log := range logs {
+			if d, ok := crashlogutil.Uptime(log); !ok || d >= opts.MaxUptime {
+				loops = appendLoop(loops, run, opts)
+				run = nil
+				continue
+			}
+			if len(run) > 0 {
+				last := run[len(run)-1]
+				if log.SystemTime.Equal(last.SystemTime) {
+					// The same crash fetched twice
+					continue
+				}
+				if log.SystemTime.Sub(last.SystemTime) > opts.MaxGap {
+					loops = appendLoop(loops, run, opts)
+					run = nil
+				}
+			}
+			run = append(run, log)
+		}
+		loops = appendLoop(loops, run, opts)
+	}
+
+	sort.Slice(loops, func(i, j int) bool {
+		if loops[i].Count != loops[j].Count {
+			return loops[i].Count > loops[j].Count
+		}
+		return loops[i].DeviceID < loops[j].DeviceID
+	})
+
+	return loops
+}
+
+func appendLoop(loops []Loop, run []crashlog.CrashLog, opts Options) []Loop {
+	if len(run) < opts.MinCrashes {
+		return loops
+	}
+
+	first := run[0]
+	last := run[len(run)-1]
+	loop := Loop{
+		DeviceID: first.AnonymousDeviceID,
+		Model:    first.Model,
+		Version:  last.Version,
+		Count:    len(run),
+		Start:    first.SystemTime,
+		End:      last.SystemTime,
+		Span:     last.SystemTime.Sub(first.SystemTime),
+	}
+
+	seen := make(map[string]bool)
+	for _, log := range run {
+		fingerprint := crashlogutil.Fingerprint(log.CrashLog)
+		if !seen[fingerprint] {
+			seen[fingerprint] = true
+			loop.Fingerprints = append(loop.Fingerprints, fingerprint)
+		}
+	}
+
+	return append(loops, loop)
+}
+
+// Table converts the loops into rows with a header, ready to be written into a sheet
+func Table(loops []Loop) [][]interface{} {
+	rows := [][]interface{}{
+		{"Boot loop device", "Model", "Version", "Loop count", "Start", "End", "Span", "Fingerprints"},
+	}
+	for _, loop := range loops {
+		rows = append(rows, []interface{}{
+			loop.DeviceID,
+			loop.Model,
+			loop.Version,
+			loop.Count,
+			loop.Start.Format(time.RFC3339),
+			loop.End.Format(time.RFC3339),
+			loop.Span.String(),
+			strings.Join(loop.Fingerprints, ", "),
+		})
+	}
+	return rows
+}
@@ -0,0 +1,87 @@
+package bootloop
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC)
+
+// crashAt returns a crash of the device minutes after start, uptime is in
+// seconds and 0 leaves it unknown
+func crashAt(device string, minutes, uptime int) crashlog.CrashLog {
+	return crashlog.CrashLog{
+		AnonymousDeviceID: device,
+		Model:             "UDMPRO",
+		Version:           "v3.1.9",
+		SystemTime:        start.Add(time.Duration(minutes) * time.Minute),
+		Uptime:            uptime,
+		CrashLog:          "<0>[  12.345678] Kernel panic - not syncing: Fatal exception",
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name string
+		data []crashlog.CrashLog
+		want []int // the loop counts, longest first
+	}{
+		{
+			name: "three short uptime crashes",
+			data: []crashlog.CrashLog{crashAt("a", 0, 60), crashAt("a", 5, 60), crashAt("a", 10, 60)},
+			want: []int{3},
+		},
+		{
+			name: "too few crashes",
+			data: []crashlog.CrashLog{crashAt("a", 0, 60), crashAt("a", 5, 60)},
+		},
+		{
+			name: "unknown uptime is no loop",
+			data: []crashlog.CrashLog{crashAt("a", 0, 0), crashAt("a", 5, 0), crashAt("a", 10, 0)},
+		},
+		{
+			name: "unknown uptime breaks the run",
+			data: []crashlog.CrashLog{crashAt("a", 0, 60), crashAt("a", 5, 60), crashAt("a", 10, 0), crashAt("a", 15, 60), crashAt("a", 20, 60)},
+		},
+		{
+			name: "long uptime breaks the run",
+			data: []crashlog.CrashLog{crashAt("a", 0, 60), crashAt("a", 5, 60), crashAt("a", 10, 3600), crashAt("a", 15, 60), crashAt("a", 20, 60), crashAt("a", 25, 60)},
+			want: []int{3},
+		},
+		{
+			name: "gap splits the run",
+			data: []crashlog.CrashLog{crashAt("a", 0, 60), crashAt("a", 5, 60), crashAt("a", 10, 60), crashAt("a", 120, 60), crashAt("a", 125, 60)},
+			want: []int{3},
+		},
+		{
+			name: "the same crash fetched twice counts once",
+			data: []crashlog.CrashLog{crashAt("a", 0, 60), crashAt("a", 0, 60), crashAt("a", 5, 60)},
+		},
+		{
+			name: "longest loop first",
+			data: []crashlog.CrashLog{
+				crashAt("b", 0, 60), crashAt("b", 1, 60), crashAt("b", 2, 60),
+				crashAt("a", 0, 60), crashAt("a", 1, 60), crashAt("a", 2, 60), crashAt("a", 3, 60),
+			},
+			want: []int{4, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loops := Detect(tt.data, DefaultOptions)
+			if len(loops) != len(tt.want) {
+				t.Fatalf("got %d loops, want %d: %+v", len(loops), len(tt.want), loops)
+			}
+			for i, loop := range loops {
+				if loop.Count != tt.want[i] {
+					t.Errorf("loop %d count = %d, want %d", i, loop.Count, tt.want[i])
+				}
+				if loop.Span != loop.End.Sub(loop.Start) || len(loop.Fingerprints) != 1 {
+					t.Errorf("loop %d = %+v", i, loop)
+				}
+			}
+		})
+	}
+}
@@ -1,12 +1,92 @@
 package crashlogutil
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"grafana-extract-go/internal/app/crashlog"
+	"io"
 	"regexp"
 	"sort"
+	"strings"
+	"time"
 )
 
+var (
+	// Matches the printk timestamp, ex: [  123.456789]
+	timestampRegex = regexp.MustCompile(`\[\s*\d+\.\d+\]`)
+	// Matches addresses and other hex values
+	hexRegex = regexp.MustCompile(`0x[0-9a-fA-F]+|\b[0-9a-fA-F]{8,16}\b`)
+	// Matches decimal numbers such as PIDs and CPU ids
+	numberRegex = regexp.MustCompile(`\b\d+\b`)
+	// Matches a call trace frame symbol, ex: blk_update_request+0x1c4/0x3e8
+	frameRegex = regexp.MustCompile(`([A-Za-z_][\w.]*)\+0x[0-9a-fA-F]+/0x[0-9a-fA-F]+`)
+	// Matches the faulting PC and LR at the start of the message, ex: pc : blk_update_request+0x1c4/0x3e8,
+	// LR is at scsi_io_completion+0x10/0x40
+	registerRegex = regexp.MustCompile(`^\s*(?:\[\s*\d+\.\d+\]\s*)?(?:(?:pc|lr)\s*:|(?:PC|LR) is at|RIP: )`)
+	// Matches a line holding nothing but the printk timestamp
+	timestampOnlyRegex = regexp.MustCompile(`^\s*\[\s*\d+\.\d+\]\s*$`)
+)
+
+// The headlines of a crash, the kernel panic the reason comes from or a BUG/Oops
+var headlineKeywords = []string{crashlog.PanicKeyword, "BUG: ", "Internal error: Oops", "Unable to handle kernel"}
+
+// The start of the call trace block
+var callTraceKeywords = []string{"Call trace:", "Call Trace:"}
+
+// LineClass is the kind of a crash log line, the writers style the lines by it
+type LineClass int
+
+const (
+	PlainLine LineClass = iota
+	// HeadlineLine is the kernel panic the reason comes from, or a BUG/Oops
+	HeadlineLine
+	// TraceLine is the PC/LR or a line of the call trace block
+	TraceLine
+	// TimestampLine holds only a timestamp
+	TimestampLine
+)
+
+// ClassifyLines classifies the lines, in printed order. The call trace block
+// runs from the Call trace: line over the frames following it.
+func ClassifyLines(lines []string) []LineClass {
+	classes := make([]LineClass, len(lines))
+	inTrace := false
+	for i, line := range lines {
+		switch {
+		case containsAny(line, headlineKeywords):
+			classes[i] = HeadlineLine
+			inTrace = false
+		case containsAny(line, callTraceKeywords):
+			classes[i] = TraceLine
+			inTrace = true
+		case registerRegex.MatchString(line):
+			classes[i] = TraceLine
+		case inTrace && frameRegex.MatchString(line):
+			classes[i] = TraceLine
+		case timestampOnlyRegex.MatchString(line):
+			classes[i] = TimestampLine
+			inTrace = false
+		default:
+			inTrace = false
+		}
+	}
+	return classes
+}
+
+// containsAny reports if the line contains one of the keywords
+func containsAny(line string, keywords []string) bool {
+	for _, keyword := range keywords {
+		if strings.Contains(line, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// The number of call trace frames used to build a fingerprint
+const fingerprintFrames = 8
+
 func ExtractVersion(input string) (string, error) {
 	// Define the regular expression pattern to match the version
 	pattern := `v(\d+\.\d+\.\d+)`
@@ -64,3 +144,155 @@ func ApplyRegex(crashLog string) string {
 
 	return cleanLog
 }
+
+// CleanLines applies the regex pattern to the crash log and returns its non-empty lines
+func CleanLines(crashLog string) []string {
+	cleanLog := ApplyRegex(crashLog)
+	lines := make([]string, 0)
+	for _, line := range strings.Split(cleanLog, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// PrintedLines returns the non-empty lines in the order the kernel printed
+// them, the crash log keeps the latest line first
+func PrintedLines(crashLog string) []string {
+	lines := CleanLines(crashLog)
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// Reason returns the kernel panic message of the crash log
+func Reason(crashLog string) string {
+	return crashlog.IdentifyKernelPanic(CleanLines(crashLog))
+}
+
+// The categories of a crash by its headline, the kernel panic alone is a panic
+var categories = []struct {
+	keyword, category string
+}{
+	{"Unable to handle kernel", "page fault"},
+	{"Internal error: Oops", "oops"},
+	{"BUG: ", "bug"},
+}
+
+// Category returns the kind of the crash by the first headline printed, ex:
+// page fault, oops, bug, or panic if only the kernel panic is printed
+func Category(crashLog string) string {
+	for _, line := range PrintedLines(crashLog) {
+		for _, c := range categories {
+			if strings.Contains(line, c.keyword) {
+				return c.category
+			}
+		}
+	}
+	return "panic"
+}
+
+// NormalizeLine strips timestamps, addresses and numbers, so the same line
+// logged by different devices compares equal
+func NormalizeLine(line string) string {
+	line = timestampRegex.ReplaceAllString(line, "")
+	line = hexRegex.ReplaceAllString(line, "X")
+	line = numberRegex.ReplaceAllString(line, "N")
+	return strings.Join(strings.Fields(line), " ")
+}
+
+// Fingerprint returns a short hash identifying the crash signature. It is
+// built from the panic reason, the faulting PC/LR symbols and the innermost
+// call trace frames, so it stays the same for one crash across devices, days
+// and runs.
+func Fingerprint(crashLog string) string {
+	lines := PrintedLines(crashLog)
+
+	h := sha1.New()
+	io.WriteString(h, crashlog.IdentifyKernelPanic(lines))
+
+	// The faulting PC and LR come before the call trace
+	trace := len(lines)
+	for i, line := range lines {
+		if containsAny(line, callTraceKeywords) {
+			trace = i
+			break
+		}
+	}
+	for _, line := range lines[:trace] {
+		if !registerRegex.MatchString(line) {
+			continue
+		}
+		if match := frameRegex.FindStringSubmatch(line); match != nil {
+			io.WriteString(h, "\n"+match[1])
+		}
+	}
+
+	// The frames of the call trace block, innermost first. Without a call
+	// trace block the frames printed anywhere are used.
+	var frames []string
+	if trace < len(lines) {
+		for _, line := range lines[trace+1:] {
+			match := frameRegex.FindStringSubmatch(line)
+			if match == nil {
+				break
+			}
+			frames = append(frames, match[1])
+		}
+	} else {
+		for _, line := range lines {
+			for _, match := range frameRegex.FindAllStringSubmatch(line, -1) {
+				frames = append(frames, match[1])
+			}
+		}
+	}
+	if len(frames) > fingerprintFrames {
+		frames = frames[:fingerprintFrames]
+	}
+	for _, frame := range frames {
+		io.WriteString(h, "\n"+frame)
+	}
+
+	// Fall back to the whole normalized log if there is no call trace
+	if len(frames) == 0 {
+		for _, line := range lines {
+			io.WriteString(h, "\n"+NormalizeLine(line))
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// FingerprintCache computes the fingerprint of every distinct crash log once,
+// many crashes mostly share the same crash log
+type FingerprintCache map[string]string
+
+// Fingerprint returns the fingerprint of the crash log, see Fingerprint
+func (c FingerprintCache) Fingerprint(crashLog string) string {
+	fingerprint, ok := c[crashLog]
+	if !ok {
+		fingerprint = Fingerprint(crashLog)
+		c[crashLog] = fingerprint
+	}
+	return fingerprint
+}
+
+// NormalizeVersion strips the 'v' prefix, ex: v3.1.9 -> 3.1.9
+func NormalizeVersion(version string) string {
+	return strings.TrimPrefix(strings.TrimSpace(version), "v")
+}
+
+// Uptime returns how long the device was up when it crashed, and false if it
+// is unknown. The uptime field is in seconds, the boot time is used if the
+// field is missing.
+func Uptime(log crashlog.CrashLog) (time.Duration, bool) {
+	if log.Uptime > 0 {
+		return time.Duration(log.Uptime) * time.Second, true
+	}
+	if !log.BootTime.IsZero() && log.SystemTime.After(log.BootTime) {
+		return log.SystemTime.Sub(log.BootTime), true
+	}
+	return 0, false
+}
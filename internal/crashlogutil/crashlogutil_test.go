@@ -0,0 +1,152 @@
+package crashlogutil
+
+import (
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildLog joins the lines printed by the kernel into a crash log, the latest line first
+func buildLog(ts float64, printed ...string) string {
+	var sb strings.Builder
+	for i := len(printed) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "<4>[%11.6f] %s", ts+float64(i)/1000, printed[i])
+	}
+	return sb.String()
+}
+
+// arm64 prints the registers, then the call trace innermost first
+func arm64Log(ts float64, pc, lr string, frames ...string) string {
+	printed := []string{
+		"Unable to handle kernel NULL pointer dereference at virtual address 0000000000000008",
+		fmt.Sprintf("pc : %s+0x1c4/0x3e8", pc),
+		fmt.Sprintf("lr : %s+0x10/0x40", lr),
+		"Call trace:",
+	}
+	for i, frame := range frames {
+		printed = append(printed, fmt.Sprintf(" %s+0x%x/0x200", frame, 0x20+i*8))
+	}
+	printed = append(printed, "Code: d65f03c0 f9400001 (f9400400)", "---[ end trace 3f2a9c1be07d8e11 ]---",
+		"Kernel panic - not syncing: Fatal exception in interrupt")
+	return buildLog(ts, printed...)
+}
+
+// The outer frames every worker crash shares
+var outer = []string{"process_one_work", "worker_thread", "kthread", "ret_from_fork"}
+
+func TestFingerprint(t *testing.T) {
+	deep := append([]string{"a1", "a2", "a3", "a4", "a5", "a6"}, outer...)
+
+	tests := []struct {
+		name  string
+		a, b  string
+		equal bool
+	}{
+		{
+			name:  "same crash on another device and time",
+			a:     arm64Log(123.456, "blk_update_request", "scsi_io_completion", append([]string{"blk_update_request", "scsi_end_request"}, outer...)...),
+			b:     arm64Log(98765.4321, "blk_update_request", "scsi_io_completion", append([]string{"blk_update_request", "scsi_end_request"}, outer...)...),
+			equal: true,
+		},
+		{
+			name:  "different faulting frames, shared outer frames",
+			a:     arm64Log(1, "blk_update_request", "scsi_io_completion", append([]string{"blk_update_request", "scsi_end_request"}, outer...)...),
+			b:     arm64Log(1, "ext4_writepages", "do_writepages", append([]string{"ext4_writepages", "do_writepages"}, outer...)...),
+			equal: false,
+		},
+		{
+			name:  "different pc, same trace",
+			a:     arm64Log(1, "memcpy", "skb_copy_bits", append([]string{"skb_copy_bits"}, outer...)...),
+			b:     arm64Log(1, "memset", "skb_copy_bits", append([]string{"skb_copy_bits"}, outer...)...),
+			equal: false,
+		},
+		{
+			name:  "deep traces differing past the top frames",
+			a:     arm64Log(1, "a1", "a2", append(deep, "x1", "x2")...),
+			b:     arm64Log(1, "a1", "a2", append(deep, "y1", "y2")...),
+			equal: true,
+		},
+		{
+			name:  "deep traces differing in the top frames",
+			a:     arm64Log(1, "a1", "a2", append([]string{"b0"}, deep...)...),
+			b:     arm64Log(1, "a1", "a2", append([]string{"c0"}, deep...)...),
+			equal: false,
+		},
+		{
+			name:  "no call trace, same lines but the numbers",
+			a:     buildLog(12.5, "Out of memory: Killed process 1234 (ubnt-dpkg)", "Kernel panic - not syncing: System is deadlocked on memory"),
+			b:     buildLog(900.25, "Out of memory: Killed process 5678 (ubnt-dpkg)", "Kernel panic - not syncing: System is deadlocked on memory"),
+			equal: true,
+		},
+		{
+			name:  "no call trace, different reason",
+			a:     buildLog(12.5, "Kernel panic - not syncing: System is deadlocked on memory"),
+			b:     buildLog(12.5, "Kernel panic - not syncing: Attempted to kill init!"),
+			equal: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := Fingerprint(tt.a), Fingerprint(tt.b)
+			if len(a) != 12 {
+				t.Fatalf("fingerprint %q is not 12 characters", a)
+			}
+			if (a == b) != tt.equal {
+				t.Errorf("Fingerprint equal = %v, want %v (%s, %s)", a == b, tt.equal, a, b)
+			}
+		})
+	}
+}
+
+func TestReasonAndCategory(t *testing.T) {
+	log := arm64Log(1, "memcpy", "skb_copy_bits", outer...)
+	if got, want := Reason(log), "not syncing: Fatal exception in interrupt"; got != want {
+		t.Errorf("Reason = %q, want %q", got, want)
+	}
+	if got, want := Category(log), "page fault"; got != want {
+		t.Errorf("Category = %q, want %q", got, want)
+	}
+	if got, want := Category(buildLog(1, "Kernel panic - not syncing: Attempted to kill init!")), "panic"; got != want {
+		t.Errorf("Category = %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeLine(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"[  123.456789] CPU: 3 PID: 1234 Comm: kworker/3:1", "CPU: N PID: N Comm: kworker/N:N"},
+		{"pc : blk_update_request+0x1c4/0x3e8", "pc : blk_update_request+X/X"},
+		{"x29: ffffffc0112e3b40 x28: 0000000000000000", "x29: X x28: X"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeLine(tt.line); got != tt.want {
+			t.Errorf("NormalizeLine(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestUptime(t *testing.T) {
+	boot := time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		log    crashlog.CrashLog
+		want   time.Duration
+		wantOK bool
+	}{
+		{"uptime field", crashlog.CrashLog{Uptime: 90}, 90 * time.Second, true},
+		{"boot time", crashlog.CrashLog{BootTime: boot, SystemTime: boot.Add(time.Hour)}, time.Hour, true},
+		{"uptime field wins", crashlog.CrashLog{Uptime: 30, BootTime: boot, SystemTime: boot.Add(time.Hour)}, 30 * time.Second, true},
+		{"boot time after the crash", crashlog.CrashLog{BootTime: boot, SystemTime: boot.Add(-time.Hour)}, 0, false},
+		{"unknown", crashlog.CrashLog{SystemTime: boot}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := Uptime(tt.log)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: Uptime = %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package devicehistory
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/ownership"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A device with at least this many crashes is a repeat offender
+const RepeatOffenderCrashes = 2
+
+// Crash is one crash of a device
+type Crash struct {
+	SystemTime time.Time `json:"system_time"`
+	BootTime   time.Time `json:"boot_time"`
+	// Uptime and BootTime are zero if unknown
+	Uptime      time.Duration `json:"uptime"`
+	Version     string        `json:"version"`
+	Reason      string        `json:"reason"`
+	Fingerprint string        `json:"fingerprint"`
+	Owner       string        `json:"owner"`
+}
+
+// History is the crash history of one device, oldest crash first
+type History struct {
+	DeviceID       string   `json:"device_id"`
+	Model          string   `json:"model"`
+	Crashes        []Crash  `json:"crashes"`
+	Signatures     []string `json:"signatures"`
+	RepeatOffender bool     `json:"repeat_offender"`
+}
+
+// Build groups the crash logs per AnonymousDeviceID, devices with the most crashes first
+func Build(data []crashlog.CrashLog, owners *ownership.Owners) []History {
+	histories := make(map[string]*History)
+	// The same crash can be fetched more than once, ex: overlapping date ranges
+	seen := make(map[string]bool)
+	// The signature of every distinct crash log, many crashes share one
+	type signature struct {
+		fingerprint, reason, owner string
+	}
+	signatures := make(map[string]signature)
+
+	for _, log := range data {
+		sig, ok := signatures[log.CrashLog]
+		if !ok {
+			sig = signature{
+				fingerprint: crashlogutil.Fingerprint(log.CrashLog),
+				reason:      crashlogutil.Reason(log.CrashLog),
+				owner:       ownership.Attribute(log.CrashLog, owners).Owner,
+			}
+			signatures[log.CrashLog] = sig
+		}
+		fingerprint := sig.fingerprint
+		key := log.AnonymousDeviceID + "|" + log.SystemTime.String() + "|" + fingerprint
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		history, ok := histories[log.AnonymousDeviceID]
+		if !ok {
+			history = &History{DeviceID: log.AnonymousDeviceID, Model: log.Model}
+			histories[log.AnonymousDeviceID] = history
+		}
+		// Zero is an unknown uptime
+		uptime, _ := crashlogutil.Uptime(log)
+		history.Crashes = append(history.Crashes, Crash{
+			SystemTime:  log.SystemTime,
+			BootTime:    log.BootTime,
+			Uptime:      uptime,
+			Version:     log.Version,
+			Reason:      sig.reason,
+			Fingerprint: fingerprint,
+			Owner:       sig.owner,
+		})
+	}
+
+	result := make([]History, 0, len(histories))
+	for _, history := range histories {
+		sort.Slice(history.Crashes, func(i, j int) bool {
+			return history.Crashes[i].SystemTime.Before(history.Crashes[j].SystemTime)
+		})
+
+		signatures := make(map[string]bool)
+		for _, crash := range history.Crashes {
+			if !signatures[crash.Fingerprint] {
+				signatures[crash.Fingerprint] = true
+				history.Signatures = append(history.Signatures, crash.Fingerprint)
+			}
+		}
+		history.RepeatOffender = len(history.Crashes) >= RepeatOffenderCrashes
+
+		result = append(result, *history)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if len(result[i].Crashes) != len(result[j].Crashes) {
+			return len(result[i].Crashes) > len(result[j].Crashes)
+		}
+		return result[i].DeviceID < result[j].DeviceID
+	})
+
+	return result
+}
+
+// Lookup returns the crash history of the device, nil if it has no crash
+func Lookup(data []crashlog.CrashLog, deviceID string, owners *ownership.Owners) *History {
+	var deviceData []crashlog.CrashLog
+	for _, log := range data {
+		if log.AnonymousDeviceID == deviceID {
+			deviceData = append(deviceData, log)
+		}
+	}
+
+	histories := Build(deviceData, owners)
+	if len(histories) == 0 {
+		return nil
+	}
+	return &histories[0]
+}
+
+// Table converts the histories into rows with a header, one row per crash
+func Table(histories []History) [][]interface{} {
+	rows := [][]interface{}{
+		{"AnonymousDeviceID", "Model", "Crashes", "Repeat offender", "Signatures", "System time", "Boot time", "Uptime", "Version", "Reason", "Fingerprint", "Owner"},
+	}
+	for _, history := range histories {
+		for _, crash := range history.Crashes {
+			rows = append(rows, []interface{}{
+				history.DeviceID,
+				history.Model,
+				len(history.Crashes),
+				history.RepeatOffender,
+				strings.Join(history.Signatures, ", "),
+				formatTime(crash.SystemTime),
+				formatTime(crash.BootTime),
+				crash.FormattedUptime(),
+				crash.Version,
+				crash.Reason,
+				crash.Fingerprint,
+				crash.Owner,
+			})
+		}
+	}
+	return rows
+}
+
+// formatTime prints an unknown time as -, like the crash sheets
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// FormattedUptime returns the uptime, - if unknown
+func (c Crash) FormattedUptime() string {
+	if c.Uptime <= 0 {
+		return "-"
+	}
+	return c.Uptime.String()
+}
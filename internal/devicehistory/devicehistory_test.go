@@ -0,0 +1,105 @@
+package devicehistory
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"testing"
+	"time"
+)
+
+var boot = time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC)
+
+func crash(device string, hour int, uptime int, reason string) crashlog.CrashLog {
+	return crashlog.CrashLog{
+		AnonymousDeviceID: device,
+		Model:             "UDMPRO",
+		Version:           "v3.1.9",
+		SystemTime:        boot.Add(time.Duration(hour) * time.Hour),
+		Uptime:            uptime,
+		CrashLog:          "<0>[  12.345678] Kernel panic - not syncing: " + reason,
+	}
+}
+
+func TestBuild(t *testing.T) {
+	data := []crashlog.CrashLog{
+		crash("a", 3, 60, "Fatal exception"),
+		crash("b", 1, 0, "Fatal exception"),
+		crash("a", 1, 120, "Attempted to kill init!"),
+		// Fetched twice, ex: overlapping date ranges
+		crash("a", 3, 60, "Fatal exception"),
+		crash("a", 2, 90, "Fatal exception"),
+	}
+
+	histories := Build(data, nil)
+	if len(histories) != 2 {
+		t.Fatalf("got %d devices, want 2", len(histories))
+	}
+
+	tests := []struct {
+		device         string
+		crashes        int
+		signatures     int
+		repeatOffender bool
+		firstUptime    time.Duration
+	}{
+		{"a", 3, 2, true, 2 * time.Minute},
+		{"b", 1, 1, false, 0},
+	}
+	for i, tt := range tests {
+		history := histories[i]
+		if history.DeviceID != tt.device {
+			t.Fatalf("device %d = %s, want %s, the most crashes first", i, history.DeviceID, tt.device)
+		}
+		if len(history.Crashes) != tt.crashes || len(history.Signatures) != tt.signatures || history.RepeatOffender != tt.repeatOffender {
+			t.Errorf("%s: %d crashes, %d signatures, repeat offender %v", tt.device, len(history.Crashes), len(history.Signatures), history.RepeatOffender)
+		}
+		if history.Crashes[0].Uptime != tt.firstUptime {
+			t.Errorf("%s: first uptime = %v, want %v", tt.device, history.Crashes[0].Uptime, tt.firstUptime)
+		}
+		for j := 1; j < len(history.Crashes); j++ {
+			if history.Crashes[j].SystemTime.Before(history.Crashes[j-1].SystemTime) {
+				t.Errorf("%s: crashes not oldest first", tt.device)
+			}
+		}
+	}
+
+	// The unknown boot time and uptime print as -
+	rows := Table(histories)
+	if len(rows) != 5 {
+		t.Fatalf("got %d rows, want a header and 4 crashes", len(rows))
+	}
+	last := rows[4]
+	if last[0] != "b" || last[6] != "-" || last[7] != "-" {
+		t.Errorf("row of the unknown uptime = %v", last)
+	}
+	if rows[1][7] != "2m0s" {
+		t.Errorf("uptime = %v, want 2m0s", rows[1][7])
+	}
+}
+
+func TestLookup(t *testing.T) {
+	data := []crashlog.CrashLog{
+		crash("a", 1, 60, "Fatal exception"),
+		crash("b", 2, 60, "Fatal exception"),
+		crash("a", 2, 60, "Fatal exception"),
+	}
+	tests := []struct {
+		device  string
+		crashes int
+	}{
+		{"a", 2},
+		{"b", 1},
+		{"c", 0},
+	}
+	for _, tt := range tests {
+		history := Lookup(data, tt.device, nil)
+		if tt.crashes == 0 {
+			if history != nil {
+				t.Errorf("Lookup(%s) = %+v, want nil", tt.device, history)
+			}
+			continue
+		}
+		if history == nil || history.DeviceID != tt.device || len(history.Crashes) != tt.crashes {
+			t.Errorf("Lookup(%s) = %+v, want %d crashes", tt.device, history, tt.crashes)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package esindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func crashes(n int) []crashlog.CrashLog {
+	data := make([]crashlog.CrashLog, n)
+	for i := range data {
+		data[i] = crashlog.CrashLog{
+			AnonymousDeviceID: fmt.Sprintf("device-%d", i),
+			SystemTime:        time.Date(2023, 6, 15, 10, i, 0, 0, time.UTC),
+			Uptime:            60,
+			CrashLog:          "<0>[  12.345678] Kernel panic - not syncing: Fatal exception",
+		}
+	}
+	return data
+}
+
+// item is one result of a _bulk answer
+func item(status int, err string) string {
+	if err == "" {
+		return fmt.Sprintf(`{"index": {"status": %d}}`, status)
+	}
+	return fmt.Sprintf(`{"index": {"status": %d, "error": %s}}`, status, err)
+}
+
+func TestWrite(t *testing.T) {
+	const mappingErr = `{"type": "mapper_parsing_exception", "reason": "failed to parse field [uptime]"}`
+
+	tests := []struct {
+		name string
+		// respond answers a _bulk request of n documents
+		respond     func(w http.ResponseWriter, n int)
+		wantIndexed int
+		wantErr     []string
+	}{
+		{
+			name: "indexed",
+			respond: func(w http.ResponseWriter, n int) {
+				fmt.Fprint(w, `{"errors": false, "items": []}`)
+			},
+			wantIndexed: 3,
+		},
+		{
+			name: "partial failures",
+			respond: func(w http.ResponseWriter, n int) {
+				items := []string{item(201, "")}
+				for i := 1; i < n; i++ {
+					items = append(items, item(400, mappingErr))
+				}
+				fmt.Fprintf(w, `{"errors": true, "items": [%s]}`, strings.Join(items, ","))
+			},
+			wantIndexed: 2,
+			wantErr:     []string{"1 of 3 documents failed", "status 400", "mapper_parsing_exception"},
+		},
+		{
+			name: "errors without a failed item",
+			respond: func(w http.ResponseWriter, n int) {
+				fmt.Fprint(w, `{"errors": true, "items": [], "took": 3}`)
+			},
+			wantErr: []string{"3 of 3 documents failed", "no failed item", `"took": 3`},
+		},
+		{
+			name: "non-2xx",
+			respond: func(w http.ResponseWriter, n int) {
+				http.Error(w, "cluster_block_exception: index read-only", http.StatusForbidden)
+			},
+			wantErr: []string{"3 of 3 documents failed", "403 Forbidden", "cluster_block_exception"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if r.Method != http.MethodPost || r.URL.Path != "/_bulk" {
+					t.Errorf("got %s %s, want POST /_bulk", r.Method, r.URL.Path)
+				}
+				if got := r.Header.Get("Content-Type"); got != "application/x-ndjson" {
+					t.Errorf("Content-Type = %q", got)
+				}
+
+				n := 0
+				scanner := bufio.NewScanner(r.Body)
+				scanner.Buffer(nil, 1<<20)
+				for scanner.Scan() {
+					var action map[string]map[string]string
+					err := json.Unmarshal(scanner.Bytes(), &action)
+					if err != nil {
+						t.Errorf("bad action line %q: %s", scanner.Text(), err)
+						break
+					}
+					if got := action["index"]["_index"]; got != "crash_enriched_2023_06_15" {
+						t.Errorf("_index = %q", got)
+					}
+					if action["index"]["_id"] == "" {
+						t.Error("no _id")
+					}
+					if !scanner.Scan() {
+						t.Error("action without a document")
+						break
+					}
+					var doc Document
+					err = json.Unmarshal(scanner.Bytes(), &doc)
+					if err != nil {
+						t.Errorf("bad document line %q: %s", scanner.Text(), err)
+					}
+					if len(doc.Fingerprint) != 12 || doc.UptimeSeconds == nil || *doc.UptimeSeconds != 60 {
+						t.Errorf("document = %+v", doc)
+					}
+					n++
+				}
+				tt.respond(w, n)
+			}))
+			defer server.Close()
+
+			sink := New(server.URL+"/", "")
+			sink.BatchSize = 2
+			indexed, err := sink.Write(crashes(3))
+			if requests != 2 {
+				t.Errorf("got %d requests, want 2 batches", requests)
+			}
+			if indexed != tt.wantIndexed {
+				t.Errorf("indexed %d, want %d", indexed, tt.wantIndexed)
+			}
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Write succeeded, want an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestID(t *testing.T) {
+	data := crashes(2)
+	if ID(data[0]) != ID(data[0]) || ID(data[0]) == ID(data[1]) {
+		t.Error("the ID isn't derived from the crash")
+	}
+	moved := data[0]
+	moved.SystemTime = moved.SystemTime.In(time.FixedZone("PDT", -7*3600))
+	if ID(moved) != ID(data[0]) {
+		t.Error("the ID depends on the time zone")
+	}
+}
@@ -0,0 +1,197 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/ownership"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the file format of an export
+type Format string
+
+const (
+	CSV    Format = "csv"
+	NDJSON Format = "ndjson"
+)
+
+// Row is one crash log and the fields derived from it
+type Row struct {
+	Log         crashlog.CrashLog
+	Reason      string
+	Fingerprint string
+	Attribution ownership.Attribution
+	// CleanLog is the lines of the crash log in printed order, one per line
+	CleanLog string
+}
+
+// The columns of an export by name, the CrashLog fields keep their JSON names
+var columns = map[string]func(row *Row) interface{}{
+	"type":                  func(row *Row) interface{} { return row.Log.Type },
+	"system_time":           func(row *Row) interface{} { return row.Log.SystemTime },
+	"anonymous_device_id":   func(row *Row) interface{} { return row.Log.AnonymousDeviceID },
+	"model":                 func(row *Row) interface{} { return row.Log.Model },
+	"version":               func(row *Row) interface{} { return row.Log.Version },
+	"bomrev":                func(row *Row) interface{} { return row.Log.BomRev },
+	"is_default":            func(row *Row) interface{} { return row.Log.IsDefault },
+	"product_line":          func(row *Row) interface{} { return row.Log.ProductLine },
+	"boot_time":             func(row *Row) interface{} { return row.Log.BootTime },
+	"uptime":                func(row *Row) interface{} { return row.Log.Uptime },
+	"human_readable_uptime": func(row *Row) interface{} { return row.Log.HumanReadableUptime },
+	"kernel_version":        func(row *Row) interface{} { return row.Log.KernelVersion },
+	"architecture":          func(row *Row) interface{} { return row.Log.Architecture },
+	"load_average":          func(row *Row) interface{} { return row.Log.LoadAverage },
+	"crash_log":             func(row *Row) interface{} { return row.Log.CrashLog },
+	"is_internal":           func(row *Row) interface{} { return row.Log.IsInternal },
+	"signal":                func(row *Row) interface{} { return row.Log.Signal },
+	"apiVersion":            func(row *Row) interface{} { return row.Log.APIVersion },
+	"clean_version":         func(row *Row) interface{} { return row.Log.CleanVersion },
+	"sortable_version":      func(row *Row) interface{} { return row.Log.SortableVersion },
+	"id":                    func(row *Row) interface{} { return row.Log.ID },
+	"reason":                func(row *Row) interface{} { return row.Reason },
+	"fingerprint":           func(row *Row) interface{} { return row.Fingerprint },
+	"owner":                 func(row *Row) interface{} { return row.Attribution.Owner },
+	"subsystem":             func(row *Row) interface{} { return row.Attribution.Subsystem },
+	"module":                func(row *Row) interface{} { return row.Attribution.Module },
+	"uptime_seconds":        uptimeSeconds,
+	"clean_log":             func(row *Row) interface{} { return row.CleanLog },
+}
+
+// DefaultColumns is exported if no columns are given
+var DefaultColumns = []string{
+	"system_time", "anonymous_device_id", "model", "version", "bomrev", "kernel_version",
+	"uptime_seconds", "load_average", "reason", "fingerprint", "owner", "clean_log",
+}
+
+// uptimeSeconds returns the uptime in seconds, nil if it is unknown
+func uptimeSeconds(row *Row) interface{} {
+	d, ok := crashlogutil.Uptime(row.Log)
+	if !ok {
+		return nil
+	}
+	return int64(d.Seconds())
+}
+
+// ParseColumns parses a comma separated list of column names, empty means DefaultColumns
+func ParseColumns(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return DefaultColumns, nil
+	}
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("unknown column: %s, ex: %s", name, strings.Join(DefaultColumns, ","))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Write writes one record per crash log in the format, each record is
+// written as soon as it is built so the output can be streamed
+func Write(w io.Writer, format Format, data []crashlog.CrashLog, names []string, owners *ownership.Owners) error {
+	switch format {
+	case CSV:
+		return writeCSV(w, data, names, owners)
+	case NDJSON:
+		return writeNDJSON(w, data, names, owners)
+	default:
+		return fmt.Errorf("unknown export format: %s", format)
+	}
+}
+
+func writeCSV(w io.Writer, data []crashlog.CrashLog, names []string, owners *ownership.Owners) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(names)
+	if err != nil {
+		return err
+	}
+
+	rows := newRows(owners)
+	record := make([]string, len(names))
+	for _, log := range data {
+		row := rows.build(log)
+		for i, name := range names {
+			record[i] = formatValue(columns[name](row))
+		}
+		err = cw.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeNDJSON(w io.Writer, data []crashlog.CrashLog, names []string, owners *ownership.Owners) error {
+	encoder := json.NewEncoder(w)
+	rows := newRows(owners)
+	for _, log := range data {
+		row := rows.build(log)
+		record := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			record[name] = columns[name](row)
+		}
+		err := encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatValue formats a column value for CSV, times in RFC3339
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(time.RFC3339)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// rows builds the rows, the fields derived from a crash log are computed once
+// per distinct crash log
+type rows struct {
+	owners  *ownership.Owners
+	derived map[string]Row
+}
+
+func newRows(owners *ownership.Owners) *rows {
+	return &rows{owners: owners, derived: make(map[string]Row)}
+}
+
+func (r *rows) build(log crashlog.CrashLog) *Row {
+	row, ok := r.derived[log.CrashLog]
+	if !ok {
+		row = Row{
+			Reason:      crashlogutil.Reason(log.CrashLog),
+			Fingerprint: crashlogutil.Fingerprint(log.CrashLog),
+			Attribution: ownership.Attribute(log.CrashLog, r.owners),
+			CleanLog:    strings.Join(crashlogutil.PrintedLines(log.CrashLog), "\n"),
+		}
+		r.derived[log.CrashLog] = row
+	}
+	row.Log = log
+	return &row
+}
@@ -0,0 +1,128 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"grafana-extract-go/internal/app/crashlog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseColumns(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{"", DefaultColumns, false},
+		{"  ", DefaultColumns, false},
+		{"model, version,,fingerprint", []string{"model", "version", "fingerprint"}, false},
+		{"apiVersion,uptime_seconds", []string{"apiVersion", "uptime_seconds"}, false},
+		{"model,firmware", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseColumns(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseColumns(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("ParseColumns(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+	for _, name := range DefaultColumns {
+		if _, ok := columns[name]; !ok {
+			t.Errorf("default column %s is unknown", name)
+		}
+	}
+}
+
+var data = []crashlog.CrashLog{
+	{
+		SystemTime:        time.Date(2023, 6, 15, 10, 30, 0, 0, time.UTC),
+		AnonymousDeviceID: "device-1",
+		Model:             "UNVR",
+		Uptime:            90,
+		CrashLog:          "<0>[  12.000200] Kernel panic - not syncing: Fatal exception, \"oops\"<4>[  12.000100] pc : blk_update_request+0x1c4/0x3e8",
+	},
+	{
+		AnonymousDeviceID: "device-2",
+		Model:             "UNVR",
+		CrashLog:          "<0>[  12.000100] Kernel panic - not syncing: Attempted to kill init!",
+	},
+}
+
+func TestWrite(t *testing.T) {
+	names := []string{"system_time", "anonymous_device_id", "uptime_seconds", "reason", "subsystem", "clean_log"}
+
+	tests := []struct {
+		format Format
+		check  func(t *testing.T, out string)
+	}{
+		{
+			format: CSV,
+			check: func(t *testing.T, out string) {
+				records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(records) != 3 || strings.Join(records[0], ",") != strings.Join(names, ",") {
+					t.Fatalf("records = %q", records)
+				}
+				first := records[1]
+				if first[0] != "2023-06-15T10:30:00Z" || first[2] != "90" || first[3] != `not syncing: Fatal exception, "oops"` || first[4] != "block" {
+					t.Errorf("first record = %q", first)
+				}
+				if !strings.Contains(first[5], "\n") {
+					t.Errorf("clean log %q isn't one line per printed line", first[5])
+				}
+				// The zero time and the unknown uptime are left empty
+				if second := records[2]; second[0] != "" || second[2] != "" {
+					t.Errorf("second record = %q", second)
+				}
+			},
+		},
+		{
+			format: NDJSON,
+			check: func(t *testing.T, out string) {
+				lines := strings.Split(strings.TrimSpace(out), "\n")
+				if len(lines) != 2 {
+					t.Fatalf("got %d lines, want 2", len(lines))
+				}
+				var first map[string]interface{}
+				err := json.Unmarshal([]byte(lines[0]), &first)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(first) != len(names) || first["uptime_seconds"] != 90.0 || first["anonymous_device_id"] != "device-1" {
+					t.Errorf("first record = %v", first)
+				}
+				var second map[string]interface{}
+				err = json.Unmarshal([]byte(lines[1]), &second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if uptime, ok := second["uptime_seconds"]; !ok || uptime != nil {
+					t.Errorf("unknown uptime = %v, want null", uptime)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			var out bytes.Buffer
+			err := Write(&out, tt.format, data, names, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, out.String())
+		})
+	}
+
+	err := Write(&bytes.Buffer{}, "xml", data, names, nil)
+	if err == nil {
+		t.Error("Write of an unknown format succeeded")
+	}
+}
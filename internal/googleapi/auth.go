@@ -0,0 +1,450 @@
+package googleapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// AuthMode is how the Google API client authenticates
+type AuthMode string
+
+const (
+	// AuthAuto picks by the credentials file: a service account or external
+	// account key is used as is, an OAuth client uses the saved token. Without
+	// a credentials file it falls back to the application default credentials.
+	AuthAuto AuthMode = "auto"
+	// AuthServiceAccount uses a service account or external account(workload identity federation) key
+	AuthServiceAccount AuthMode = "service-account"
+	// AuthOAuth uses the saved token of an OAuth client, the consent flow runs
+	// in the browser through a loopback redirect
+	AuthOAuth AuthMode = "oauth"
+	// AuthDevice is AuthOAuth with the device flow, the code is entered on another device
+	AuthDevice AuthMode = "device"
+	// AuthDefault uses the application default credentials, ex:
+	// GOOGLE_APPLICATION_CREDENTIALS, gcloud or the GKE and GCE workload identity
+	AuthDefault AuthMode = "default"
+)
+
+// The environment variables of the credential locations, the flags override them
+const (
+	CredentialsEnv = "GOOGLE_SHEETS_CREDENTIALS"
+	TokenEnv       = "GOOGLE_SHEETS_TOKEN"
+	AuthModeEnv    = "GOOGLE_SHEETS_AUTH"
+)
+
+// The Google device flow endpoint, oauth2 doesn't provide it in this version
+const deviceCodeURL = "https://oauth2.googleapis.com/device/code"
+
+// Auth is where the credentials are and how to use them
+type Auth struct {
+	Mode            AuthMode
+	CredentialsFile string
+	// TokenFile keeps the OAuth token, the refreshed tokens are saved into it
+	TokenFile string
+	// Interactive lets the flow run when no token is saved,
+	// a server answers with an error instead of waiting for a browser
+	Interactive bool
+
+	// reauthorize runs the flow even if a token is saved
+	reauthorize bool
+}
+
+// DefaultAuth returns the auth of the environment variables, or of the credential directory
+func DefaultAuth() Auth {
+	auth := Auth{
+		Mode:            AuthMode(os.Getenv(AuthModeEnv)),
+		CredentialsFile: os.Getenv(CredentialsEnv),
+		TokenFile:       os.Getenv(TokenEnv),
+	}
+	if auth.Mode == "" {
+		auth.Mode = AuthAuto
+	}
+	if auth.CredentialsFile == "" {
+		auth.CredentialsFile = CredentialsPath
+	}
+	if auth.TokenFile == "" {
+		auth.TokenFile = TokenPath
+	}
+	return auth
+}
+
+// ParseAuthMode parses the auth mode name, empty means AuthAuto
+func ParseAuthMode(name string) (AuthMode, error) {
+	switch mode := AuthMode(strings.ToLower(name)); mode {
+	case "":
+		return AuthAuto, nil
+	case AuthAuto, AuthServiceAccount, AuthOAuth, AuthDevice, AuthDefault:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown auth mode: %s, ex: auto, service-account, oauth, device or default", name)
+	}
+}
+
+// Client returns an HTTP client authorized for the scopes
+func (a Auth) Client(ctx context.Context, scopes ...string) (*http.Client, error) {
+	ts, err := a.TokenSource(ctx, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(ctx, ts), nil
+}
+
+// TokenSource returns the token source of the auth mode
+func (a Auth) TokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	if a.Mode == AuthDefault {
+		return defaultTokenSource(ctx, scopes)
+	}
+
+	credentials, err := ioutil.ReadFile(a.CredentialsFile)
+	if err != nil {
+		if a.Mode == AuthAuto && errors.Is(err, os.ErrNotExist) {
+			log.Printf("No credentials file %s, using the application default credentials\n", a.CredentialsFile)
+			return defaultTokenSource(ctx, scopes)
+		}
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+
+	var kind struct {
+		Type string `json:"type"`
+	}
+	err = json.Unmarshal(credentials, &kind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file: %v", err)
+	}
+
+	// A service account or external account key needs no consent
+	if kind.Type == "service_account" || kind.Type == "external_account" {
+		if a.Mode != AuthAuto && a.Mode != AuthServiceAccount {
+			return nil, fmt.Errorf("%s is a %s key, the %s auth mode needs an OAuth client", a.CredentialsFile, kind.Type, a.Mode)
+		}
+		creds, err := google.CredentialsFromJSON(ctx, credentials, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s key: %v", kind.Type, err)
+		}
+		return creds.TokenSource, nil
+	}
+	if a.Mode == AuthServiceAccount {
+		return nil, fmt.Errorf("%s is not a service account key", a.CredentialsFile)
+	}
+
+	config, err := google.ConfigFromJSON(credentials, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file: %v", err)
+	}
+	return a.oauthTokenSource(ctx, config)
+}
+
+// oauthTokenSource returns the saved token, running the consent flow first if
+// needed, and saves every refreshed token
+func (a Auth) oauthTokenSource(ctx context.Context, config *oauth2.Config) (oauth2.TokenSource, error) {
+	tok, err := tokenFromFile(a.TokenFile)
+	switch {
+	case a.reauthorize:
+		// The flow was asked for, it replaces the saved token
+		tok, err = a.runFlow(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if !a.Interactive {
+			return nil, fmt.Errorf("no token in %s, authorize first, ex: go run main.go auth -google-auth oauth", a.TokenFile)
+		}
+		tok, err = a.runFlow(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to read token file: %v", err)
+	}
+
+	saving := &savingTokenSource{base: config.TokenSource(ctx, tok), path: a.TokenFile, last: tok}
+	return oauth2.ReuseTokenSource(tok, saving), nil
+}
+
+// runFlow asks the user for consent, through the device flow or a browser
+func (a Auth) runFlow(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	var tok *oauth2.Token
+	var err error
+	if a.Mode == AuthDevice {
+		tok, err = deviceFlow(ctx, config)
+	} else {
+		tok, err = consentFlow(ctx, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = saveToken(a.TokenFile, tok)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Saved token:", a.TokenFile)
+	return tok, nil
+}
+
+// Authorize gets a token of the auth. The oauth and device modes run their flow
+// and replace the saved token, the auto mode keeps a saved token.
+func Authorize(ctx context.Context, auth Auth, scopes ...string) error {
+	auth.Interactive = true
+	auth.reauthorize = auth.Mode == AuthOAuth || auth.Mode == AuthDevice
+	ts, err := auth.TokenSource(ctx, scopes...)
+	if err != nil {
+		return err
+	}
+	_, err = ts.Token()
+	if err != nil {
+		return fmt.Errorf("failed to get token: %v", err)
+	}
+	return nil
+}
+
+func defaultTokenSource(ctx context.Context, scopes []string) (oauth2.TokenSource, error) {
+	creds, err := google.FindDefaultCredentials(ctx, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find default credentials: %v", err)
+	}
+	return creds.TokenSource, nil
+}
+
+// Retrieves a token from a local file.
+func tokenFromFile(file string) (*oauth2.Token, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tok := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(tok)
+	return tok, err
+}
+
+// saveToken writes the token readable by the owner only
+func saveToken(file string, tok *oauth2.Token) error {
+	if dir := filepath.Dir(file); dir != "." {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return fmt.Errorf("failed to create token directory: %v", err)
+		}
+	}
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %v", err)
+	}
+	err = ioutil.WriteFile(file, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save token: %v", err)
+	}
+	return nil
+}
+
+// savingTokenSource saves every token the base source refreshes
+type savingTokenSource struct {
+	base oauth2.TokenSource
+	path string
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil || tok.AccessToken != s.last.AccessToken {
+		// Google leaves the refresh token out of the refreshed tokens
+		if tok.RefreshToken == "" && s.last != nil {
+			tok.RefreshToken = s.last.RefreshToken
+		}
+		err = saveToken(s.path, tok)
+		if err != nil {
+			log.Println("Save refreshed token failed with: ", err)
+		}
+		s.last = tok
+	}
+	return tok, nil
+}
+
+// consentFlow opens the consent page and waits for its redirect to a loopback
+// listener, Google doesn't support pasting codes anymore
+func consentFlow(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the consent redirect: %v", err)
+	}
+	defer listener.Close()
+
+	c := *config
+	c.RedirectURL = "http://" + listener.Addr().String() + "/"
+	state, err := newState()
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case query.Get("state") != state:
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		case query.Get("error") != "":
+			errs <- fmt.Errorf("consent denied: %s", query.Get("error"))
+			fmt.Fprintln(w, "Authorization failed, you can close this window.")
+			return
+		}
+		codes <- query.Get("code")
+		fmt.Fprintln(w, "Authorization done, you can close this window.")
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fmt.Printf("Open this link in your browser to authorize the Google API:\n%s\n", c.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce))
+
+	var code string
+	select {
+	case code = <-codes:
+	case err = <-errs:
+		return nil, err
+	case <-time.After(5 * time.Minute):
+		return nil, errors.New("timed out waiting for the consent")
+	}
+
+	tok, err := c.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange the authorization code: %v", err)
+	}
+	return tok, nil
+}
+
+// newState returns a random OAuth state, the redirect must bring it back
+func newState() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate the OAuth state: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// deviceFlow shows a code to enter on another device and polls until it is
+// entered, see https://developers.google.com/identity/protocols/oauth2/limited-input-device
+func deviceFlow(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	resp, err := postForm(ctx, deviceCodeURL, url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {strings.Join(config.Scopes, " ")},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to request a device code: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var device struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURL string `json:"verification_url"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+		Error           string `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the device code: %v", err)
+	}
+	if device.Error != "" || device.DeviceCode == "" {
+		return nil, fmt.Errorf("failed to get a device code: %s, the OAuth client must be of the TVs and Limited Input devices type", device.Error)
+	}
+
+	fmt.Printf("Visit %s and enter the code %s to authorize the Google API\n", device.VerificationURL, device.UserCode)
+
+	interval := time.Duration(device.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		tok, pending, err := pollDeviceToken(ctx, config, device.DeviceCode)
+		switch {
+		case err != nil:
+			return nil, err
+		case pending == "slow_down":
+			interval += 5 * time.Second
+		case pending == "":
+			return tok, nil
+		}
+	}
+	return nil, errors.New("the device code expired before it was entered")
+}
+
+// pollDeviceToken asks for the token of the device code, pending is the error
+// code while the user hasn't entered the code yet
+func pollDeviceToken(ctx context.Context, config *oauth2.Config, deviceCode string) (*oauth2.Token, string, error) {
+	resp, err := postForm(ctx, config.Endpoint.TokenURL, url.Values{
+		"client_id":     {config.ClientID},
+		"client_secret": {config.ClientSecret},
+		"device_code":   {deviceCode},
+		"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to poll the device token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		Error        string `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse the device token: %v", err)
+	}
+	switch result.Error {
+	case "":
+	case "authorization_pending", "slow_down":
+		return nil, result.Error, nil
+	default:
+		return nil, "", fmt.Errorf("device authorization failed: %s", result.Error)
+	}
+
+	return &oauth2.Token{
+		AccessToken:  result.AccessToken,
+		RefreshToken: result.RefreshToken,
+		TokenType:    result.TokenType,
+		Expiry:       time.Now().Add(time.Duration(result.ExpiresIn) * time.Second),
+	}, "", nil
+}
+
+// postForm posts the form values with the context
+func postForm(ctx context.Context, target string, values url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return http.DefaultClient.Do(req)
+}
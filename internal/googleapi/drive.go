@@ -0,0 +1,153 @@
+package googleapi
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+const spreadsheetMimeType = "application/vnd.google-apps.spreadsheet"
+
+// Drive is where the spreadsheets are created and who they are shared with
+type Drive struct {
+	// FolderID is the folder the spreadsheets are created in, of a shared drive
+	// or not, empty keeps the Drive root of the credentials
+	FolderID string
+	// Readers and Writers are the grantees of the reader and writer roles,
+	// ex: alice@example.com, group:kernel@example.com, domain:example.com or anyone
+	Readers []string
+	Writers []string
+	// Notify lets Drive e-mail the users and groups the spreadsheet is shared with
+	Notify bool
+}
+
+// Enabled tells if the spreadsheets need the Drive API
+func (d Drive) Enabled() bool {
+	return d.FolderID != "" || len(d.Readers) > 0 || len(d.Writers) > 0
+}
+
+// Scopes returns the scopes of the Sheets API, and of the Drive API if enabled.
+// The Drive scope lets the spreadsheets be created in a folder the client didn't create.
+func (d Drive) Scopes() []string {
+	if !d.Enabled() {
+		return Scopes
+	}
+	return append(append([]string{}, Scopes...), drive.DriveScope)
+}
+
+// ParseGrantees parses the comma separated grantees, an e-mail is a user,
+// ex: alice@example.com,group:kernel@example.com,domain:example.com,anyone
+func ParseGrantees(list string) ([]string, error) {
+	var grantees []string
+	for _, grantee := range strings.Split(list, ",") {
+		grantee = strings.TrimSpace(grantee)
+		if grantee == "" {
+			continue
+		}
+		_, err := newPermission(grantee, "reader")
+		if err != nil {
+			return nil, err
+		}
+		grantees = append(grantees, grantee)
+	}
+	return grantees, nil
+}
+
+// newPermission returns the permission of the grantee
+func newPermission(grantee, role string) (*drive.Permission, error) {
+	permission := &drive.Permission{Role: role, Type: "user"}
+	if strings.EqualFold(grantee, "anyone") {
+		permission.Type = "anyone"
+		return permission, nil
+	}
+	if kind, value, ok := strings.Cut(grantee, ":"); ok {
+		permission.Type = strings.ToLower(kind)
+		grantee = value
+	}
+	switch permission.Type {
+	case "user", "group":
+		if !strings.Contains(grantee, "@") {
+			return nil, fmt.Errorf("invalid grantee: %s, the %s needs an e-mail", grantee, permission.Type)
+		}
+		permission.EmailAddress = grantee
+	case "domain":
+		if grantee == "" {
+			return nil, fmt.Errorf("invalid grantee: domain needs a domain name, ex: domain:example.com")
+		}
+		permission.Domain = grantee
+	default:
+		return nil, fmt.Errorf("unknown grantee type: %s, ex: user, group, domain or anyone", permission.Type)
+	}
+	return permission, nil
+}
+
+// createInFolder creates the spreadsheet in the Drive folder, a service account
+// has no Drive storage of its own but may create in a shared drive
+func (g *GoogleAPI) createInFolder(spreadsheetName, folderID string) (*sheets.Spreadsheet, error) {
+	file, err := g.driveSvc.Files.Create(&drive.File{
+		Name:     spreadsheetName,
+		MimeType: spreadsheetMimeType,
+		Parents:  []string{folderID},
+	}).SupportsAllDrives(true).Fields("id").Context(g.ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spreadsheet in folder %s: %v", folderID, err)
+	}
+
+	spreadsheet, err := g.sheetsSvc.Spreadsheets.Get(file.Id).Context(g.ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get spreadsheet: %v", err)
+	}
+	return spreadsheet, nil
+}
+
+// Share grants the readers and writers of the drive access to the spreadsheet
+func (g *GoogleAPI) Share(d Drive) error {
+	roles := []struct {
+		role     string
+		grantees []string
+	}{{"reader", d.Readers}, {"writer", d.Writers}}
+	for _, r := range roles {
+		for _, grantee := range r.grantees {
+			permission, err := newPermission(grantee, r.role)
+			if err != nil {
+				return err
+			}
+			call := g.driveSvc.Permissions.Create(g.spreadsheetID, permission).SupportsAllDrives(true)
+			// Drive only e-mails users and groups
+			if permission.Type == "user" || permission.Type == "group" {
+				call = call.SendNotificationEmail(d.Notify)
+			}
+			_, err = call.Context(g.ctx).Do()
+			if err != nil {
+				return fmt.Errorf("failed to share spreadsheet with %s: %v", grantee, err)
+			}
+		}
+	}
+	return nil
+}
+
+// URL returns the link of the spreadsheet, it opens for everyone it is shared with
+func (g *GoogleAPI) URL() string {
+	if g.spreadsheet == nil {
+		return ""
+	}
+	if g.spreadsheet.SpreadsheetUrl != "" {
+		return g.spreadsheet.SpreadsheetUrl
+	}
+	return "https://docs.google.com/spreadsheets/d/" + g.spreadsheetID + "/edit"
+}
+
+// discard deletes the spreadsheet the error left partially written. Without
+// the Drive API, or if the deletion fails, the error tells where it is left.
+func (g *GoogleAPI) discard(err error) error {
+	if g.driveSvc == nil {
+		return fmt.Errorf("%v, the partial spreadsheet is left at %s", err, g.URL())
+	}
+	deleteErr := g.driveSvc.Files.Delete(g.spreadsheetID).SupportsAllDrives(true).Context(g.ctx).Do()
+	if deleteErr != nil {
+		return fmt.Errorf("%v, failed to delete the partial spreadsheet %s: %v", err, g.URL(), deleteErr)
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package googleapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+func TestParseGrantees(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{"alice@example.com, group:kernel@example.com,,domain:example.com,anyone", []string{"alice@example.com", "group:kernel@example.com", "domain:example.com", "anyone"}, false},
+		{"", nil, false},
+		{"alice", nil, true},
+		{"domain:", nil, true},
+		{"team:kernel@example.com", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseGrantees(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseGrantees(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("ParseGrantees(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	writeErr := errors.New("failed to write summary: quota exceeded")
+
+	tests := []struct {
+		name string
+		// status answers the deletion, 0 means no Drive API
+		status  int
+		wantErr []string
+	}{
+		{"no drive", 0, []string{"quota exceeded", "partial spreadsheet is left at https://docs.google.com/spreadsheets/d/sheet-id/edit"}},
+		{"deleted", http.StatusNoContent, []string{"quota exceeded"}},
+		{"deletion failed", http.StatusForbidden, []string{"quota exceeded", "failed to delete the partial spreadsheet https://docs.google.com/spreadsheets/d/sheet-id/edit"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deleted []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodDelete {
+					deleted = append(deleted, r.URL.Path)
+				}
+				if r.URL.Query().Get("supportsAllDrives") != "true" {
+					t.Errorf("%s doesn't support shared drives", r.URL)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			g := &GoogleAPI{ctx: context.Background(), spreadsheet: &sheets.Spreadsheet{SpreadsheetId: "sheet-id"}, spreadsheetID: "sheet-id"}
+			if tt.status != 0 {
+				var err error
+				g.driveSvc, err = drive.NewService(g.ctx, option.WithHTTPClient(server.Client()), option.WithEndpoint(server.URL+"/"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := g.discard(writeErr)
+			for _, want := range tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("error %v doesn't contain %q", err, want)
+				}
+			}
+			if tt.status != 0 && (len(deleted) != 1 || deleted[0] != "/files/sheet-id") {
+				t.Errorf("deleted %v, want /files/sheet-id", deleted)
+			}
+		})
+	}
+}
@@ -2,19 +2,20 @@ package googleapi
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"grafana-extract-go/internal/app/crashlog"
 	"grafana-extract-go/internal/crashlogutil"
-	"io/ioutil"
+	"grafana-extract-go/internal/devicehistory"
+	"grafana-extract-go/internal/ownership"
+	"grafana-extract-go/internal/report"
+	"grafana-extract-go/internal/storage"
+	"grafana-extract-go/internal/uptime"
 	"log"
-	"net/http"
-	"os"
 	"strings"
+	"time"
 
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
 	"google.golang.org/api/sheets/v4"
 )
@@ -24,147 +25,265 @@ const (
 	TokenPath       = "credential/token.json"
 )
 
+// Scopes is what the client is authorized for
+var Scopes = []string{sheets.SpreadsheetsScope}
+
 type GoogleAPI struct {
-	ctx           context.Context
-	sheetsSvc     *sheets.Service
+	ctx       context.Context
+	sheetsSvc *sheets.Service
+	// driveSvc places and shares the spreadsheet, nil without the Drive API
+	driveSvc      *drive.Service
 	spreadsheet   *sheets.Spreadsheet
 	sheetName     string
 	spreadsheetID string
+	// The sheet IDs by sheet name, to link the sheets
+	sheetIDs map[string]int64
+	// The next empty row of every sheet, WriteData appends below the rows already queued
+	nextRows map[string]int
+	// The values queued by WriteData, sent by Flush
+	pending []*sheets.ValueRange
 }
 
-func parseToken(token []byte) *oauth2.Token {
-	strToken := strings.TrimSpace(string(token))
-	return &oauth2.Token{
-		AccessToken: strToken,
+// The values sent per Values.BatchUpdate call at most, in characters. It keeps
+// every request well under the request size the Sheets API accepts.
+const maxBatchChars = 4 << 20
+
+// CreateSpreadsheet creates the spreadsheet in the folder, an empty folder ID
+// means the Drive root of the credentials
+func (g *GoogleAPI) CreateSpreadsheet(spreadsheetName, folderID string) error {
+	var spreadsheet *sheets.Spreadsheet
+	var err error
+	if folderID != "" {
+		if g.driveSvc == nil {
+			return errors.New("no Drive client to create the spreadsheet in a folder")
+		}
+		spreadsheet, err = g.createInFolder(spreadsheetName, folderID)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Create a new spreadsheet
+		spreadsheet = &sheets.Spreadsheet{
+			Properties: &sheets.SpreadsheetProperties{
+				Title: spreadsheetName,
+			},
+		}
+
+		// Call the Sheets API to create the spreadsheet
+		spreadsheet, err = g.sheetsSvc.Spreadsheets.Create(spreadsheet).Context(g.ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to create spreadsheet: %v", err)
+		}
+	}
+
+	g.spreadsheet = spreadsheet
+	g.spreadsheetID = spreadsheet.SpreadsheetId
+	g.sheetIDs = make(map[string]int64)
+	for _, sheet := range spreadsheet.Sheets {
+		g.sheetIDs[sheet.Properties.Title] = sheet.Properties.SheetId
 	}
-}
 
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config, tokenFile string) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tok, _ := tokenFromFile(tokenFile)
-	return config.Client(context.Background(), tok)
+	return nil
 }
 
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
+// DefaultSheet returns the name of the sheet a new spreadsheet comes with, ex: Sheet1
+func (g *GoogleAPI) DefaultSheet() string {
+	if g.spreadsheet == nil || len(g.spreadsheet.Sheets) == 0 {
+		return "Sheet1"
 	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
+	return g.spreadsheet.Sheets[0].Properties.Title
 }
 
-func (g *GoogleAPI) CreateSpreadsheet(spreadsheetName string) error {
-	// Create a new spreadsheet
-	spreadsheet := &sheets.Spreadsheet{
-		Properties: &sheets.SpreadsheetProperties{
-			Title: spreadsheetName,
-		},
+// WriteData queues the rows below the rows already queued for the sheet, the
+// first rows go to A1. Nothing is sent before Flush.
+func (g *GoogleAPI) WriteData(data [][]interface{}, sheetName string) error {
+	if g.nextRows == nil {
+		g.nextRows = make(map[string]int)
 	}
-
-	// Call the Sheets API to create the spreadsheet
-	spreadsheet, err := g.sheetsSvc.Spreadsheets.Create(spreadsheet).Context(g.ctx).Do()
-	if err != nil {
-		return fmt.Errorf("failed to create spreadsheet: %v", err)
+	row := g.nextRows[sheetName]
+	if row == 0 {
+		row = 1
 	}
+	g.nextRows[sheetName] = row + len(data)
 
-	g.spreadsheet = spreadsheet
-	g.spreadsheetID = spreadsheet.SpreadsheetId
+	var vr sheets.ValueRange
+	vr.Range = fmt.Sprintf("%s!A%d", quoteSheet(sheetName), row)
+
+	// The empty cells are kept, so every value stays in its column
+	vr.Values = data
+	if len(vr.Values) > 0 {
+		g.pending = append(g.pending, &vr)
+	}
 
 	return nil
 }
 
-func (g *GoogleAPI) WriteData(data [][]interface{}, sheetName string) error {
-	writeRange := sheetName + "!A1" // Specify the sheet name and cell range
-
-	var vr sheets.ValueRange
+// SkipRows leaves empty rows below the rows already queued for the sheet
+func (g *GoogleAPI) SkipRows(sheetName string, rows int) {
+	if g.nextRows == nil {
+		g.nextRows = make(map[string]int)
+	}
+	if g.nextRows[sheetName] == 0 {
+		g.nextRows[sheetName] = 1
+	}
+	g.nextRows[sheetName] += rows
+}
 
-	// Iterate over each column in the data slice
-	for _, col := range data {
-		// Filter out empty values in the column
-		filteredCol := make([]interface{}, 0)
-		for _, value := range col {
-			if value != "" {
-				filteredCol = append(filteredCol, value)
+// Flush sends the values queued by WriteData, in as few Values.BatchUpdate calls as the request size allows
+func (g *GoogleAPI) Flush() error {
+	for len(g.pending) > 0 {
+		n, chars := 0, 0
+		for n < len(g.pending) {
+			size := valueChars(g.pending[n])
+			if n > 0 && chars+size > maxBatchChars {
+				break
 			}
+			chars += size
+			n++
+		}
+
+		// The crash data is raw, so it is never parsed as formulas
+		request := &sheets.BatchUpdateValuesRequest{
+			ValueInputOption: "RAW",
+			Data:             g.pending[:n],
 		}
-		// Append the filtered column to the ValueRange
-		vr.Values = append(vr.Values, filteredCol)
+		_, err := g.sheetsSvc.Spreadsheets.Values.BatchUpdate(g.spreadsheetID, request).Context(g.ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to update data in sheets: %v", err)
+		}
+		g.pending = g.pending[n:]
 	}
+	return nil
+}
 
-	_, err := g.sheetsSvc.Spreadsheets.Values.Update(g.spreadsheetID, writeRange, &vr).ValueInputOption("RAW").Do()
-	if err != nil {
-		log.Fatalf("Unable to update data in sheet. %v", err)
+// valueChars returns the size of the values of the range in characters
+func valueChars(vr *sheets.ValueRange) int {
+	chars := len(vr.Range)
+	for _, row := range vr.Values {
+		for _, value := range row {
+			chars += len(fmt.Sprint(value)) + 3
+		}
 	}
+	return chars
+}
 
-	return nil
+// quoteSheet quotes the sheet name for a range, ex: 'Out of memory 3f2a9c1be07d'
+func quoteSheet(sheetName string) string {
+	return "'" + strings.ReplaceAll(sheetName, "'", "''") + "'"
 }
 
 func (g *GoogleAPI) CreateSheet(sheetName string) error {
-	// Create the sheet properties
-	sheetProperties := &sheets.SheetProperties{
-		Title: sheetName,
+	return g.CreateSheets([]string{sheetName})
+}
+
+// CreateSheets adds the sheets to the spreadsheet in a single BatchUpdate call
+func (g *GoogleAPI) CreateSheets(sheetNames []string) error {
+	if len(sheetNames) == 0 {
+		return nil
 	}
 
-	// Create the request to add a sheet
-	addSheetRequest := &sheets.Request{
-		AddSheet: &sheets.AddSheetRequest{
-			Properties: sheetProperties,
-		},
+	// Create the requests to add a sheet
+	requests := make([]*sheets.Request, 0, len(sheetNames))
+	for _, sheetName := range sheetNames {
+		requests = append(requests, &sheets.Request{
+			AddSheet: &sheets.AddSheetRequest{
+				Properties: &sheets.SheetProperties{Title: sheetName},
+			},
+		})
 	}
 
 	// Create the batch update spreadsheet request
 	batchUpdateRequest := &sheets.BatchUpdateSpreadsheetRequest{
-		Requests: []*sheets.Request{addSheetRequest},
+		Requests: requests,
 	}
 
 	// Execute the batch update request
-	_, err := g.sheetsSvc.Spreadsheets.BatchUpdate(g.spreadsheetID, batchUpdateRequest).Context(g.ctx).Do()
+	resp, err := g.sheetsSvc.Spreadsheets.BatchUpdate(g.spreadsheetID, batchUpdateRequest).Context(g.ctx).Do()
 	if err != nil {
-		return fmt.Errorf("failed to create sheet: %v", err)
+		return fmt.Errorf("failed to create sheets: %v", err)
+	}
+	for _, reply := range resp.Replies {
+		if reply.AddSheet != nil {
+			g.sheetIDs[reply.AddSheet.Properties.Title] = reply.AddSheet.Properties.SheetId
+		}
 	}
 
 	return nil
 }
 
-func NewGoogleAPI(credentialsFile, tokenFile string) (*GoogleAPI, error) {
-	ctx := context.Background()
+// hyperlink returns the formula linking to the sheet id, the label quotes are doubled
+// as in any formula string
+func hyperlink(id int64, label string) string {
+	return fmt.Sprintf(`=HYPERLINK("#gid=%d", "%s")`, id, strings.ReplaceAll(label, `"`, `""`))
+}
 
-	// Read the credentials file
-	credentials, err := ioutil.ReadFile(credentialsFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+// LinkSheets turns cells of column A into links to other sheets, rows maps
+// the linked sheet name to the 0-based row of the cell
+func (g *GoogleAPI) LinkSheets(sheetName string, rows map[string]int) error {
+	var data []*sheets.ValueRange
+	for target, row := range rows {
+		id, ok := g.sheetIDs[target]
+		if !ok {
+			continue
+		}
+		data = append(data, &sheets.ValueRange{
+			Range:  fmt.Sprintf("%s!A%d", quoteSheet(sheetName), row+1),
+			Values: [][]interface{}{{hyperlink(id, target)}},
+		})
+	}
+	if len(data) == 0 {
+		return nil
 	}
 
-	// Parse the credentials file
-	config, err := google.ConfigFromJSON(credentials, sheets.SpreadsheetsScope)
+	// Only the links are user entered, so the crash data is never parsed as formulas
+	request := &sheets.BatchUpdateValuesRequest{
+		ValueInputOption: "USER_ENTERED",
+		Data:             data,
+	}
+	_, err := g.sheetsSvc.Spreadsheets.Values.BatchUpdate(g.spreadsheetID, request).Context(g.ctx).Do()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse credentials file: %v", err)
+		return fmt.Errorf("failed to link sheets: %v", err)
 	}
 
-	client := getClient(config, tokenFile)
+	return nil
+}
+
+// NewGoogleAPI returns a Sheets client authorized by the auth, and a Drive
+// client if the drive is enabled
+func NewGoogleAPI(auth Auth, d Drive) (*GoogleAPI, error) {
+	ctx := context.Background()
+
+	client, err := auth.Client(ctx, d.Scopes()...)
+	if err != nil {
+		return nil, err
+	}
 
 	sheetsSvc, err := sheets.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		log.Fatalf("Unable to retrieve Sheets client: %v", err)
+		return nil, fmt.Errorf("failed to create Sheets client: %v", err)
+	}
+
+	var driveSvc *drive.Service
+	if d.Enabled() {
+		driveSvc, err = drive.NewService(ctx, option.WithHTTPClient(client))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Drive client: %v", err)
+		}
 	}
 
 	return &GoogleAPI{
 		ctx:       ctx,
 		sheetsSvc: sheetsSvc,
+		driveSvc:  driveSvc,
 	}, nil
 
 }
 
-func WriteCrashLogs(crashLogs []crashlog.CrashLog) error {
+// WriteCrashLogs writes the crash logs into a new spreadsheet of the drive and
+// returns its URL
+func WriteCrashLogs(crashLogs []crashlog.CrashLog, opts report.Options, auth Auth, d Drive) (string, error) {
 	if len(crashLogs) == 0 {
-		return errors.New("crashLogs slice is empty")
+		return "", errors.New("crashLogs slice is empty")
 	}
 
 	// Extract the year and date from the first crash log entry
@@ -174,102 +293,149 @@ func WriteCrashLogs(crashLogs []crashlog.CrashLog) error {
 	// Extract the version number from crashLogs[0].Version
 	version, err := crashlogutil.ExtractVersion(crashLogs[0].Version)
 	if err != nil {
-		return fmt.Errorf("failed to extract version: %s", err)
+		return "", fmt.Errorf("failed to extract version: %s", err)
 	}
 
-	// Generate the spreadsheet and sheet names
+	// Generate the spreadsheet name
 	spreadsheetName := fmt.Sprintf("CrashLogs-%s-%s-%s", crashLogs[0].Model, version, yearDate)
-	sheetNamePrefix := "CrashLog"
 
 	// Initialize the google sheet client API
-	api, err := NewGoogleAPI(CredentialsPath, TokenPath)
+	api, err := NewGoogleAPI(auth, d)
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.Println("Creating Spreadsheet")
 	// Create the spreadsheet
-	err = api.CreateSpreadsheet(spreadsheetName)
+	err = api.CreateSpreadsheet(spreadsheetName, d.FolderID)
 	if err != nil {
 		log.Println("Failed to creating srpeadsheet")
-		return err
+		return "", err
 	}
+	// Write the report, a partially written spreadsheet is deleted
+	err = api.writeReport(crashLogs, opts)
+	if err != nil {
+		return "", api.discard(err)
+	}
+	// Share it once the report is complete, the grantees never open a partial one
+	err = api.Share(d)
+	if err != nil {
+		return "", fmt.Errorf("%v, the spreadsheet is written but not shared: %s", err, api.URL())
+	}
+	return api.URL(), nil
+}
 
-	// Extract unique crash logs
-	uniqueCrashLogs := crashlogutil.ExtractUniqueCrashLogs(crashLogs)
-
-	// TODO: 
-	// Start from the five row in default Sheet1
-	// sheet1row := 5
-	// Create a map to store AnonymousDeviceID
-	// processedIDs := make(map[string]bool)
+// writeReport writes the crash groups, the summary and the analysis sheets
+// into the spreadsheet
+func (g *GoogleAPI) writeReport(crashLogs []crashlog.CrashLog, opts report.Options) error {
+	// Group the crash logs by unique crash log, the dedup policy picks the written ones
+	groups := report.Groups(crashLogs, opts)
+
+	// Add the sheet of each unique crash log, even if all its crash logs are
+	// suppressed, and the analysis sheets in one call
+	sheetNames := make([]string, 0, len(groups)+3)
+	for _, group := range groups {
+		sheetNames = append(sheetNames, group.Sheet)
+	}
+	sheetNames = append(sheetNames, "Devices", "Uptime")
+	perModel := storage.PerModel(crashLogs)
+	if len(perModel) > 0 {
+		sheetNames = append(sheetNames, "Storage")
+	}
+	err := g.CreateSheets(sheetNames)
+	if err != nil {
+		return fmt.Errorf("Failed to create sheets: %v", err)
+	}
 
+	for _, group := range groups {
+		sheetName := group.Sheet
 
-	// Create sheets for each unique crash log
-	for i, crashLog := range uniqueCrashLogs {
-		sheetName := fmt.Sprintf("%s%d", sheetNamePrefix, i+1)
+		strReason := "Reason: "
+		strTitle := "AnonymousDeviceID: "
+		attribution := ownership.Attribute(group.CrashLog, opts.Owners)
 
-		// Create a new sheet within the spreadsheet
-		err = api.CreateSheet(sheetName)
+		// The rows follow the crash sheets of the Excel report. Set the header
+		// column, and keep the count of the crash logs the dedup policy suppressed
+		reasonData := []interface{}{strReason + group.Reason}
+		if group.Suppressed > 0 {
+			reasonData = append(reasonData, fmt.Sprintf("Suppressed: %d of %d by the %s policy", group.Suppressed, group.Crashes, opts.Dedup.Policy))
+		}
+		// Set the AnonymousDevice ID of the last written crash log
+		deviceID := ""
+		if len(group.Written) > 0 {
+			deviceID = group.Written[len(group.Written)-1].AnonymousDeviceID
+		}
+		// Next to it record the full fingerprint, the sheet name may be shortened,
+		// then set the owner and the subsystem it is attributed to
+		headerData := [][]interface{}{
+			reasonData,
+			{strTitle + deviceID, "Fingerprint: " + group.Fingerprint},
+			{fmt.Sprintf("Owner: %s (%s)", attribution.Owner, attribution.Subsystem)},
+		}
+		err = g.WriteData(headerData, sheetName)
 		if err != nil {
-			return fmt.Errorf("Failed to create sheet: %v", err)
+			return fmt.Errorf("failed to write crash log header: %v", err)
+		}
+
+		// List every crash instance when several devices share the crash log
+		if group.Devices > 1 {
+			err = g.WriteData(report.Instances(group.Logs), sheetName)
+			if err != nil {
+				return fmt.Errorf("failed to write crash instances: %v", err)
+			}
+			g.SkipRows(sheetName, 1)
 		}
 
-		// Prepare the crash log data
-		crashLogData := crashlogutil.FilterCrashLogByValue(crashLogs, crashLog)
-		// TODO: 
-		// Start from the third row in indivudual crash sheet
-		// row := 3
-
-		// Populate the crash log data in the sheet
-		for _, log := range crashLogData {
-			// TODO: call google API
-			// if processedIDs[log.AnonymousDeviceID] && unique {
-			// 	err := file.DeleteSheet(sheetName)
-			// 	if err != nil {
-			// 		return fmt.Errorf("failed to delete new sheet: %s", err)
-			// 	}
-			// 	continue
-			// }
-			
-			// Apply the regex pattern to the crash log
-			cleanLog := crashlogutil.ApplyRegex(log.CrashLog)
-
-			// Split the cleaned crash log into lines
-			lines := strings.Split(cleanLog, "\n")
-
-			// Create a slice to store the column-wise data
-			columnData := make([][]interface{}, 0)
-
-			// Identify kernel panic
-			kpType := crashlog.IdentifyKernelPanic(lines)
-			strReason := "Reason: "
-			strTitle := "AnonymousDeviceID: "
-			//fmt.Println("kpType:", kpType)
-			// Convert kernel panic type into a column
-			columnData = append(columnData, []interface{}{strReason + kpType })
-			// Set the AnonymousDevice ID
-			columnData = append(columnData, []interface{}{strTitle + log.AnonymousDeviceID })
-			// TODO:calculate total AnonymousDevice ID
-			// sheet1cell := fmt.Sprintf("A%d", sheet1row)
-			// file.SetCellValue("Sheet1", sheet1cell, log.AnonymousDeviceID)
-			// sheet1row++
-			// Take a record for handled AnonymousDeviceID
-			// processedIDs[log.AnonymousDeviceID] = true
-
-
-			// Convert each non-empty line of the crash log into a column
-			for _, line := range lines {
-				if line != "" {
-					columnData = append(columnData, []interface{}{line})
-				}
+		// Populate every written crash log below the previous one
+		for _, log := range group.Written {
+			// Describe the crash instance above its lines
+			columnData := report.Metadata(log)
+
+			// Write each line of the cleaned crash log in the order the kernel printed them
+			for _, line := range crashlogutil.PrintedLines(log.CrashLog) {
+				columnData = append(columnData, []interface{}{line})
 			}
-			// Write the column-wise data to the sheet
-			err = api.WriteData(columnData, sheetName)
+			// Queue the column-wise data below the previous crash log
+			err = g.WriteData(columnData, sheetName)
 			if err != nil {
 				return fmt.Errorf("failed to write crash log line: %v", err)
 			}
+			// Keep a blank row between the crash instances
+			g.SkipRows(sheetName, 1)
 		}
 	}
 
-	return nil
+	// Write the summary into the default sheet, linking every group to its sheet
+	summarySheet := g.DefaultSheet()
+	summary := report.BuildSummary(crashLogs, groups, opts, time.Now())
+	err = g.WriteData(summary.Rows, summarySheet)
+	if err != nil {
+		return fmt.Errorf("failed to write summary: %v", err)
+	}
+
+	// Write the crash history of every device into its own sheet
+	err = g.WriteData(devicehistory.Table(devicehistory.Build(crashLogs, opts.Owners)), "Devices")
+	if err != nil {
+		return fmt.Errorf("failed to write device history: %v", err)
+	}
+
+	// Write the uptime and load average distributions per signature
+	err = g.WriteData(uptime.Table(uptime.Analyze(crashLogs, opts.Owners)), "Uptime")
+	if err != nil {
+		return fmt.Errorf("failed to write uptime distribution: %v", err)
+	}
+
+	// Write the disk errors of the NVR and NAS models
+	if len(perModel) > 0 {
+		err = g.WriteData(storage.Table(perModel, storage.PerDevice(crashLogs)), "Storage")
+		if err != nil {
+			return fmt.Errorf("failed to write storage errors: %v", err)
+		}
+	}
+
+	// Send every queued value, then link the summary to the group sheets over the summary cells
+	err = g.Flush()
+	if err != nil {
+		return err
+	}
+	return g.LinkSheets(summarySheet, summary.GroupRows)
 }
@@ -0,0 +1,58 @@
+package googleapi
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHyperlink(t *testing.T) {
+	tests := []struct {
+		label, want string
+	}{
+		{"Fatal exception 3f2a9c1be07d", `=HYPERLINK("#gid=42", "Fatal exception 3f2a9c1be07d")`},
+		{`Bad "magic" 3f2a9c1be07d`, `=HYPERLINK("#gid=42", "Bad ""magic"" 3f2a9c1be07d")`},
+	}
+	for _, tt := range tests {
+		if got := hyperlink(42, tt.label); got != tt.want {
+			t.Errorf("hyperlink(%q) = %s, want %s", tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteSheet(t *testing.T) {
+	if got, want := quoteSheet("Don't panic"), "'Don''t panic'"; got != want {
+		t.Errorf("quoteSheet = %s, want %s", got, want)
+	}
+}
+
+func TestWriteData(t *testing.T) {
+	g := &GoogleAPI{}
+	err := g.WriteData([][]interface{}{{"Reason: Fatal exception"}, {"a", "", "UNVR"}}, "Sheet1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SkipRows("Sheet1", 1)
+	err = g.WriteData([][]interface{}{{"", "b"}}, "Sheet1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(g.pending) != 2 {
+		t.Fatalf("got %d pending ranges, want 2", len(g.pending))
+	}
+	tests := []struct {
+		wantRange string
+		wantRow   []interface{}
+	}{
+		// The empty middle cell keeps UNVR in the third column
+		{"'Sheet1'!A1", []interface{}{"a", "", "UNVR"}},
+		{"'Sheet1'!A4", []interface{}{"", "b"}},
+	}
+	for i, tt := range tests {
+		vr := g.pending[i]
+		row := vr.Values[len(vr.Values)-1]
+		if vr.Range != tt.wantRange || fmt.Sprint(row) != fmt.Sprint(tt.wantRow) || len(row) != len(tt.wantRow) {
+			t.Errorf("range %d = %s %q, want %s %q", i, vr.Range, row, tt.wantRange, tt.wantRow)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package googleapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/localexcel"
+	"grafana-extract-go/internal/report"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// sheetsServer answers the Sheets API calls of writeReport, and returns the
+// raw values written per sheet, one string slice per row
+func sheetsServer(t *testing.T) (*httptest.Server, map[string][][]string) {
+	rows := make(map[string][][]string)
+	rangeRegex := regexp.MustCompile(`^'(.*)'!A(\d+)$`)
+	var sheetID int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/values:batchUpdate"):
+			var request sheets.BatchUpdateValuesRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				t.Error(err)
+			}
+			json.NewEncoder(w).Encode(sheets.BatchUpdateValuesResponse{})
+			if request.ValueInputOption != "RAW" {
+				break
+			}
+			for _, vr := range request.Data {
+				match := rangeRegex.FindStringSubmatch(vr.Range)
+				if match == nil {
+					t.Errorf("unexpected range %s", vr.Range)
+					continue
+				}
+				name := strings.ReplaceAll(match[1], "''", "'")
+				first, _ := strconv.Atoi(match[2])
+				for i, values := range vr.Values {
+					for len(rows[name]) < first+i {
+						rows[name] = append(rows[name], nil)
+					}
+					row := make([]string, 0, len(values))
+					for _, value := range values {
+						row = append(row, fmt.Sprint(value))
+					}
+					rows[name][first+i-1] = row
+				}
+			}
+		case strings.HasSuffix(r.URL.Path, ":batchUpdate"):
+			var request sheets.BatchUpdateSpreadsheetRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				t.Error(err)
+			}
+			var response sheets.BatchUpdateSpreadsheetResponse
+			for _, req := range request.Requests {
+				sheetID++
+				properties := &sheets.SheetProperties{Title: req.AddSheet.Properties.Title, SheetId: sheetID}
+				response.Replies = append(response.Replies, &sheets.Response{AddSheet: &sheets.AddSheetResponse{Properties: properties}})
+			}
+			json.NewEncoder(w).Encode(response)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server, rows
+}
+
+func TestWriteReportMatchesExcel(t *testing.T) {
+	crashLog := "<0>[  12.000300] Kernel panic - not syncing: Fatal exception" +
+		"<4>[  12.000200] pc : blk_update_request+0x1c4/0x3e8" +
+		"<4>[  12.000100] Call trace:"
+	data := []crashlog.CrashLog{
+		{AnonymousDeviceID: "a", SystemTime: time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC), Model: "UNVR", Version: "v3.1.9",
+			Signal: 11, IsInternal: "false", Uptime: 90, CrashLog: crashLog},
+		{AnonymousDeviceID: "b", SystemTime: time.Date(2023, 6, 15, 11, 0, 0, 0, time.UTC), Model: "UNVR", Version: "v3.1.9",
+			Signal: 11, IsInternal: "false", CrashLog: crashLog},
+	}
+	opts := report.Options{Dedup: report.Dedup{Policy: report.DedupNone}}
+
+	server, rows := sheetsServer(t)
+	defer server.Close()
+	g := &GoogleAPI{ctx: context.Background(), spreadsheetID: "sheet-id", sheetIDs: make(map[string]int64)}
+	var err error
+	g.sheetsSvc, err = sheets.NewService(g.ctx, option.WithHTTPClient(server.Client()), option.WithEndpoint(server.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.writeReport(data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = localexcel.WriteExcel(&buf, data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := excelize.OpenReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	groups := report.Groups(data, opts)
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups, want 1", len(groups))
+	}
+	sheet := groups[0].Sheet
+	want, err := file.GetRows(sheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := rows[sheet]
+	// The trailing blank rows are only skipped, and Excel reads no trailing empty cells
+	for len(want) > 0 && len(want[len(want)-1]) == 0 {
+		want = want[:len(want)-1]
+	}
+	for i, row := range got {
+		for len(row) > 0 && row[len(row)-1] == "" {
+			row = row[:len(row)-1]
+		}
+		got[i] = row
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d\n%q\nwant\n%q", len(got), len(want), got, want)
+	}
+	for i := range want {
+		if strings.Join(got[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("row %d = %q, want %q", i+1, got[i], want[i])
+		}
+	}
+}
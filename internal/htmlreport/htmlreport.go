@@ -0,0 +1,250 @@
+package htmlreport
+
+import (
+	"errors"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/devicehistory"
+	"grafana-extract-go/internal/report"
+	"grafana-extract-go/internal/storage"
+	"grafana-extract-go/internal/uptime"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cell is one cell of a table, Link is the anchor of the group it points to
+type Cell struct {
+	Text string
+	Link string
+}
+
+// Block is a part of the summary, either a table with a header or key/value pairs
+type Block struct {
+	Table  bool
+	Header []Cell
+	Rows   [][]Cell
+}
+
+// Line is one crash log line and the class it is styled by
+type Line struct {
+	Text  string
+	Class string
+}
+
+// Instance is one written crash log of a group
+type Instance struct {
+	Metadata [][]Cell
+	Lines    []Line
+}
+
+// Group is the details of one crash group
+type Group struct {
+	Anchor      string
+	Sheet       string
+	Reason      string
+	Fingerprint string
+	Owner       string
+	Crashes     int
+	Devices     int
+	Suppressed  int
+	Instances   *Block
+	Written     []Instance
+}
+
+// Page is what the template renders
+type Page struct {
+	Title     string
+	Summary   []Block
+	Groups    []Group
+	Sections  []Section
+	Generated string
+}
+
+// Section is a titled table below the groups, ex: the device history
+type Section struct {
+	Title string
+	Table Block
+}
+
+// CreateHTML writes the report of the crash logs into a single HTML file, named like the Excel file
+func CreateHTML(data []crashlog.CrashLog, opts report.Options) error {
+	if len(data) == 0 {
+		return errors.New("data slice is empty")
+	}
+
+	fileName, err := opts.Output.Path(data, opts.Query, ".html")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(fileName); dir != "." {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create output directory: %s", err)
+		}
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to create HTML file: %s", err)
+	}
+	defer f.Close()
+
+	err = Render(f, data, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Saved HTML file:", fileName)
+	return nil
+}
+
+// Render writes the report of the crash logs as a self-contained HTML page,
+// the styles and scripts are inlined so it works offline
+func Render(w io.Writer, data []crashlog.CrashLog, opts report.Options) error {
+	page := BuildPage(data, opts, time.Now())
+	err := pageTemplate.Execute(w, page)
+	if err != nil {
+		return fmt.Errorf("failed to render HTML report: %s", err)
+	}
+	return nil
+}
+
+// BuildPage lays out the report from the same groups, summary and analysis tables as the Excel writer
+func BuildPage(data []crashlog.CrashLog, opts report.Options, generated time.Time) Page {
+	groups := report.Groups(data, opts)
+	summary := report.BuildSummary(data, groups, opts, generated)
+
+	// The summary links every group to its details
+	anchors := make(map[string]string, len(groups))
+	for i, group := range groups {
+		anchors[group.Sheet] = fmt.Sprintf("group-%d", i+1)
+	}
+
+	page := Page{
+		Title:     "Crash report",
+		Generated: generated.Format(time.RFC3339),
+	}
+	if len(summary.Rows) > 0 && len(summary.Rows[0]) == 1 {
+		page.Title = fmt.Sprint(summary.Rows[0][0])
+		page.Summary = blocks(summary.Rows[1:], summary.GroupRows, anchors, 1)
+	} else {
+		page.Summary = blocks(summary.Rows, summary.GroupRows, anchors, 0)
+	}
+
+	for _, group := range groups {
+		page.Groups = append(page.Groups, buildGroup(group, anchors[group.Sheet]))
+	}
+
+	page.Sections = append(page.Sections, Section{Title: "Devices", Table: table(devicehistory.Table(devicehistory.Build(data, opts.Owners)))})
+	page.Sections = append(page.Sections, Section{Title: "Uptime", Table: table(uptime.Table(uptime.Analyze(data, opts.Owners)))})
+	if perModel := storage.PerModel(data); len(perModel) > 0 {
+		for _, block := range blocks(storage.Table(perModel, storage.PerDevice(data)), nil, nil, 0) {
+			page.Sections = append(page.Sections, Section{Title: "Storage", Table: block})
+		}
+	}
+
+	return page
+}
+
+func buildGroup(group report.Group, anchor string) Group {
+	g := Group{
+		Anchor:      anchor,
+		Sheet:       group.Sheet,
+		Reason:      group.Reason,
+		Fingerprint: group.Fingerprint,
+		Owner:       group.Owner,
+		Crashes:     group.Crashes,
+		Devices:     group.Devices,
+		Suppressed:  group.Suppressed,
+	}
+
+	// List every crash instance when several devices share the crash log
+	if group.Devices > 1 {
+		instances := table(report.Instances(group.Logs))
+		g.Instances = &instances
+	}
+
+	for _, log := range group.Written {
+		lines := crashlogutil.PrintedLines(log.CrashLog)
+		classes := crashlogutil.ClassifyLines(lines)
+		instance := Instance{Metadata: cells(report.Metadata(log), nil, nil, 0)}
+		for i, line := range lines {
+			instance.Lines = append(instance.Lines, Line{Text: line, Class: lineClass(classes[i])})
+		}
+		g.Written = append(g.Written, instance)
+	}
+	return g
+}
+
+// lineClass returns the CSS class of a crash log line class
+func lineClass(class crashlogutil.LineClass) string {
+	switch class {
+	case crashlogutil.HeadlineLine:
+		return "headline"
+	case crashlogutil.TraceLine:
+		return "trace"
+	case crashlogutil.TimestampLine:
+		return "timestamp"
+	default:
+		return ""
+	}
+}
+
+// blocks splits the rows at the empty rows. A block whose first row has more
+// than two cells is a table with that row as the header, the others are
+// key/value pairs. links maps a group sheet to its row in rows, offset is the
+// index of rows[0] in the rows links refers to.
+func blocks(rows [][]interface{}, links map[string]int, anchors map[string]string, offset int) []Block {
+	var result []Block
+	start := 0
+	for i := 0; i <= len(rows); i++ {
+		if i < len(rows) && len(rows[i]) > 0 {
+			continue
+		}
+		if i > start {
+			part := rows[start:i]
+			body := cells(part, links, anchors, offset+start)
+			if len(part[0]) > 2 {
+				result = append(result, Block{Table: true, Header: body[0], Rows: body[1:]})
+			} else {
+				result = append(result, Block{Rows: body})
+			}
+		}
+		start = i + 1
+	}
+	return result
+}
+
+// table converts rows with a header into a table block
+func table(rows [][]interface{}) Block {
+	body := cells(rows, nil, nil, 0)
+	if len(body) == 0 {
+		return Block{Table: true}
+	}
+	return Block{Table: true, Header: body[0], Rows: body[1:]}
+}
+
+// cells formats the values of the rows, the first cell of a linked row points to its group
+func cells(rows [][]interface{}, links map[string]int, anchors map[string]string, offset int) [][]Cell {
+	linked := make(map[int]string, len(links))
+	for sheet, row := range links {
+		linked[row] = anchors[sheet]
+	}
+
+	result := make([][]Cell, 0, len(rows))
+	for i, row := range rows {
+		formatted := make([]Cell, 0, len(row))
+		for j, value := range row {
+			cell := Cell{Text: fmt.Sprint(value)}
+			if j == 0 {
+				cell.Link = linked[offset+i]
+			}
+			formatted = append(formatted, cell)
+		}
+		result = append(result, formatted)
+	}
+	return result
+}
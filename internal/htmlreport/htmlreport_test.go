@@ -0,0 +1,76 @@
+package htmlreport
+
+import (
+	"bytes"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/report"
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	panicLog := "<0>[  12.000200] Kernel panic - not syncing: Fatal exception" +
+		"<4>[  12.000100] pc : blk_update_request+0x1c4/0x3e8"
+	// A hostile crash line, the page must show it and never run it
+	hostileLog := "<0>[  13.000200] Kernel panic - not syncing: <script>alert(1)</script>" +
+		"<4>[  13.000100] comm: <img src=x onerror=alert(2)>"
+	data := []crashlog.CrashLog{
+		{AnonymousDeviceID: "a", SystemTime: time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC), Model: "UNVR", Version: "v3.1.9", CrashLog: panicLog},
+		{AnonymousDeviceID: "b", SystemTime: time.Date(2023, 6, 15, 11, 0, 0, 0, time.UTC), Model: "UNVR", Version: "v3.1.9", CrashLog: panicLog},
+		{AnonymousDeviceID: "c", SystemTime: time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC), Model: "UNVR", Version: "v3.1.9", CrashLog: hostileLog},
+	}
+	opts := report.Options{Dedup: report.Dedup{Policy: report.DedupNone}}
+
+	var buf bytes.Buffer
+	err := Render(&buf, data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+
+	// The summary table lists every group, linked to its section
+	if !strings.Contains(page, "<h2>Summary</h2>") || !strings.Contains(page, "<th>Sheet</th><th>Reason</th><th>Fingerprint</th>") {
+		t.Error("no summary table of the groups")
+	}
+	groups := report.Groups(data, opts)
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(groups))
+	}
+	links := regexp.MustCompile(`<td><a href="#(group-\d+)">([^<]*)</a></td>`).FindAllStringSubmatch(page, -1)
+	if len(links) != len(groups) {
+		t.Fatalf("got %d links in the summary, want %d", len(links), len(groups))
+	}
+	for i, link := range links {
+		if html.UnescapeString(link[2]) != groups[i].Sheet {
+			t.Errorf("link %d is labeled %q, want %q", i, link[2], groups[i].Sheet)
+		}
+		// One section per group, the link points to its anchor
+		if n := strings.Count(page, `<details id="`+link[1]+`"`); n != 1 {
+			t.Errorf("got %d sections with the anchor %s, want 1", n, link[1])
+		}
+	}
+	if n := strings.Count(page, "<details "); n != len(groups) {
+		t.Errorf("got %d group sections, want %d", n, len(groups))
+	}
+
+	// The group shared by two devices lists its instances, and both crash logs are written
+	if !strings.Contains(page, "<th>AnonymousDeviceID</th><th>System time</th>") {
+		t.Error("no instance table for the group shared by 2 devices")
+	}
+
+	// The crash lines are escaped, only the page's own script is left
+	for _, raw := range []string{"<script>alert(1)", "<img src=x"} {
+		if strings.Contains(page, raw) {
+			t.Errorf("the page contains the unescaped %q", raw)
+		}
+	}
+	if !strings.Contains(page, "&lt;script&gt;alert(1)&lt;/script&gt;") || !strings.Contains(page, "&lt;img src=x onerror=alert(2)&gt;") {
+		t.Error("the hostile crash lines aren't shown escaped")
+	}
+	if n := strings.Count(page, "<script>"); n != 1 {
+		t.Errorf("got %d script elements, want the page's own only", n)
+	}
+}
@@ -0,0 +1,109 @@
+package htmlreport
+
+import "html/template"
+
+// The page template, everything is inlined so the file works offline
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; margin: 24px; color: #222; }
+h1 { margin-bottom: 4px; }
+.generated { color: #808080; margin-bottom: 16px; }
+#search { width: 100%; max-width: 480px; padding: 6px 8px; margin-bottom: 16px; font-size: 14px; }
+table { border-collapse: collapse; margin: 8px 0 20px; font-size: 13px; }
+th, td { border: 1px solid #d0d0d0; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #d9d9d9; cursor: pointer; user-select: none; white-space: nowrap; }
+th.asc::after { content: " \25B2"; }
+th.desc::after { content: " \25BC"; }
+table.kv th { cursor: default; }
+details { border: 1px solid #d0d0d0; border-radius: 4px; margin: 8px 0; padding: 4px 12px; }
+summary { cursor: pointer; padding: 4px 0; }
+summary .reason { color: #c00000; font-weight: bold; }
+summary .meta { color: #555; }
+pre { background: #fafafa; border: 1px solid #eee; padding: 8px; overflow-x: auto; font-size: 12px; line-height: 1.4; }
+pre span { display: block; }
+.headline { color: #c00000; font-weight: bold; }
+.trace { color: #1f4e79; background: #ddebf7; }
+.timestamp { color: #808080; }
+.hidden { display: none; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div class="generated">Generated {{.Generated}}</div>
+<input id="search" type="search" placeholder="Search devices, reasons, fingerprints, log lines...">
+
+<h2>Summary</h2>
+{{range .Summary}}{{template "block" .}}{{end}}
+
+<h2>Crash groups</h2>
+{{range .Groups}}
+<details id="{{.Anchor}}" class="searchable">
+<summary><span class="reason">{{.Reason}}</span> <span class="meta">{{.Sheet}} &middot; {{.Fingerprint}} &middot; {{.Owner}} &middot; {{.Crashes}} crashes &middot; {{.Devices}} devices{{if .Suppressed}} &middot; {{.Suppressed}} suppressed{{end}}</span></summary>
+{{with .Instances}}{{template "block" .}}{{end}}
+{{range .Written}}
+<table class="kv">{{range .Metadata}}<tr><th>{{(index . 0).Text}}</th><td>{{(index . 1).Text}}</td></tr>{{end}}</table>
+<pre>{{range .Lines}}<span{{if .Class}} class="{{.Class}}"{{end}}>{{.Text}}</span>{{end}}</pre>
+{{end}}
+</details>
+{{end}}
+
+{{range .Sections}}
+<h2>{{.Title}}</h2>
+{{template "block" .Table}}
+{{end}}
+
+<script>
+(function () {
+  // Sort a table by the clicked column, numbers compare as numbers
+  document.querySelectorAll("table.sortable th").forEach(function (th) {
+    th.addEventListener("click", function () {
+      var table = th.closest("table");
+      var body = table.tBodies[0];
+      var index = Array.prototype.indexOf.call(th.parentNode.children, th);
+      var asc = !th.classList.contains("asc");
+      table.querySelectorAll("th").forEach(function (other) { other.classList.remove("asc", "desc"); });
+      th.classList.add(asc ? "asc" : "desc");
+      var rows = Array.prototype.slice.call(body.rows);
+      rows.sort(function (a, b) {
+        var x = a.cells[index] ? a.cells[index].textContent : "";
+        var y = b.cells[index] ? b.cells[index].textContent : "";
+        var nx = parseFloat(x), ny = parseFloat(y);
+        var cmp = (!isNaN(nx) && !isNaN(ny) && String(nx) === x.trim() && String(ny) === y.trim()) ? nx - ny : x.localeCompare(y);
+        return asc ? cmp : -cmp;
+      });
+      rows.forEach(function (row) { body.appendChild(row); });
+    });
+  });
+
+  // Hide the table rows and crash groups not matching the search
+  document.getElementById("search").addEventListener("input", function (event) {
+    var query = event.target.value.toLowerCase();
+    document.querySelectorAll("table.sortable tbody tr, details.searchable").forEach(function (el) {
+      var match = !query || el.textContent.toLowerCase().indexOf(query) >= 0;
+      el.classList.toggle("hidden", !match);
+      if (match && query && el.tagName === "DETAILS") { el.open = true; }
+    });
+  });
+
+  // Open the group a summary link points to
+  function openHash() {
+    var el = document.getElementById(location.hash.slice(1));
+    if (el && el.tagName === "DETAILS") { el.open = true; }
+  }
+  window.addEventListener("hashchange", openHash);
+  openHash();
+})();
+</script>
+</body>
+</html>
+{{define "block"}}{{if .Table}}<table class="sortable">
+<thead><tr>{{range .Header}}<th>{{.Text}}</th>{{end}}</tr></thead>
+<tbody>{{range .Rows}}<tr>{{range .}}<td>{{if .Link}}<a href="#{{.Link}}">{{.Text}}</a>{{else}}{{.Text}}{{end}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>{{else}}<table class="kv">{{range .Rows}}<tr>{{range $i, $cell := .}}{{if eq $i 0}}<th>{{$cell.Text}}</th>{{else}}<td>{{$cell.Text}}</td>{{end}}{{end}}</tr>{{end}}</table>{{end}}{{end}}
+`))
@@ -0,0 +1,290 @@
+package installbase
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/ownership"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Record is the active device count of one model and version, optionally for a single day
+type Record struct {
+	Date    string `json:"date"`
+	Model   string `json:"model"`
+	Version string `json:"version"`
+	Devices int    `json:"devices"`
+}
+
+type InstallBase struct {
+	records []Record
+}
+
+// Rate is the crash rate of one signature on one model and version
+type Rate struct {
+	Model            string  `json:"model"`
+	Version          string  `json:"version"`
+	Fingerprint      string  `json:"fingerprint"`
+	Reason           string  `json:"reason"`
+	Owner            string  `json:"owner"`
+	Crashes          int     `json:"crashes"`
+	Devices          int     `json:"devices"`
+	InstalledDevices int     `json:"installed_devices"`
+	CrashesPer1k     float64 `json:"crashes_per_1k"`
+	DevicesPer1k     float64 `json:"devices_per_1k"`
+}
+
+// Load reads the install-base file, the format is picked by the file extension.
+//
+// CSV: a header row with the columns model,version,devices and an optional date column
+// JSON: an array of {"date": "2023_06_15", "model": "UDMPRO", "version": "3.1.9", "devices": 1000}
+func Load(path string) (*InstallBase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open install-base file: %s", err)
+	}
+	defer f.Close()
+
+	var records []Record
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.NewDecoder(f).Decode(&records)
+	case ".csv":
+		records, err = readCSV(f)
+	default:
+		return nil, fmt.Errorf("unsupported install-base file: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse install-base file: %s", err)
+	}
+
+	for i := range records {
+		records[i].Date = normalizeDate(records[i].Date)
+		records[i].Version = crashlogutil.NormalizeVersion(records[i].Version)
+	}
+
+	return &InstallBase{records: records}, nil
+}
+
+func readCSV(r io.Reader) ([]Record, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("missing header row")
+	}
+
+	// Map the header columns, so the column order doesn't matter
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"model", "version", "devices"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column: %s", name)
+		}
+	}
+
+	records := make([]Record, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		devices, err := strconv.Atoi(strings.TrimSpace(row[columns["devices"]]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid device count in row %d: %s", i+2, err)
+		}
+		record := Record{
+			Model:   strings.TrimSpace(row[columns["model"]]),
+			Version: strings.TrimSpace(row[columns["version"]]),
+			Devices: devices,
+		}
+		if index, ok := columns["date"]; ok {
+			record.Date = strings.TrimSpace(row[index])
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// Both 2023_06_15 and 2023-06-15 are accepted
+func normalizeDate(date string) string {
+	return strings.ReplaceAll(strings.TrimSpace(date), "-", "_")
+}
+
+// Lookup returns the active device count of the model and version on the
+// date. A record of the same day wins, then the latest earlier day, then a
+// record without a date. It returns 0 if the install base has no record.
+func (b *InstallBase) Lookup(model, version, date string) int {
+	version = crashlogutil.NormalizeVersion(version)
+	date = normalizeDate(date)
+
+	devices := 0
+	bestDate := ""
+	for _, record := range b.records {
+		if !strings.EqualFold(record.Model, model) || record.Version != version {
+			continue
+		}
+		switch {
+		case record.Date == "":
+			if bestDate == "" {
+				devices = record.Devices
+			}
+		case date == "" || record.Date <= date:
+			if record.Date >= bestDate {
+				bestDate = record.Date
+				devices = record.Devices
+			}
+		}
+	}
+	return devices
+}
+
+// ModelDevices returns the active device count of the model on the date,
+// summed over every version of the install base, see Lookup
+func (b *InstallBase) ModelDevices(model, date string) int {
+	seen := make(map[string]bool)
+	devices := 0
+	for _, record := range b.records {
+		if !strings.EqualFold(record.Model, model) || seen[record.Version] {
+			continue
+		}
+		seen[record.Version] = true
+		devices += b.Lookup(model, record.Version, date)
+	}
+	return devices
+}
+
+// rateKey is what the crashes are counted by, an empty field aggregates over it
+type rateKey struct {
+	model, version, fingerprint string
+}
+
+// ComputeRates counts crashes and distinct crashing devices per model,
+// version and signature, and normalizes them against the install base
+func ComputeRates(data []crashlog.CrashLog, base *InstallBase, owners *ownership.Owners) []Rate {
+	fingerprints := make(crashlogutil.FingerprintCache)
+	return computeRates(data, base, owners, func(log crashlog.CrashLog) rateKey {
+		return rateKey{
+			model:       log.Model,
+			version:     crashlogutil.NormalizeVersion(log.Version),
+			fingerprint: fingerprints.Fingerprint(log.CrashLog),
+		}
+	})
+}
+
+// ComputeBreakdown returns the rates of every signature together, per model
+// over all its versions first, then per model and version
+func ComputeBreakdown(data []crashlog.CrashLog, base *InstallBase) []Rate {
+	perModel := computeRates(data, base, nil, func(log crashlog.CrashLog) rateKey {
+		return rateKey{model: log.Model}
+	})
+	perVersion := computeRates(data, base, nil, func(log crashlog.CrashLog) rateKey {
+		return rateKey{model: log.Model, version: crashlogutil.NormalizeVersion(log.Version)}
+	})
+	return append(perModel, perVersion...)
+}
+
+func computeRates(data []crashlog.CrashLog, base *InstallBase, owners *ownership.Owners, keyOf func(crashlog.CrashLog) rateKey) []Rate {
+	rates := make(map[rateKey]*Rate)
+	devices := make(map[rateKey]map[string]bool)
+	dates := make(map[rateKey]string)
+	for _, log := range data {
+		k := keyOf(log)
+		rate, ok := rates[k]
+		if !ok {
+			rate = &Rate{
+				Model:       k.model,
+				Version:     k.version,
+				Fingerprint: k.fingerprint,
+			}
+			// Only a single signature has a reason and an owner
+			if k.fingerprint != "" {
+				rate.Reason = crashlogutil.Reason(log.CrashLog)
+				rate.Owner = ownership.Attribute(log.CrashLog, owners).Owner
+			}
+			rates[k] = rate
+			devices[k] = make(map[string]bool)
+		}
+		rate.Crashes++
+		devices[k][log.AnonymousDeviceID] = true
+
+		// Normalize against the install base of the latest crash day
+		if day := log.SystemTime.Format("2006_01_02"); day > dates[k] {
+			dates[k] = day
+		}
+	}
+
+	result := make([]Rate, 0, len(rates))
+	for k, rate := range rates {
+		rate.Devices = len(devices[k])
+		if base != nil {
+			if rate.Version == "" {
+				rate.InstalledDevices = base.ModelDevices(rate.Model, dates[k])
+			} else {
+				rate.InstalledDevices = base.Lookup(rate.Model, rate.Version, dates[k])
+			}
+		}
+		if rate.InstalledDevices > 0 {
+			rate.CrashesPer1k = float64(rate.Crashes) * 1000 / float64(rate.InstalledDevices)
+			rate.DevicesPer1k = float64(rate.Devices) * 1000 / float64(rate.InstalledDevices)
+		}
+		result = append(result, *rate)
+	}
+
+	// Highest rate first, raw counts break the ties
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].DevicesPer1k != result[j].DevicesPer1k {
+			return result[i].DevicesPer1k > result[j].DevicesPer1k
+		}
+		if result[i].Crashes != result[j].Crashes {
+			return result[i].Crashes > result[j].Crashes
+		}
+		if result[i].Model != result[j].Model {
+			return result[i].Model < result[j].Model
+		}
+		if result[i].Version != result[j].Version {
+			return result[i].Version < result[j].Version
+		}
+		return result[i].Fingerprint < result[j].Fingerprint
+	})
+
+	return result
+}
+
+// Table converts the rates into rows with a header, ready to be written into a sheet.
+// The rows of a breakdown read All versions and All signatures.
+func Table(rates []Rate) [][]interface{} {
+	rows := [][]interface{}{
+		{"Model", "Version", "Reason", "Fingerprint", "Owner", "Crashes", "Devices", "Installed devices", "Crashes per 1k", "Devices per 1k"},
+	}
+	for _, rate := range rates {
+		version, reason, fingerprint, owner := rate.Version, rate.Reason, rate.Fingerprint, rate.Owner
+		if version == "" {
+			version = "All versions"
+		}
+		if fingerprint == "" {
+			reason, fingerprint, owner = "All signatures", "-", "-"
+		}
+		row := []interface{}{rate.Model, version, reason, fingerprint, owner, rate.Crashes, rate.Devices}
+		if rate.InstalledDevices > 0 {
+			row = append(row, rate.InstalledDevices, round(rate.CrashesPer1k), round(rate.DevicesPer1k))
+		} else {
+			row = append(row, "n/a", "n/a", "n/a")
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// round keeps 3 decimals, the rates stay numbers so the charts can plot them
+func round(rate float64) float64 {
+	return math.Round(rate*1000) / 1000
+}
@@ -0,0 +1,182 @@
+package installbase
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+		want                []Record
+		wantErr             bool
+	}{
+		{
+			name:    "csv, columns in any order",
+			file:    "base.csv",
+			content: "devices,model,version,date\n1000,UDMPRO,v3.1.9,2023-06-15\n",
+			want:    []Record{{Date: "2023_06_15", Model: "UDMPRO", Version: "3.1.9", Devices: 1000}},
+		},
+		{
+			name:    "json",
+			file:    "base.json",
+			content: `[{"model": "UDR", "version": "3.0.18", "devices": 50}]`,
+			want:    []Record{{Model: "UDR", Version: "3.0.18", Devices: 50}},
+		},
+		{name: "csv missing column", file: "base.csv", content: "model,version\nUDR,3.0.18\n", wantErr: true},
+		{name: "csv invalid count", file: "base.csv", content: "model,version,devices\nUDR,3.0.18,many\n", wantErr: true},
+		{name: "unsupported extension", file: "base.txt", content: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := Load(writeFile(t, tt.file, tt.content))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Load succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(base.records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(base.records), len(tt.want))
+			}
+			for i, record := range base.records {
+				if record != tt.want[i] {
+					t.Errorf("record %d = %+v, want %+v", i, record, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	base := &InstallBase{records: []Record{
+		{Model: "UDMPRO", Version: "3.1.9", Devices: 100},
+		{Date: "2023_06_10", Model: "UDMPRO", Version: "3.1.9", Devices: 200},
+		{Date: "2023_06_14", Model: "UDMPRO", Version: "3.1.9", Devices: 300},
+		{Date: "2023_06_20", Model: "UDMPRO", Version: "3.1.9", Devices: 400},
+		{Model: "UDMPRO", Version: "3.2.7", Devices: 50},
+	}}
+
+	tests := []struct {
+		model, version, date string
+		want                 int
+	}{
+		{"UDMPRO", "v3.1.9", "2023_06_14", 300},
+		{"udmpro", "3.1.9", "2023-06-15", 300},
+		{"UDMPRO", "3.1.9", "2023_06_01", 100},
+		{"UDMPRO", "3.1.9", "2023_06_25", 400},
+		{"UDMPRO", "3.2.7", "2023_06_15", 50},
+		{"UDR", "3.1.9", "2023_06_15", 0},
+	}
+	for _, tt := range tests {
+		if got := base.Lookup(tt.model, tt.version, tt.date); got != tt.want {
+			t.Errorf("Lookup(%s, %s, %s) = %d, want %d", tt.model, tt.version, tt.date, got, tt.want)
+		}
+	}
+
+	if got := base.ModelDevices("UDMPRO", "2023_06_15"); got != 350 {
+		t.Errorf("ModelDevices = %d, want 350", got)
+	}
+}
+
+// crash returns a crash log of the device whose signature is the panic reason
+func crash(device, model, version, reason string) crashlog.CrashLog {
+	return crashlog.CrashLog{
+		AnonymousDeviceID: device,
+		Model:             model,
+		Version:           version,
+		SystemTime:        time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC),
+		CrashLog:          "<0>[  12.345678] Kernel panic - not syncing: " + reason,
+	}
+}
+
+func TestComputeRates(t *testing.T) {
+	base := &InstallBase{records: []Record{
+		{Model: "UDMPRO", Version: "3.1.9", Devices: 1000},
+		{Model: "UDMPRO", Version: "3.2.7", Devices: 1000},
+		{Model: "UDR", Version: "3.1.9", Devices: 500},
+	}}
+	data := []crashlog.CrashLog{
+		crash("a", "UDMPRO", "v3.1.9", "Fatal exception"),
+		crash("a", "UDMPRO", "v3.1.9", "Fatal exception"),
+		crash("b", "UDMPRO", "v3.1.9", "Fatal exception"),
+		crash("c", "UDMPRO", "v3.1.9", "Attempted to kill init!"),
+		crash("d", "UDMPRO", "v3.2.7", "Fatal exception"),
+		crash("e", "UDR", "v3.1.9", "Fatal exception"),
+	}
+
+	rates := ComputeRates(data, base, nil)
+	if len(rates) != 4 {
+		t.Fatalf("got %d rates, want 4", len(rates))
+	}
+	top := rates[0]
+	if top.Model != "UDMPRO" || top.Version != "3.1.9" || top.Reason != "not syncing: Fatal exception" || top.Crashes != 3 || top.Devices != 2 || top.InstalledDevices != 1000 {
+		t.Errorf("top rate = %+v", top)
+	}
+	if top.DevicesPer1k != 2 || top.CrashesPer1k != 3 {
+		t.Errorf("top rate per 1k = %v crashes, %v devices, want 3, 2", top.CrashesPer1k, top.DevicesPer1k)
+	}
+
+	type want struct {
+		crashes, devices, installed int
+	}
+	breakdown := make(map[string]want)
+	for _, rate := range ComputeBreakdown(data, base) {
+		if rate.Fingerprint != "" || rate.Reason != "" {
+			t.Errorf("breakdown rate %+v has a signature", rate)
+		}
+		breakdown[rate.Model+" "+rate.Version] = want{rate.Crashes, rate.Devices, rate.InstalledDevices}
+	}
+	wantBreakdown := map[string]want{
+		"UDMPRO ":      {5, 4, 2000},
+		"UDR ":         {1, 1, 500},
+		"UDMPRO 3.1.9": {4, 3, 1000},
+		"UDMPRO 3.2.7": {1, 1, 1000},
+		"UDR 3.1.9":    {1, 1, 500},
+	}
+	if len(breakdown) != len(wantBreakdown) {
+		t.Errorf("got %d breakdown rates, want %d", len(breakdown), len(wantBreakdown))
+	}
+	for key, w := range wantBreakdown {
+		if got := breakdown[key]; got != w {
+			t.Errorf("breakdown %q = %+v, want %+v", key, got, w)
+		}
+	}
+}
+
+func TestTable(t *testing.T) {
+	rows := Table([]Rate{
+		{Model: "UDR", Crashes: 1, Devices: 1},
+		{Model: "UDR", Version: "3.1.9", Fingerprint: "3f2a9c1be07d", Reason: "Fatal exception", Owner: "kernel", Crashes: 2, Devices: 1, InstalledDevices: 500, CrashesPer1k: 4, DevicesPer1k: 2},
+	})
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows, want 3", len(rows))
+	}
+	if got := rows[1][1].(string) + "/" + rows[1][2].(string) + "/" + rows[1][7].(string); got != "All versions/All signatures/n/a" {
+		t.Errorf("breakdown row = %v", rows[1])
+	}
+	if got := rows[2][8]; got != 4.0 {
+		t.Errorf("crashes per 1k = %v, want the number 4", got)
+	}
+	if !strings.EqualFold(rows[0][0].(string), "model") {
+		t.Errorf("header = %v", rows[0])
+	}
+}
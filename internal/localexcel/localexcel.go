@@ -1,110 +1,569 @@
 package localexcel
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"grafana-extract-go/internal/app/crashlog"
 	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/devicehistory"
+	"grafana-extract-go/internal/ownership"
+	"grafana-extract-go/internal/report"
+	"grafana-extract-go/internal/storage"
+	"grafana-extract-go/internal/uptime"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/xuri/excelize/v2"
 )
 
-func CreateExcel(data []crashlog.CrashLog, unique bool) error {
+func CreateExcel(data []crashlog.CrashLog, opts report.Options) error {
 	if len(data) == 0 {
 		return errors.New("data slice is empty")
 	}
+
+	// Name the file after the new crash logs, so a merge finds the same file again
+	fileName, err := opts.Output.Path(data, opts.Query, ".xlsx")
+	if err != nil {
+		return err
+	}
+
+	// Append the new crashes to the ones the existing workbook recorded
+	if opts.Output.Merge {
+		recorded, err := ReadRecords(fileName)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			log.Println("No workbook to merge into, creating", fileName)
+		case err != nil:
+			return err
+		default:
+			var added int
+			data, added = report.Merge(recorded, data)
+			log.Printf("Merging %d new crash logs into %s, %d recorded\n", added, fileName, len(recorded))
+		}
+	}
+
+	file, err := buildWorkbook(data, opts)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if dir := filepath.Dir(fileName); dir != "." {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create output directory: %s", err)
+		}
+	}
+
+	// Save the Excel file with the custom name
+	err = file.SaveAs(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to save Excel file: %s", err)
+	}
+
+	fmt.Println("Saved Excel file:", fileName)
+
+	return nil
+}
+
+// WriteExcel writes the workbook of the crash logs to w instead of a file,
+// ex: an HTTP download. Nothing is merged or saved, so no records are kept.
+func WriteExcel(w io.Writer, data []crashlog.CrashLog, opts report.Options) error {
+	if len(data) == 0 {
+		return errors.New("data slice is empty")
+	}
+	opts.Output.Merge = false
+
+	file, err := buildWorkbook(data, opts)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = file.Write(w)
+	if err != nil {
+		return fmt.Errorf("failed to write Excel file: %s", err)
+	}
+	return nil
+}
+
+// buildWorkbook lays out the summary, the crash group sheets and the analysis sheets of the crash logs
+func buildWorkbook(data []crashlog.CrashLog, opts report.Options) (*excelize.File, error) {
 	// Create a new Excel file
 	file := excelize.NewFile()
+	styles, err := newStyles(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create styles: %s", err)
+	}
+
+	// Keep every crash log in merge mode, so a later run can merge into this
+	// workbook. It comes first, hiding a sheet reads every other sheet back
+	// into memory.
+	if opts.Output.Merge {
+		err = writeRecords(file, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write records: %s", err)
+		}
+	}
+
+	// Group the crash logs by unique crash log, the dedup policy picks the written ones
+	groups := report.Groups(data, opts)
+
+	// Create sheets for each unique crash log, even if all its crash logs are suppressed.
+	// The workbook opens on the summary, setting another active sheet reads
+	// every streamed sheet back into memory.
+	for _, group := range groups {
+		_, err := file.NewSheet(group.Sheet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new sheet: %s", err)
+		}
+		err = writeCrashSheet(file, group, opts, styles)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write %s: %s", group.Sheet, err)
+		}
+	}
+
+	// Write the summary into Sheet1, linking every group to its sheet
+	summary := report.BuildSummary(data, groups, opts, time.Now())
+	err = writeRows(file, summarySheet, 1, 1, summary.Rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write summary: %s", err)
+	}
+	err = styleTable(file, summarySheet, summary.GroupHeader+1, summary.Rows, styles, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to style summary: %s", err)
+	}
+	for sheetName, i := range summary.GroupRows {
+		cell := fmt.Sprintf("A%d", i+1)
+		err = file.SetCellHyperLink(summarySheet, cell, fmt.Sprintf("'%s'!A1", sheetName), "Location")
+		if err != nil {
+			return nil, fmt.Errorf("failed to link %s: %s", sheetName, err)
+		}
+	}
+
+	// Write the crash history of every device into its own sheet
+	_, err = file.NewSheet("Devices")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new sheet: %s", err)
+	}
+	err = streamTable(file, "Devices", devicehistory.Table(devicehistory.Build(data, opts.Owners)), styles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write device history: %s", err)
+	}
+
+	// Write the uptime and load average distributions per signature
+	_, err = file.NewSheet("Uptime")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new sheet: %s", err)
+	}
+	uptimeRows := uptime.Table(uptime.Analyze(data, opts.Owners))
+	err = writeRows(file, "Uptime", 1, 1, uptimeRows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write uptime distribution: %s", err)
+	}
+	err = styleTable(file, "Uptime", 1, uptimeRows, styles, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to style uptime distribution: %s", err)
+	}
+
+	// Write the disk errors of the NVR and NAS models
+	if perModel := storage.PerModel(data); len(perModel) > 0 {
+		_, err = file.NewSheet("Storage")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new sheet: %s", err)
+		}
+		storageRows := storage.Table(perModel, storage.PerDevice(data))
+		err = writeRows(file, "Storage", 1, 1, storageRows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write storage errors: %s", err)
+		}
+		err = styleTable(file, "Storage", 1, storageRows, styles, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to style storage errors: %s", err)
+		}
+	}
+
+	// Draw the crash counts on their own sheet
+	err = writeCharts(file, report.BuildChartData(data), summary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write charts: %s", err)
+	}
 
-	// Extract unique crash logs
-	crashLogs := crashlogutil.ExtractUniqueCrashLogs(data)
+	return file, nil
+}
 
-	// Start from the five row in default Sheet1
-	sheet1row := 5
+// writeCrashSheet streams the crash logs of the group into its sheet, the
+// rows are written in order so only the current row is kept in memory
+func writeCrashSheet(file *excelize.File, group report.Group, opts report.Options, styles *styles) error {
+	sw, err := file.NewStreamWriter(group.Sheet)
+	if err != nil {
+		return err
+	}
 
-	// Create a map to store AnonymousDeviceID
-	processedIDs := make(map[string]bool)
+	// The widths and panes go before the rows, keep the header rows in view
+	err = sw.SetColWidth(1, 1, lineColWidth)
+	if err != nil {
+		return err
+	}
+	err = sw.SetColWidth(2, len(report.InstanceColumns), 24)
+	if err != nil {
+		return err
+	}
+	err = sw.SetPanes(&excelize.Panes{Freeze: true, YSplit: 3, TopLeftCell: "A4", ActivePane: "bottomLeft"})
+	if err != nil {
+		return err
+	}
 
-	// Create sheets for each unique crash log
-	for i, crashLog := range crashLogs {
-		sheetName := fmt.Sprintf("CrashLog%d", i+1)
-		index, err := file.NewSheet(sheetName)
+	row := 1
+	add := func(values []interface{}, opts ...excelize.RowOpts) error {
+		cell, err := excelize.CoordinatesToCellName(1, row)
 		if err != nil {
-			return fmt.Errorf("failed to create new sheet: %s", err)
+			return err
 		}
+		row++
+		return sw.SetRow(cell, values, opts...)
+	}
+	header := excelize.RowOpts{StyleID: styles.header}
 
-		// Populate the crash log data in the sheet
-		crashLogData := crashlogutil.FilterCrashLogByValue(data, crashLog)
-		// Start from the third row in indivudual crash sheet
-		row := 3 
+	strReason := "Reason: "
+	strTitle := "AnonymousDeviceID: "
+	attribution := ownership.Attribute(group.CrashLog, opts.Owners)
 
-		for _, log := range crashLogData {
-			if processedIDs[log.AnonymousDeviceID] && unique {
-				err := file.DeleteSheet(sheetName)
-				if err != nil {
-					return fmt.Errorf("failed to delete new sheet: %s", err)
-				}
-				continue
+	// Set the header column, and keep the count of the crash logs the dedup policy suppressed
+	reasonData := []interface{}{excelize.Cell{StyleID: styles.headline, Value: strReason + group.Reason}}
+	if group.Suppressed > 0 {
+		reasonData = append(reasonData, fmt.Sprintf("Suppressed: %d of %d by the %s policy", group.Suppressed, group.Crashes, opts.Dedup.Policy))
+	}
+	// Set the AnonymousDevice ID of the last written crash log,
+	deviceID := ""
+	if len(group.Written) > 0 {
+		deviceID = group.Written[len(group.Written)-1].AnonymousDeviceID
+	}
+	// Next to it record the full fingerprint, the sheet name may be shortened,
+	// then set the owner and the subsystem it is attributed to
+	for _, values := range [][]interface{}{
+		reasonData,
+		{strTitle + deviceID, "Fingerprint: " + group.Fingerprint},
+		{fmt.Sprintf("Owner: %s (%s)", attribution.Owner, attribution.Subsystem)},
+	} {
+		if err = add(values, header); err != nil {
+			return err
+		}
+	}
+
+	// List every crash instance when several devices share the crash log
+	if group.Devices > 1 {
+		for i, values := range report.Instances(group.Logs) {
+			var opts []excelize.RowOpts
+			if i == 0 {
+				opts = append(opts, header)
+			}
+			if err = add(values, opts...); err != nil {
+				return err
 			}
+		}
+		row++
+	}
+
+	for _, log := range group.Written {
+		// Describe the crash instance above its lines
+		for _, values := range report.Metadata(log) {
+			values[0] = excelize.Cell{StyleID: styles.header, Value: values[0]}
+			if err = add(values); err != nil {
+				return err
+			}
+		}
 
-			// Apply the regex pattern to the crash log
-			cleanLog := crashlogutil.ApplyRegex(log.CrashLog)
-
-			// Write each line of the cleaned crash log to the same column but different rows
-			lines := strings.Split(cleanLog, "\n")
-			// Identify kernel panic
-			kpType := crashlog.IdentifyKernelPanic(lines)
-			strReason := "Reason: "
-			strTitle := "AnonymousDeviceID: "
-			// Set the header column
-			file.SetCellValue(sheetName, "A1", strReason + kpType)
-			// Set the AnonymousDevice ID
-			file.SetCellValue(sheetName, "A2", strTitle + log.AnonymousDeviceID)
-			// calculate total AnonymousDevice ID
-			sheet1cell := fmt.Sprintf("A%d", sheet1row)
-			file.SetCellValue("Sheet1", sheet1cell, log.AnonymousDeviceID)
-			sheet1row++
-			// Take a record for handled AnonymousDeviceID
-			processedIDs[log.AnonymousDeviceID] = true
-			
-			// Reverse the order of lines
-			for j := len(lines) - 1; j >= 0; j-- {
-				line := lines[j]
-				if line != "" {
-					cell := fmt.Sprintf("A%d", row)
-					file.SetCellValue(sheetName, cell, line)
-					row++
-				}
+		// Write each line of the cleaned crash log in the order the kernel
+		// printed them, styled by its class
+		lines := crashlogutil.PrintedLines(log.CrashLog)
+		classes := crashlogutil.ClassifyLines(lines)
+		for i, line := range lines {
+			if err = add([]interface{}{excelize.Cell{StyleID: styles.line(classes[i]), Value: line}}); err != nil {
+				return err
 			}
 		}
+		// Keep a blank row between the crash instances
+		row++
+	}
+
+	return sw.Flush()
+}
+
+// streamTable streams the table into a new sheet from A1, the header row is
+// frozen and highlighted, and the rows can be filtered
+func streamTable(file *excelize.File, sheetName string, rows [][]interface{}, styles *styles) error {
+	sw, err := file.NewStreamWriter(sheetName)
+	if err != nil {
+		return err
+	}
+	for i, width := range colWidths(rows) {
+		err = sw.SetColWidth(i+1, i+1, width)
+		if err != nil {
+			return err
+		}
+	}
+	err = sw.SetPanes(&excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"})
+	if err != nil {
+		return err
+	}
 
-		// Set the active sheet
-		file.SetActiveSheet(index)
+	for i, values := range rows {
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return err
+		}
+		var opts []excelize.RowOpts
+		if i == 0 {
+			opts = append(opts, excelize.RowOpts{StyleID: styles.header})
+		}
+		err = sw.SetRow(cell, values, opts...)
+		if err != nil {
+			return err
+		}
+	}
 
+	// A table filters its rows, it needs a data row besides the header
+	if len(rows) > 1 && len(rows[0]) > 0 {
+		last, err := excelize.CoordinatesToCellName(len(rows[0]), len(rows))
+		if err != nil {
+			return err
+		}
+		err = sw.AddTable(&excelize.Table{Range: "A1:" + last, Name: sheetName, StyleName: "TableStyleLight1"})
+		if err != nil {
+			return err
+		}
 	}
 
-	// Extract the year and date from the first crash log entry
-	firstLogSystemTime := data[0].SystemTime
-	yearDate := firstLogSystemTime.Format("2006-01-02")
+	return sw.Flush()
+}
+
+// The summary sheet, the sheet a new workbook starts with
+const summarySheet = "Sheet1"
+
+// The sheet of the charts, the chart data that isn't on the summary is
+// written into its first two columns and the charts are anchored next to it
+const chartsSheet = "Charts"
+
+// The rows between the top left cells of two charts, a chart is 290px high
+const chartRows = 18
 
-	// Extract the version number from crashLog.Version
-	version, err := crashlogutil.ExtractVersion(data[0].Version)
+// chart is a chart of one series, the references are absolute cell ranges
+type chart struct {
+	title                    string
+	chartType                excelize.ChartType
+	name, categories, values string
+}
+
+// cellRange returns the reference of the rows of a column, rows are 1-based.
+// The sheet name is not quoted, the summary and charts sheets don't need it.
+func cellRange(sheet, col string, first, last int) string {
+	return fmt.Sprintf("%s!$%s$%d:$%s$%d", sheet, col, first, col, last)
+}
+
+// writeCharts draws the signature and rate charts from the group and rate
+// tables of the summary, and the other charts from the chart data it writes
+// into the charts sheet
+func writeCharts(file *excelize.File, charts report.ChartData, summary report.Summary) error {
+	_, err := file.NewSheet(chartsSheet)
 	if err != nil {
-		return fmt.Errorf("failed to extract version: %s", err)
+		return err
 	}
 
-	fmt.Println("Extracted version:", version)
+	var drawn []chart
 
-	// Generate the file name
-	fileName := fmt.Sprintf("CrashLogs-%s-%s-%s.xlsx", data[0].Model, version, yearDate)
+	// The signatures with the most crashes, the group table is sorted by
+	// crashes. Column A is the sheet of the group and E its crashes.
+	if signatures := min(len(summary.GroupRows), report.ChartSignatures); signatures > 0 {
+		header := summary.GroupHeader + 1
+		drawn = append(drawn, chart{
+			title:      "Crashes per signature",
+			chartType:  excelize.Bar,
+			name:       cellRange(summarySheet, "E", header, header),
+			categories: cellRange(summarySheet, "A", header+1, header+signatures),
+			values:     cellRange(summarySheet, "E", header+1, header+signatures),
+		})
+	}
 
-	// Save the Excel file with the custom name
-	err = file.SaveAs(fileName)
+	// The highest rates per signature. Column D is the fingerprint and I the crashes per 1k devices.
+	if rates := min(summary.RateRows, report.ChartSignatures); rates > 0 {
+		header := summary.RateHeader + 1
+		drawn = append(drawn, chart{
+			title:      "Crashes per 1k devices per signature",
+			chartType:  excelize.Bar,
+			name:       cellRange(summarySheet, "I", header, header),
+			categories: cellRange(summarySheet, "D", header+1, header+rates),
+			values:     cellRange(summarySheet, "I", header+1, header+rates),
+		})
+	}
+
+	tables := []struct {
+		title  string
+		header string
+		counts []report.Count
+		chart  excelize.ChartType
+	}{
+		{"Crashes per day", "Day", charts.Days, excelize.Line},
+		{"Crashes per uptime", "Uptime", charts.Uptime, excelize.Col},
+		{"Crashes per " + strings.ToLower(charts.ShareBy), charts.ShareBy, charts.Share, excelize.Pie},
+	}
+
+	row := 1
+	for _, table := range tables {
+		if len(table.counts) == 0 {
+			continue
+		}
+
+		// Write the table, the header row names the series
+		rows := [][]interface{}{{table.header, "Crashes"}}
+		for _, count := range table.counts {
+			rows = append(rows, []interface{}{count.Label, count.Crashes})
+		}
+		err = writeRows(file, chartsSheet, 1, row, rows)
+		if err != nil {
+			return err
+		}
+
+		first, last := row+1, row+len(table.counts)
+		drawn = append(drawn, chart{
+			title:      table.title,
+			chartType:  table.chart,
+			name:       cellRange(chartsSheet, "B", row, row),
+			categories: cellRange(chartsSheet, "A", first, last),
+			values:     cellRange(chartsSheet, "B", first, last),
+		})
+		row = last + 2
+	}
+
+	for i, c := range drawn {
+		chart := &excelize.Chart{
+			Type: c.chartType,
+			Series: []excelize.ChartSeries{{
+				Name:       c.name,
+				Categories: c.categories,
+				Values:     c.values,
+			}},
+			Title:     excelize.ChartTitle{Name: c.title},
+			Legend:    excelize.ChartLegend{Position: "none"},
+			Dimension: excelize.ChartDimension{Width: 640, Height: 290},
+		}
+		if c.chartType == excelize.Pie {
+			chart.Legend.Position = "right"
+			chart.PlotArea.ShowPercent = true
+		}
+		err = file.AddChart(chartsSheet, fmt.Sprintf("D%d", 1+i*chartRows), chart)
+		if err != nil {
+			return err
+		}
+	}
+
+	return file.SetColWidth(chartsSheet, "A", "A", 60)
+}
+
+// min returns the smaller of a and b
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// The hidden sheet holding every crash log of the workbook as JSON, one per row
+const recordsSheet = "Records"
+
+// The JSON of a crash log is split into cells of this length, a cell holds
+// at most 32767 characters
+const recordCellLength = 32000
+
+// writeRecords writes the crash logs into the hidden records sheet
+func writeRecords(file *excelize.File, data []crashlog.CrashLog) error {
+	_, err := file.NewSheet(recordsSheet)
 	if err != nil {
-		return fmt.Errorf("failed to save Excel file: %s", err)
+		return err
 	}
 
+	// Hide the sheet before streaming, a flushed sheet can't be changed
+	err = file.SetSheetVisible(recordsSheet, false)
+	if err != nil {
+		return err
+	}
+	sw, err := file.NewStreamWriter(recordsSheet)
+	if err != nil {
+		return err
+	}
+	for i, log := range data {
+		record, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		var row []interface{}
+		for len(record) > recordCellLength {
+			row = append(row, string(record[:recordCellLength]))
+			record = record[recordCellLength:]
+		}
+		row = append(row, string(record))
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return err
+		}
+		err = sw.SetRow(cell, row)
+		if err != nil {
+			return err
+		}
+	}
+	return sw.Flush()
+}
+
+// ReadRecords reads the crash logs recorded in the workbook. The error wraps
+// os.ErrNotExist if the workbook doesn't exist.
+func ReadRecords(fileName string) ([]crashlog.CrashLog, error) {
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, err
+	}
+	file, err := excelize.OpenFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Excel file: %s", err)
+	}
+	defer file.Close()
+
+	if index, _ := file.GetSheetIndex(recordsSheet); index < 0 {
+		return nil, fmt.Errorf("no %s sheet in %s, it can't be merged into", recordsSheet, fileName)
+	}
+	rows, err := file.GetRows(recordsSheet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read records: %s", err)
+	}
+
+	data := make([]crashlog.CrashLog, 0, len(rows))
+	for i, row := range rows {
+		var log crashlog.CrashLog
+		err = json.Unmarshal([]byte(strings.Join(row, "")), &log)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record in row %d: %s", i+1, err)
+		}
+		data = append(data, log)
+	}
+	return data, nil
+}
+
+// writeRows writes the rows into the sheet, starting from the cell at col and row
+func writeRows(file *excelize.File, sheetName string, col, row int, rows [][]interface{}) error {
+	for i, values := range rows {
+		cell, err := excelize.CoordinatesToCellName(col, row+i)
+		if err != nil {
+			return err
+		}
+		values := values
+		err = file.SetSheetRow(sheetName, cell, &values)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,384 @@
+package localexcel
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/devicehistory"
+	"grafana-extract-go/internal/ownership"
+	"grafana-extract-go/internal/report"
+	"grafana-extract-go/internal/storage"
+	"grafana-extract-go/internal/uptime"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// The call trace symbols of the synthetic crash logs
+var symbols = []string{"blk_update_request", "scsi_io_completion", "ext4_writepages", "skb_copy_bits", "dev_hard_start_xmit", "nf_hook_slow", "mmc_blk_rw_rq_prep", "ubifs_tnc_lookup"}
+
+// corpus returns crashes of the signatures spread over the devices and a
+// week, the crash log of each crash differs by its timestamps and addresses
+func corpus(crashes, signatures, devices int) []crashlog.CrashLog {
+	start := time.Date(2023, 6, 12, 0, 0, 0, 0, time.UTC)
+	data := make([]crashlog.CrashLog, 0, crashes)
+	for i := 0; i < crashes; i++ {
+		signature := i % signatures
+		ts := 100 + i%500
+
+		// The kernel prints the trace first, the crash log keeps the latest line first
+		var lines []string
+		lines = append(lines, fmt.Sprintf("<0>[%5d.000100] Kernel panic - not syncing: Fatal exception in %s", ts, symbols[signature%len(symbols)]))
+		lines = append(lines, fmt.Sprintf("<4>[%5d.000090] ---[ end trace %016x ]---", ts, i))
+		for frame := 7; frame >= 0; frame-- {
+			lines = append(lines, fmt.Sprintf("<4>[%5d.%06d]  %s+0x%x/0x400", ts, 80-frame, symbols[(signature+frame)%len(symbols)], frame*16+i%4))
+		}
+		lines = append(lines, fmt.Sprintf("<4>[%5d.000070] Call trace:", ts))
+		lines = append(lines, fmt.Sprintf("<4>[%5d.000060] pc : %s+0x%x/0x400", ts, symbols[signature%len(symbols)], 0x10+i%4))
+		for pad := 0; pad < 30; pad++ {
+			lines = append(lines, fmt.Sprintf("<6>[%5d.%06d] x%d : %016x x%d : %016x", ts, 50-pad, pad*2, signature*pad+i, pad*2+1, pad))
+		}
+
+		data = append(data, crashlog.CrashLog{
+			Type:              "kernel_crash",
+			SystemTime:        start.Add(time.Duration(i) * 7 * 24 * time.Hour / time.Duration(crashes)),
+			AnonymousDeviceID: fmt.Sprintf("device-%05d", i%devices),
+			Model:             "UNVR",
+			Version:           "v3.1.9",
+			BomRev:            fmt.Sprintf("%d", 113+i%3),
+			ProductLine:       "protect",
+			Uptime:            60 + (i*7919)%200000,
+			KernelVersion:     "4.19.152-al-linux-v10.2.0",
+			LoadAverage:       "1.52 1.23 0.98",
+			CrashLog:          strings.Join(lines, ""),
+		})
+	}
+	return data
+}
+
+func sheets(t *testing.T, data []byte) map[string]bool {
+	t.Helper()
+	file, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	names := make(map[string]bool)
+	for _, name := range file.GetSheetList() {
+		names[name] = true
+	}
+	return names
+}
+
+func TestWriteExcelRecords(t *testing.T) {
+	data := corpus(20, 3, 5)
+	for _, merge := range []bool{false, true} {
+		var buf bytes.Buffer
+		err := WriteExcel(&buf, data, report.Options{Output: report.Output{Merge: merge}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := sheets(t, buf.Bytes())
+		if names[recordsSheet] {
+			t.Errorf("merge %v: the download has a %s sheet", merge, recordsSheet)
+		}
+		// Sheet1 and a sheet per signature at least
+		if !names["Sheet1"] || len(names) < 4 {
+			t.Errorf("merge %v: sheets = %v", merge, names)
+		}
+	}
+}
+
+func TestCreateExcelMerge(t *testing.T) {
+	dir := t.TempDir()
+	data := corpus(20, 3, 5)
+	opts := report.Options{Output: report.Output{Dir: dir, FileName: "week", Merge: true}}
+
+	// Without -merge the workbook keeps no records to merge into
+	err := CreateExcel(data[:10], report.Options{Output: report.Output{Dir: dir, FileName: "plain"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadRecords(dir + "/plain.xlsx")
+	if err == nil || !strings.Contains(err.Error(), "can't be merged into") {
+		t.Errorf("ReadRecords of a plain workbook = %v", err)
+	}
+
+	err = CreateExcel(data[:10], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second run fetches half of the crashes again
+	err = CreateExcel(data[5:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := ReadRecords(dir + "/week.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != len(data) {
+		t.Errorf("recorded %d crash logs, want %d", len(recorded), len(data))
+	}
+}
+
+// chartRefs returns the references of the charts of the workbook, chart by chart
+func chartRefs(t *testing.T, file *excelize.File) [][]string {
+	t.Helper()
+	buf, err := file.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs [][]string
+	for i := 1; ; i++ {
+		f, err := r.Open(fmt.Sprintf("xl/charts/chart%d.xml", i))
+		if err != nil {
+			return refs
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var chart []string
+		for _, part := range strings.Split(string(content), "<f>")[1:] {
+			chart = append(chart, part[:strings.Index(part, "</f>")])
+		}
+		refs = append(refs, chart)
+	}
+}
+
+func TestWriteCharts(t *testing.T) {
+	groups := func(n int) map[string]int {
+		rows := make(map[string]int)
+		for i := 0; i < n; i++ {
+			rows[fmt.Sprintf("group %d", i)] = 20 + i
+		}
+		return rows
+	}
+	charts := report.ChartData{
+		Days:    []report.Count{{Label: "2023-06-15", Crashes: 3}},
+		Uptime:  []report.Count{{Label: "< 5m", Crashes: 3}},
+		ShareBy: "Kernel version",
+		Share:   []report.Count{{Label: "5.4.0", Crashes: 3}},
+	}
+
+	tests := []struct {
+		name    string
+		summary report.Summary
+		want    [][]string
+	}{
+		{
+			name:    "groups",
+			summary: report.Summary{GroupHeader: 19, GroupRows: groups(3)},
+			want: [][]string{
+				{"Sheet1!$E$20:$E$20", "Sheet1!$A$21:$A$23", "Sheet1!$E$21:$E$23"},
+				{"Charts!$B$1:$B$1", "Charts!$A$2:$A$2", "Charts!$B$2:$B$2"},
+				{"Charts!$B$4:$B$4", "Charts!$A$5:$A$5", "Charts!$B$5:$B$5"},
+				{"Charts!$B$7:$B$7", "Charts!$A$8:$A$8", "Charts!$B$8:$B$8"},
+			},
+		},
+		{
+			name:    "top signatures and rates",
+			summary: report.Summary{GroupHeader: 19, GroupRows: groups(20), RateHeader: 45, RateRows: 30},
+			want: [][]string{
+				{"Sheet1!$E$20:$E$20", "Sheet1!$A$21:$A$35", "Sheet1!$E$21:$E$35"},
+				{"Sheet1!$I$46:$I$46", "Sheet1!$D$47:$D$61", "Sheet1!$I$47:$I$61"},
+				{"Charts!$B$1:$B$1", "Charts!$A$2:$A$2", "Charts!$B$2:$B$2"},
+				{"Charts!$B$4:$B$4", "Charts!$A$5:$A$5", "Charts!$B$5:$B$5"},
+				{"Charts!$B$7:$B$7", "Charts!$A$8:$A$8", "Charts!$B$8:$B$8"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := excelize.NewFile()
+			defer file.Close()
+			err := writeCharts(file, charts, tt.summary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := chartRefs(t, file)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("chart references =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The signature chart draws the group rows of the summary
+func TestWriteExcelSignatureChart(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteExcel(&buf, corpus(20, 3, 5), report.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := excelize.OpenReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	signature := chartRefs(t, file)[0]
+	var first, last int
+	_, err = fmt.Sscanf(signature[2], "Sheet1!$E$%d:$E$%d", &first, &last)
+	if err != nil {
+		t.Fatalf("values %q: %s", signature[2], err)
+	}
+	if header, _ := file.GetCellValue("Sheet1", fmt.Sprintf("E%d", first-1)); header != "Crashes" || last-first != 2 {
+		t.Errorf("the values %s aren't the crashes of the 3 groups, header %q", signature[2], header)
+	}
+	if sheet, _ := file.GetCellValue("Sheet1", fmt.Sprintf("A%d", first)); !sheets(t, buf.Bytes())[sheet] {
+		t.Errorf("category %q isn't a group sheet", sheet)
+	}
+}
+
+// The corpus sizes of the writer benchmarks
+var benchCrashes = []int{1000, 5000, 10000}
+
+func BenchmarkCreateExcel(b *testing.B) {
+	benchmarkWriter(b, CreateExcel)
+}
+
+// BenchmarkCreateExcelInMemory runs the writer before the workbook was
+// streamed, to compare both
+func BenchmarkCreateExcelInMemory(b *testing.B) {
+	benchmarkWriter(b, createInMemory)
+}
+
+func benchmarkWriter(b *testing.B, create func([]crashlog.CrashLog, report.Options) error) {
+	for _, n := range benchCrashes {
+		data := corpus(n, 50, n/5)
+		opts := report.Options{
+			Dedup:  report.Dedup{Policy: report.DedupNone},
+			Output: report.Output{Dir: b.TempDir(), FileName: "bench"},
+		}
+		b.Run(fmt.Sprintf("crashes=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := create(data, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// createInMemory writes the workbook the way CreateExcel did before it
+// streamed: the whole workbook is built in memory, the crash sheets with a
+// SetCellValue call per cell
+func createInMemory(data []crashlog.CrashLog, opts report.Options) error {
+	fileName, err := opts.Output.Path(data, opts.Query, ".xlsx")
+	if err != nil {
+		return err
+	}
+	file := excelize.NewFile()
+	defer file.Close()
+
+	groups := report.Groups(data, opts)
+	for _, group := range groups {
+		sheetName := group.Sheet
+		index, err := file.NewSheet(sheetName)
+		if err != nil {
+			return err
+		}
+		attribution := ownership.Attribute(group.CrashLog, opts.Owners)
+		file.SetCellValue(sheetName, "A1", "Reason: "+group.Reason)
+		file.SetCellValue(sheetName, "B2", "Fingerprint: "+group.Fingerprint)
+		file.SetCellValue(sheetName, "A3", fmt.Sprintf("Owner: %s (%s)", attribution.Owner, attribution.Subsystem))
+
+		row := 4
+		if group.Devices > 1 {
+			instances := report.Instances(group.Logs)
+			err = writeRows(file, sheetName, 1, row, instances)
+			if err != nil {
+				return err
+			}
+			row += len(instances) + 1
+		}
+		for _, log := range group.Written {
+			file.SetCellValue(sheetName, "A2", "AnonymousDeviceID: "+log.AnonymousDeviceID)
+			metadata := report.Metadata(log)
+			err = writeRows(file, sheetName, 1, row, metadata)
+			if err != nil {
+				return err
+			}
+			row += len(metadata)
+			for _, line := range crashlogutil.PrintedLines(log.CrashLog) {
+				file.SetCellValue(sheetName, fmt.Sprintf("A%d", row), line)
+				row++
+			}
+			row++
+		}
+		file.SetActiveSheet(index)
+	}
+
+	summary := report.BuildSummary(data, groups, opts, time.Now())
+	err = writeRows(file, summarySheet, 1, 1, summary.Rows)
+	if err != nil {
+		return err
+	}
+	for sheetName, i := range summary.GroupRows {
+		err = file.SetCellHyperLink(summarySheet, fmt.Sprintf("A%d", i+1), fmt.Sprintf("'%s'!A1", sheetName), "Location")
+		if err != nil {
+			return err
+		}
+	}
+	tables := []struct {
+		sheet string
+		rows  [][]interface{}
+	}{
+		{"Devices", devicehistory.Table(devicehistory.Build(data, opts.Owners))},
+		{"Uptime", uptime.Table(uptime.Analyze(data, opts.Owners))},
+		{"Storage", storage.Table(storage.PerModel(data), storage.PerDevice(data))},
+	}
+	for _, table := range tables {
+		_, err = file.NewSheet(table.sheet)
+		if err != nil {
+			return err
+		}
+		err = writeRows(file, table.sheet, 1, 1, table.rows)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeCharts(file, report.BuildChartData(data), summary)
+	if err != nil {
+		return err
+	}
+
+	// The records were always kept, written cell by cell too
+	records := make([][]interface{}, 0, len(data))
+	for _, log := range data {
+		record, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		records = append(records, []interface{}{string(record)})
+	}
+	_, err = file.NewSheet(recordsSheet)
+	if err != nil {
+		return err
+	}
+	err = writeRows(file, recordsSheet, 1, 1, records)
+	if err != nil {
+		return err
+	}
+	err = file.SetSheetVisible(recordsSheet, false)
+	if err != nil {
+		return err
+	}
+	return file.SaveAs(fileName)
+}
@@ -0,0 +1,155 @@
+package localexcel
+
+import (
+	"fmt"
+	"grafana-extract-go/internal/crashlogutil"
+	"unicode/utf8"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// The narrowest and widest column a table gets, in characters
+const (
+	minColWidth = 10
+	maxColWidth = 60
+)
+
+// The width of the crash log line column of a crash sheet
+const lineColWidth = 120
+
+// styles are the cell styles of a workbook
+type styles struct {
+	header    int
+	headline  int
+	trace     int
+	timestamp int
+}
+
+// newStyles adds the styles to the workbook
+func newStyles(file *excelize.File) (*styles, error) {
+	var s styles
+	var err error
+	if s.header, err = file.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Bold: true},
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"D9D9D9"}},
+	}); err != nil {
+		return nil, err
+	}
+	// The panic or BUG headline stands out the most
+	if s.headline, err = file.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Bold: true, Color: "C00000"},
+	}); err != nil {
+		return nil, err
+	}
+	if s.trace, err = file.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Color: "1F4E79"},
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"DDEBF7"}},
+	}); err != nil {
+		return nil, err
+	}
+	if s.timestamp, err = file.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Color: "808080"},
+	}); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// line returns the style of a crash log line, 0 is the default style
+func (s *styles) line(class crashlogutil.LineClass) int {
+	switch class {
+	case crashlogutil.HeadlineLine:
+		return s.headline
+	case crashlogutil.TraceLine:
+		return s.trace
+	case crashlogutil.TimestampLine:
+		return s.timestamp
+	default:
+		return 0
+	}
+}
+
+// colWidths returns the width of every column of the rows, fitting the longest value
+func colWidths(rows [][]interface{}) []float64 {
+	var widths []float64
+	for _, row := range rows {
+		for i, value := range row {
+			if i >= len(widths) {
+				widths = append(widths, minColWidth)
+			}
+			width := float64(utf8.RuneCountInString(fmt.Sprint(value)) + 2)
+			if width > maxColWidth {
+				width = maxColWidth
+			}
+			if width > widths[i] {
+				widths[i] = width
+			}
+		}
+	}
+	return widths
+}
+
+// styleTable styles a table written with writeRows: the header row at
+// headerRow is highlighted and filtered, the columns fit the rows, and the
+// rows above the header are frozen if freeze is set
+func styleTable(file *excelize.File, sheetName string, headerRow int, rows [][]interface{}, s *styles, freeze bool) error {
+	if headerRow < 1 || headerRow > len(rows) {
+		return nil
+	}
+	widths := colWidths(rows)
+	for i, width := range widths {
+		col, err := excelize.ColumnNumberToName(i + 1)
+		if err != nil {
+			return err
+		}
+		err = file.SetColWidth(sheetName, col, col, width)
+		if err != nil {
+			return err
+		}
+	}
+
+	header := rows[headerRow-1]
+	if len(header) == 0 {
+		return nil
+	}
+	first, err := excelize.CoordinatesToCellName(1, headerRow)
+	if err != nil {
+		return err
+	}
+	last, err := excelize.CoordinatesToCellName(len(header), headerRow)
+	if err != nil {
+		return err
+	}
+	err = file.SetCellStyle(sheetName, first, last, s.header)
+	if err != nil {
+		return err
+	}
+
+	// Filter the rows of the table, up to the first empty row
+	end := headerRow
+	for end < len(rows) && len(rows[end]) > 0 {
+		end++
+	}
+	last, err = excelize.CoordinatesToCellName(len(header), end)
+	if err != nil {
+		return err
+	}
+	err = file.AutoFilter(sheetName, first+":"+last, nil)
+	if err != nil {
+		return err
+	}
+
+	if !freeze {
+		return nil
+	}
+	topLeft, err := excelize.CoordinatesToCellName(1, headerRow+1)
+	if err != nil {
+		return err
+	}
+	return file.SetPanes(sheetName, &excelize.Panes{
+		Freeze:      true,
+		YSplit:      headerRow,
+		TopLeftCell: topLeft,
+		ActivePane:  "bottomLeft",
+	})
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The Prometheus text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// sample is one line of a metric
+type sample struct {
+	labels string
+	value  float64
+}
+
+// ServeHTTP writes the metrics of the last query in the Prometheus text format
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	bw := bufio.NewWriter(w)
+	c.write(bw)
+	bw.Flush()
+}
+
+func (c *Collector) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeMetric(w, "crash_total", "counter", "Crashes per signature, counted once the first time a query returns them.", signatureSamples(c.crashes))
+	writeMetric(w, "crash_window", "gauge", "Crashes per signature in the daily indexes of the query window.", signatureSamples(c.crashesInWindow))
+	writeMetric(w, "crash_devices_distinct", "gauge", "Distinct devices per signature in the daily indexes of the query window.", signatureSamples(c.devices))
+	if c.rates != nil {
+		writeMetric(w, "crash_rate_per_1k_devices", "gauge", "Crashes per 1k installed devices per signature in the query window.", signatureSamples(c.rates))
+	}
+
+	var failures []sample
+	for _, target := range c.cfg.Targets {
+		failures = append(failures, sample{
+			labels: labels("product_line", target.ProductLine, "model", target.Model, "version", target.Version),
+			value:  c.scrapeErrors[target],
+		})
+	}
+	writeMetric(w, "crash_exporter_queries_total", "counter", "Queries of every target.", []sample{{value: c.scrapes}})
+	writeMetric(w, "crash_exporter_query_errors_total", "counter", "Failed queries per target.", failures)
+	if !c.lastScrape.IsZero() {
+		writeMetric(w, "crash_exporter_last_query_timestamp_seconds", "gauge", "Unix time of the last query.", []sample{{value: float64(c.lastScrape.Unix())}})
+		writeMetric(w, "crash_exporter_query_duration_seconds", "gauge", "Duration of the last query of every target.", []sample{{value: c.scrapeDuration.Seconds()}})
+	}
+}
+
+// signatureSamples returns the samples of the signatures in a stable order
+func signatureSamples(values map[signature]float64) []sample {
+	samples := make([]sample, 0, len(values))
+	for sig, value := range values {
+		samples = append(samples, sample{
+			labels: labels("model", sig.Model, "version", sig.Version, "reason", sig.Reason, "fingerprint", sig.Fingerprint, "owner", sig.Owner),
+			value:  value,
+		})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].labels < samples[j].labels
+	})
+	return samples
+}
+
+func writeMetric(w *bufio.Writer, name, kind, help string, samples []sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	for _, s := range samples {
+		w.WriteString(name)
+		w.WriteString(s.labels)
+		w.WriteByte(' ')
+		w.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+		w.WriteByte('\n')
+	}
+}
+
+// labels formats the name and value pairs as a label set, ex: {model="UDMPRO"}
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// The label values escape the backslash, the double quote and the line feed
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/installbase"
+	"grafana-extract-go/internal/ownership"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target is one model and version set to query, the version may end with a wildcard
+type Target struct {
+	ProductLine string `json:"product_line"`
+	Model       string `json:"model"`
+	Version     string `json:"version"`
+}
+
+// Config is the metrics file, ex:
+// {"interval": "5m", "days": 1, "size": 1000,
+// "targets": [{"product_line": "network", "model": "UDMPRO", "version": "3.1.9"}]}
+type Config struct {
+	// Interval is how often the targets are queried, ex: 5m
+	Interval string `json:"interval"`
+	// Days is the window of daily indexes the gauges cover, ending today
+	Days int `json:"days"`
+	// Size is the crash logs fetched per target and day
+	Size    int      `json:"size"`
+	Targets []Target `json:"targets"`
+}
+
+const (
+	DefaultInterval = 5 * time.Minute
+	DefaultDays     = 1
+	DefaultSize     = 1000
+)
+
+// Load reads the JSON metrics file, the versions get the v prefix and the wildcard like the -v flag
+func Load(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to open metrics file: %s", err)
+	}
+	defer f.Close()
+
+	var cfg Config
+	err = json.NewDecoder(f).Decode(&cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to parse metrics file: %s", err)
+	}
+	if len(cfg.Targets) == 0 {
+		return Config{}, fmt.Errorf("no targets in metrics file: %s", path)
+	}
+	for i, target := range cfg.Targets {
+		if target.ProductLine == "" || target.Model == "" || target.Version == "" {
+			return Config{}, fmt.Errorf("target %d needs product_line, model and version", i+1)
+		}
+		if !strings.HasPrefix(target.Version, "v") {
+			target.Version = "v" + target.Version
+		}
+		if !strings.HasSuffix(target.Version, "*") {
+			target.Version += "*"
+		}
+		cfg.Targets[i] = target
+	}
+	return cfg, nil
+}
+
+// FetchFunc fetches the crash logs of the target between the from and to daily indexes
+type FetchFunc func(target Target, from, to string, size int) ([]crashlog.CrashLog, error)
+
+// Collector queries the targets periodically and keeps the metrics of the last query
+type Collector struct {
+	cfg         Config
+	interval    time.Duration
+	fetch       FetchFunc
+	owners      *ownership.Owners
+	installBase *installbase.InstallBase
+
+	mu sync.Mutex
+	// crashes counts every crash once, the first time a query returns it
+	crashes map[signature]float64
+	seen    map[string]time.Time
+	// devices and crashesInWindow are replaced by every query
+	devices         map[signature]float64
+	crashesInWindow map[signature]float64
+	rates           map[signature]float64
+	scrapes         float64
+	scrapeErrors    map[Target]float64
+	lastScrape      time.Time
+	scrapeDuration  time.Duration
+}
+
+// signature is the label set of the crash metrics
+type signature struct {
+	Model       string
+	Version     string
+	Reason      string
+	Fingerprint string
+	Owner       string
+}
+
+// NewCollector returns a collector of the config, the owners and install base may be nil
+func NewCollector(cfg Config, fetch FetchFunc, owners *ownership.Owners, installBase *installbase.InstallBase) (*Collector, error) {
+	interval := DefaultInterval
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metrics interval: %s", err)
+		}
+		interval = d
+	}
+	if cfg.Days <= 0 {
+		cfg.Days = DefaultDays
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultSize
+	}
+
+	return &Collector{
+		cfg:          cfg,
+		interval:     interval,
+		fetch:        fetch,
+		owners:       owners,
+		installBase:  installBase,
+		crashes:      make(map[signature]float64),
+		seen:         make(map[string]time.Time),
+		scrapeErrors: make(map[Target]float64),
+	}, nil
+}
+
+// Run queries the targets now and then every interval, it never returns
+func (c *Collector) Run() {
+	for {
+		c.Collect(time.Now())
+		time.Sleep(c.interval)
+	}
+}
+
+// Collect queries every target for the daily indexes of the window ending at now
+func (c *Collector) Collect(now time.Time) {
+	start := time.Now()
+	const layout = "2006_01_02"
+	windowStart := now.UTC().AddDate(0, 0, -(c.cfg.Days - 1))
+	from := windowStart.Format(layout)
+	to := now.UTC().Format(layout)
+
+	var data []crashlog.CrashLog
+	failed := make(map[Target]bool)
+	for _, target := range c.cfg.Targets {
+		logs, err := c.fetch(target, from, to, c.cfg.Size)
+		if err != nil {
+			log.Printf("Metrics query of %s %s %s failed with: %s\n", target.ProductLine, target.Model, target.Version, err)
+			failed[target] = true
+			continue
+		}
+		data = append(data, logs...)
+	}
+
+	fingerprints := make(crashlogutil.FingerprintCache)
+	devices := make(map[signature]map[string]bool)
+	crashesInWindow := make(map[signature]float64)
+	reasons := make(map[string]string)
+	attributions := make(map[string]string)
+	keys := make(map[string]signature, len(data))
+	for _, log := range data {
+		fingerprint := fingerprints.Fingerprint(log.CrashLog)
+		reason, ok := reasons[fingerprint]
+		if !ok {
+			reason = crashlogutil.Reason(log.CrashLog)
+			reasons[fingerprint] = reason
+			attributions[fingerprint] = ownership.Attribute(log.CrashLog, c.owners).Owner
+		}
+		sig := signature{Model: log.Model, Version: crashlogutil.NormalizeVersion(log.Version), Reason: reason, Fingerprint: fingerprint, Owner: attributions[fingerprint]}
+		if devices[sig] == nil {
+			devices[sig] = make(map[string]bool)
+		}
+		devices[sig][log.AnonymousDeviceID] = true
+		crashesInWindow[sig]++
+		keys[log.AnonymousDeviceID+"|"+log.SystemTime.Format(time.RFC3339Nano)+"|"+fingerprint] = sig
+	}
+
+	var rates map[signature]float64
+	if c.installBase != nil {
+		rates = make(map[signature]float64)
+		for _, rate := range installbase.ComputeRates(data, c.installBase, c.owners) {
+			sig := signature{Model: rate.Model, Version: rate.Version, Reason: reasons[rate.Fingerprint], Fingerprint: rate.Fingerprint, Owner: attributions[rate.Fingerprint]}
+			rates[sig] = rate.CrashesPer1k
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Count the crashes not returned by an earlier query, and forget the ones
+	// older than the window since no query returns them again
+	for key, sig := range keys {
+		if _, ok := c.seen[key]; ok {
+			continue
+		}
+		c.seen[key] = now
+		c.crashes[sig]++
+	}
+	cutoff := windowStart.AddDate(0, 0, -1)
+	for key, added := range c.seen {
+		if added.Before(cutoff) {
+			delete(c.seen, key)
+		}
+	}
+
+	c.devices = make(map[signature]float64, len(devices))
+	for sig, ids := range devices {
+		c.devices[sig] = float64(len(ids))
+	}
+	c.crashesInWindow = crashesInWindow
+	c.rates = rates
+	c.scrapes++
+	for target := range failed {
+		c.scrapeErrors[target]++
+	}
+	c.lastScrape = now
+	c.scrapeDuration = time.Since(start)
+}
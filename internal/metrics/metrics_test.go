@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"grafana-extract-go/internal/app/crashlog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLabels(t *testing.T) {
+	tests := []struct {
+		pairs []string
+		want  string
+	}{
+		{nil, "{}"},
+		{[]string{"model", "UDMPRO"}, `{model="UDMPRO"}`},
+		{[]string{"model", "UDR", "version", "3.1.9"}, `{model="UDR",version="3.1.9"}`},
+		{[]string{"reason", `not syncing: "C:\dev"` + "\nnext"}, `{reason="not syncing: \"C:\\dev\"\nnext"}`},
+	}
+	for _, tt := range tests {
+		if got := labels(tt.pairs...); got != tt.want {
+			t.Errorf("labels(%q) = %s, want %s", tt.pairs, got, tt.want)
+		}
+	}
+}
+
+func TestWriteMetric(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeMetric(w, "crash_total", "counter", "Crashes per signature.", []sample{
+		{labels: labels("model", "UDR"), value: 3},
+		{labels: labels("model", "UDMPRO"), value: 0.25},
+	})
+	w.Flush()
+
+	want := "# HELP crash_total Crashes per signature.\n" +
+		"# TYPE crash_total counter\n" +
+		"crash_total{model=\"UDR\"} 3\n" +
+		"crash_total{model=\"UDMPRO\"} 0.25\n"
+	if buf.String() != want {
+		t.Errorf("writeMetric =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name, content string
+		wantVersion   string
+		wantErr       bool
+	}{
+		{"version completed", `{"targets": [{"product_line": "network", "model": "UDMPRO", "version": "3.1.9"}]}`, "v3.1.9*", false},
+		{"version kept", `{"targets": [{"product_line": "network", "model": "UDMPRO", "version": "v3.1*"}]}`, "v3.1*", false},
+		{"no targets", `{"interval": "5m"}`, "", true},
+		{"incomplete target", `{"targets": [{"model": "UDMPRO", "version": "3.1.9"}]}`, "", true},
+		{"invalid JSON", `{"targets": `, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.json")
+			err := os.WriteFile(path, []byte(tt.content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && cfg.Targets[0].Version != tt.wantVersion {
+				t.Errorf("version = %s, want %s", cfg.Targets[0].Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestCollector(t *testing.T) {
+	now := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+	crash := func(device string, minute int) crashlog.CrashLog {
+		return crashlog.CrashLog{
+			AnonymousDeviceID: device,
+			Model:             "UDMPRO",
+			Version:           "v3.1.9",
+			SystemTime:        now.Add(-time.Duration(minute) * time.Minute),
+			CrashLog:          "<0>[  12.345678] Kernel panic - not syncing: Fatal exception",
+		}
+	}
+	udmpro := Target{ProductLine: "network", Model: "UDMPRO", Version: "v3.1.9*"}
+	udr := Target{ProductLine: "network", Model: "UDR", Version: "v3.1.9*"}
+
+	// The second query returns the crashes of the first one again and a new one
+	var queries int
+	fetch := func(target Target, from, to string, size int) ([]crashlog.CrashLog, error) {
+		if target == udr {
+			return nil, errors.New("index not found")
+		}
+		if from != "2023_06_15" || to != "2023_06_15" || size != DefaultSize {
+			t.Errorf("fetch(%s, %s, %d)", from, to, size)
+		}
+		if queries++; queries == 1 {
+			return []crashlog.CrashLog{crash("a", 30), crash("b", 20)}, nil
+		}
+		return []crashlog.CrashLog{crash("a", 30), crash("b", 20), crash("a", 10)}, nil
+	}
+	c, err := NewCollector(Config{Targets: []Target{udmpro, udr}}, fetch, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Collect(now)
+	c.Collect(now.Add(5 * time.Minute))
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); got != contentType {
+		t.Errorf("Content-Type = %q", got)
+	}
+	body := w.Body.String()
+
+	signature := `{model="UDMPRO",version="3.1.9",reason="not syncing: Fatal exception",fingerprint="`
+	tests := []struct {
+		prefix, want string
+	}{
+		// 3 distinct crashes over both queries, each counted once
+		{"crash_total" + signature, "3"},
+		{"crash_window" + signature, "3"},
+		{"crash_devices_distinct" + signature, "2"},
+		{"crash_exporter_queries_total ", "2"},
+		{`crash_exporter_query_errors_total{product_line="network",model="UDMPRO",version="v3.1.9*"} `, "0"},
+		{`crash_exporter_query_errors_total{product_line="network",model="UDR",version="v3.1.9*"} `, "2"},
+		{"crash_exporter_last_query_timestamp_seconds ", "1.6868307e+09"},
+	}
+	lines := strings.Split(body, "\n")
+	for _, tt := range tests {
+		found := false
+		for _, line := range lines {
+			if strings.HasPrefix(line, tt.prefix) {
+				found = true
+				if got := line[strings.LastIndex(line, " ")+1:]; got != tt.want {
+					t.Errorf("%s = %s, want %s", line[:strings.LastIndex(line, " ")], got, tt.want)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("no sample %s...\n%s", tt.prefix, body)
+		}
+	}
+	if strings.Contains(body, "crash_rate_per_1k_devices") {
+		t.Error("rates without an install base")
+	}
+}
@@ -0,0 +1,81 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/bootloop"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/ownership"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Send posts the text to the chat webhook URL as {"text": "..."}
+func Send(webhookURL, text string) error {
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %s", err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to send notification: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// Summary formats the crash report for a notification, the boot looping devices come first
+func Summary(title string, crashLogs []crashlog.CrashLog, loops []bootloop.Loop, owners *ownership.Owners) string {
+	var sb strings.Builder
+	sb.WriteString(title)
+	sb.WriteString("\n")
+
+	if len(loops) > 0 {
+		fmt.Fprintf(&sb, "\nBoot loops: %d devices\n", len(loops))
+		for _, loop := range loops {
+			fmt.Fprintf(&sb, "- %s (%s %s): %d crashes in %s, %s - %s\n",
+				loop.DeviceID, loop.Model, loop.Version, loop.Count, loop.Span,
+				loop.Start.Format(time.RFC3339), loop.End.Format(time.RFC3339))
+		}
+	}
+
+	// Count the crashes and devices per reason
+	type count struct {
+		reason  string
+		owner   string
+		crashes int
+		devices map[string]bool
+	}
+	var counts []*count
+	index := make(map[string]*count)
+	for _, log := range crashLogs {
+		reason := crashlogutil.Reason(log.CrashLog)
+		c, ok := index[reason]
+		if !ok {
+			c = &count{reason: reason, owner: ownership.Attribute(log.CrashLog, owners).Owner, devices: make(map[string]bool)}
+			index[reason] = c
+			counts = append(counts, c)
+		}
+		c.crashes++
+		c.devices[log.AnonymousDeviceID] = true
+	}
+
+	fmt.Fprintf(&sb, "\nCrashes: %d\n", len(crashLogs))
+	for _, c := range counts {
+		fmt.Fprintf(&sb, "- %s [%s]: %d crashes, %d devices\n", c.reason, c.owner, c.crashes, len(c.devices))
+	}
+
+	return sb.String()
+}
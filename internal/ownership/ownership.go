@@ -0,0 +1,267 @@
+package ownership
+
+import (
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/crashlogutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Unassigned is the owner of a crash no rule matches
+const Unassigned = "Unassigned"
+
+var (
+	// Matches the faulting PC symbol, ex: pc : blk_update_request+0x1c4/0x3e8 [ubnt_sd],
+	// PC is at blk_update_request+0x1c4/0x3e8, RIP: 0010:blk_update_request+0x1c4/0x3e8
+	pcRegex = regexp.MustCompile(`(?:\bpc\s*:|PC is at|RIP: [0-9a-f]{4}:|epc\s*:\s*[0-9a-f]+)\s*([A-Za-z_][\w.]*)\+0x[0-9a-fA-F]+/0x[0-9a-fA-F]+(?:\s+\[(\w+)\])?`)
+	// Matches a call trace frame with its optional module, ex: blk_update_request+0x1c4/0x3e8 [ubnt_sd]
+	frameRegex = regexp.MustCompile(`([A-Za-z_][\w.]*)\+0x[0-9a-fA-F]+/0x[0-9a-fA-F]+(?:\s+\[(\w+)\])?`)
+	// Matches the loaded modules, ex: Modules linked in: ubnt_sd(O) ext4 xt_TCPMSS
+	modulesRegex = regexp.MustCompile(`Modules linked in:(.*)`)
+	// Matches one loaded module and its taint flags, ex: ubnt_sd(PO)
+	moduleRegex = regexp.MustCompile(`(\w+)(?:\(([A-Z]+)\))?`)
+)
+
+// The built-in symbol prefixes of the kernel subsystems, the ownership file can add more
+var defaultPrefixes = map[string]string{
+	"blk_":                 "block",
+	"bio_":                 "block",
+	"submit_bio":           "block",
+	"generic_make_request": "block",
+	"elv_":                 "block",
+	"scsi_":                "scsi",
+	"sd_":                  "scsi",
+	"ata_":                 "ata",
+	"ahci_":                "ata",
+	"sata_":                "ata",
+	"ext4_":                "fs/ext4",
+	"jbd2_":                "fs/ext4",
+	"btrfs_":               "fs/btrfs",
+	"ubifs_":               "fs/ubifs",
+	"ubi_":                 "mtd",
+	"mtd_":                 "mtd",
+	"nand_":                "mtd",
+	"md_":                  "md",
+	"raid":                 "md",
+	"vfs_":                 "fs",
+	"__alloc_pages":        "mm",
+	"kmem_cache":           "mm",
+	"kmalloc":              "mm",
+	"oom_":                 "mm",
+	"out_of_memory":        "mm",
+	"handle_mm_fault":      "mm",
+	"skb_":                 "net",
+	"__skb":                "net",
+	"netif_":               "net",
+	"__netif":              "net",
+	"napi_":                "net",
+	"dev_queue_xmit":       "net",
+	"ip_":                  "net",
+	"ip6_":                 "net",
+	"tcp_":                 "net",
+	"udp_":                 "net",
+	"nf_":                  "net/netfilter",
+	"xt_":                  "net/netfilter",
+	"br_":                  "net/bridge",
+	"ieee80211_":           "wireless",
+	"cfg80211_":            "wireless",
+	"usb_":                 "usb",
+	"xhci_":                "usb",
+	"ehci_":                "usb",
+	"rcu_":                 "rcu",
+	"__schedule":           "sched",
+	"schedule":             "sched",
+	"try_to_wake_up":       "sched",
+}
+
+// The built-in prefixes, longest first
+var sortedDefaultPrefixes = sortPrefixes(defaultPrefixes, nil)
+
+// prefix is a symbol prefix and its subsystem
+type prefix struct {
+	prefix    string
+	subsystem string
+}
+
+// Owners maps the subsystems and modules to their owning teams
+//
+// ex: {"default": "Platform Team", "subsystems": {"block": "Storage Team"},
+// "modules": {"ubnt_sd": "Storage Team"}, "prefixes": {"ubnt_sd_": "ubnt_sd"}}
+type Owners struct {
+	// Default owns the crashes no subsystem or module matches
+	Default string `json:"default"`
+	// Subsystems maps a subsystem to a team, ex: block -> Storage Team
+	Subsystems map[string]string `json:"subsystems"`
+	// Modules maps a module to a team, ex: ubnt_sd -> Storage Team
+	Modules map[string]string `json:"modules"`
+	// Prefixes maps extra symbol prefixes to a subsystem, ex: ubnt_sd_ -> ubnt_sd
+	Prefixes map[string]string `json:"prefixes"`
+
+	// The built-in and extra prefixes, longest first, sorted on first use
+	sortOnce sync.Once
+	prefixes []prefix
+}
+
+// Attribution is the subsystem or driver a crash happened in, and its owner
+type Attribution struct {
+	Symbol    string `json:"symbol"`
+	Module    string `json:"module"`
+	Subsystem string `json:"subsystem"`
+	OutOfTree bool   `json:"out_of_tree"`
+	Owner     string `json:"owner"`
+}
+
+// Load reads the JSON ownership file
+func Load(path string) (*Owners, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ownership file: %s", err)
+	}
+	defer f.Close()
+
+	owners := &Owners{}
+	err = json.NewDecoder(f).Decode(owners)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ownership file: %s", err)
+	}
+	return owners, nil
+}
+
+// Attribute maps the crash log to a kernel subsystem or driver, and then to
+// its owner. The owners may be nil, the crash is then unassigned.
+func Attribute(crashLog string, owners *Owners) Attribution {
+	return AttributeLines(crashlogutil.PrintedLines(crashLog), owners)
+}
+
+// AttributeLines is Attribute for the crash log lines in printed order
+func AttributeLines(lines []string, owners *Owners) Attribution {
+	var attribution Attribution
+	outOfTree := make(map[string]bool)
+	var symbols []string
+
+	for _, line := range lines {
+		if match := pcRegex.FindStringSubmatch(line); match != nil && attribution.Symbol == "" {
+			attribution.Symbol = match[1]
+			if match[2] != "" {
+				attribution.Module = match[2]
+			}
+		}
+		if match := modulesRegex.FindStringSubmatch(line); match != nil {
+			for _, module := range moduleRegex.FindAllStringSubmatch(match[1], -1) {
+				// The O taint flag marks an out-of-tree module
+				if strings.Contains(module[2], "O") {
+					outOfTree[module[1]] = true
+				}
+			}
+			continue
+		}
+		for _, frame := range frameRegex.FindAllStringSubmatch(line, -1) {
+			symbols = append(symbols, frame[1])
+			if attribution.Module == "" && frame[2] != "" {
+				attribution.Module = frame[2]
+			}
+		}
+	}
+	if attribution.Symbol == "" && len(symbols) > 0 {
+		attribution.Symbol = symbols[0]
+	}
+	attribution.OutOfTree = attribution.Module != "" && outOfTree[attribution.Module]
+
+	// An out-of-tree driver is its own subsystem, otherwise the faulting
+	// symbol wins over the rest of the call trace
+	if attribution.OutOfTree {
+		attribution.Subsystem = attribution.Module
+	} else {
+		for _, symbol := range append([]string{attribution.Symbol}, symbols...) {
+			if subsystem := subsystemOf(symbol, owners); subsystem != "" {
+				attribution.Subsystem = subsystem
+				break
+			}
+		}
+		if attribution.Subsystem == "" {
+			attribution.Subsystem = attribution.Module
+		}
+	}
+	if attribution.Subsystem == "" {
+		attribution.Subsystem = "unknown"
+	}
+
+	attribution.Owner = owners.ownerOf(attribution)
+	return attribution
+}
+
+// subsystemOf returns the subsystem of the longest matching symbol prefix
+func subsystemOf(symbol string, owners *Owners) string {
+	if symbol == "" {
+		return ""
+	}
+	for _, p := range owners.sortedPrefixes() {
+		if strings.HasPrefix(symbol, p.prefix) {
+			return p.subsystem
+		}
+	}
+	return ""
+}
+
+// sortedPrefixes returns the built-in prefixes merged with the extra ones
+func (o *Owners) sortedPrefixes() []prefix {
+	if o == nil || len(o.Prefixes) == 0 {
+		return sortedDefaultPrefixes
+	}
+	o.sortOnce.Do(func() {
+		o.prefixes = sortPrefixes(defaultPrefixes, o.Prefixes)
+	})
+	return o.prefixes
+}
+
+// sortPrefixes merges the prefixes, the extra ones win, and sorts them longest first
+func sortPrefixes(builtIn, extra map[string]string) []prefix {
+	subsystems := make(map[string]string, len(builtIn)+len(extra))
+	for p, subsystem := range builtIn {
+		subsystems[p] = subsystem
+	}
+	for p, subsystem := range extra {
+		subsystems[p] = subsystem
+	}
+
+	prefixes := make([]prefix, 0, len(subsystems))
+	for p, subsystem := range subsystems {
+		prefixes = append(prefixes, prefix{prefix: p, subsystem: subsystem})
+	}
+	// The ties are sorted by name, so the order doesn't depend on the map
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i].prefix) != len(prefixes[j].prefix) {
+			return len(prefixes[i].prefix) > len(prefixes[j].prefix)
+		}
+		return prefixes[i].prefix < prefixes[j].prefix
+	})
+	return prefixes
+}
+
+// ownerOf returns the team of the module, then of the subsystem or its parent, ex: fs/ext4 then fs
+func (o *Owners) ownerOf(attribution Attribution) string {
+	if o == nil {
+		return Unassigned
+	}
+	if owner, ok := o.Modules[attribution.Module]; ok && attribution.Module != "" {
+		return owner
+	}
+	for subsystem := attribution.Subsystem; subsystem != ""; {
+		if owner, ok := o.Subsystems[subsystem]; ok {
+			return owner
+		}
+		index := strings.LastIndex(subsystem, "/")
+		if index < 0 {
+			break
+		}
+		subsystem = subsystem[:index]
+	}
+	if o.Default != "" {
+		return o.Default
+	}
+	return Unassigned
+}
@@ -0,0 +1,112 @@
+package ownership
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttributeLines(t *testing.T) {
+	owners := &Owners{
+		Default:    "Platform Team",
+		Subsystems: map[string]string{"block": "Storage Team", "fs": "Filesystem Team", "net": "Network Team"},
+		Modules:    map[string]string{"ubnt_sd": "Drivers Team"},
+		Prefixes:   map[string]string{"skb_copy": "net/core"},
+	}
+
+	tests := []struct {
+		name   string
+		lines  []string
+		owners *Owners
+		want   Attribution
+	}{
+		{
+			name:   "faulting symbol",
+			lines:  []string{"pc : blk_update_request+0x1c4/0x3e8", "Call trace:", " blk_update_request+0x1c4/0x3e8", " scsi_end_request+0x30/0x1e0"},
+			owners: owners,
+			want:   Attribution{Symbol: "blk_update_request", Subsystem: "block", Owner: "Storage Team"},
+		},
+		{
+			name:   "out-of-tree module",
+			lines:  []string{"Modules linked in: ubnt_sd(PO) ext4 xt_TCPMSS", "pc : ubnt_sd_io+0x10/0x80 [ubnt_sd]", " blk_update_request+0x1c4/0x3e8"},
+			owners: owners,
+			want:   Attribution{Symbol: "ubnt_sd_io", Module: "ubnt_sd", Subsystem: "ubnt_sd", OutOfTree: true, Owner: "Drivers Team"},
+		},
+		{
+			name:   "in-tree module",
+			lines:  []string{"Modules linked in: ext4 xt_TCPMSS", "pc : ext4_writepages+0x10/0x80 [ext4]"},
+			owners: owners,
+			want:   Attribution{Symbol: "ext4_writepages", Module: "ext4", Subsystem: "fs/ext4", Owner: "Filesystem Team"},
+		},
+		{
+			name:   "longer custom prefix",
+			lines:  []string{"PC is at skb_copy_bits+0x44/0x2a0"},
+			owners: owners,
+			want:   Attribution{Symbol: "skb_copy_bits", Subsystem: "net/core", Owner: "Network Team"},
+		},
+		{
+			name:   "x86 and the call trace past an unknown symbol",
+			lines:  []string{"RIP: 0010:vendor_fn+0x20/0x90", "Call Trace:", " tcp_v4_rcv+0x9f0/0xb20"},
+			owners: owners,
+			want:   Attribution{Symbol: "vendor_fn", Subsystem: "net", Owner: "Network Team"},
+		},
+		{
+			name:   "no symbol",
+			lines:  []string{"Kernel panic - not syncing: Attempted to kill init!"},
+			owners: owners,
+			want:   Attribution{Subsystem: "unknown", Owner: "Platform Team"},
+		},
+		{
+			name:  "no owners",
+			lines: []string{"pc : blk_update_request+0x1c4/0x3e8"},
+			want:  Attribution{Symbol: "blk_update_request", Subsystem: "block", Owner: Unassigned},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AttributeLines(tt.lines, tt.owners); got != tt.want {
+				t.Errorf("AttributeLines = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owners.json")
+	err := os.WriteFile(path, []byte(`{"default": "Platform Team", "subsystems": {"block": "Storage Team"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owners.Default != "Platform Team" || owners.Subsystems["block"] != "Storage Team" {
+		t.Errorf("owners = %+v", owners)
+	}
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
+
+func TestSortPrefixes(t *testing.T) {
+	prefixes := sortPrefixes(map[string]string{"ip_": "net", "skb_": "net", "raid": "md"}, map[string]string{"skb_copy": "net/core", "ip_": "net/ipv4"})
+	want := []prefix{{"skb_copy", "net/core"}, {"raid", "md"}, {"skb_", "net"}, {"ip_", "net/ipv4"}}
+	if len(prefixes) != len(want) {
+		t.Fatalf("sortPrefixes = %v, want %v", prefixes, want)
+	}
+	for i := range want {
+		if prefixes[i] != want[i] {
+			t.Errorf("sortPrefixes = %v, want %v", prefixes, want)
+			break
+		}
+	}
+
+	var none *Owners
+	if got := none.sortedPrefixes(); len(got) != len(defaultPrefixes) {
+		t.Errorf("got %d prefixes without owners, want %d", len(got), len(defaultPrefixes))
+	}
+}
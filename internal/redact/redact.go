@@ -0,0 +1,233 @@
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Mode is what happens to the sensitive data
+type Mode string
+
+const (
+	// Mask replaces the value with its detector name, ex: [redacted:mac]
+	Mask Mode = "mask"
+	// Hash replaces the value with a stable hash, so the same value can still be correlated, ex: [mac:1a2b3c4d]
+	Hash Mode = "hash"
+	// Drop removes the whole line holding the value
+	Drop Mode = "drop"
+)
+
+// Rule is a detector of sensitive data
+type Rule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	// Group is the submatch holding the value, 0 redacts the whole match
+	Group int `json:"group"`
+	// Mode overrides the mode of the config for this rule
+	Mode Mode `json:"mode"`
+}
+
+// Config selects the built-in detectors and adds user-defined ones
+//
+// ex: {"mode": "hash", "salt": "s3cret", "detectors": ["mac", "ipv4"],
+// "rules": [{"name": "customer", "pattern": "site=(\\S+)", "group": 1, "mode": "mask"}]}
+type Config struct {
+	Mode Mode `json:"mode"`
+	// Salt is mixed into the hashes, so short values like IPs can't be brute forced
+	Salt string `json:"salt"`
+	// Detectors are the built-in detectors to run, empty runs all of them
+	Detectors []string `json:"detectors"`
+	Rules     []Rule   `json:"rules"`
+}
+
+// The built-in detectors, in the order they run
+var Detectors = []Rule{
+	{Name: "mac", Pattern: `\b(?:[0-9A-Fa-f]{2}[:-]){5}[0-9A-Fa-f]{2}\b`},
+	{Name: "ipv6", Pattern: `\b(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}\b|\b[0-9A-Fa-f]{1,4}(?::[0-9A-Fa-f]{1,4}){0,5}::(?:[0-9A-Fa-f]{1,4}(?::[0-9A-Fa-f]{1,4}){0,5}\b)?|::[0-9A-Fa-f]{1,4}(?::[0-9A-Fa-f]{1,4}){0,5}\b`},
+	{Name: "ipv4", Pattern: `\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`},
+	{Name: "serial", Pattern: `(?i)\b(?:serial(?:[ _-]?(?:number|no))?|sn)\s*[:=]\s*([\w-]+)`, Group: 1},
+	{Name: "hostname", Pattern: `(?i)\b(?:hostname|host)\s*[:=]\s*([\w.-]+)`, Group: 1},
+	{Name: "path", Pattern: `(?:/home/|/Users/|/var/services/homes/)([^/\s]+)`, Group: 1},
+}
+
+// Matches the line markers of the raw crash log, ex: <4>
+var markerRegex = regexp.MustCompile(`<\d{1,3}>`)
+
+type rule struct {
+	name  string
+	regex *regexp.Regexp
+	group int
+	mode  Mode
+}
+
+// Redactor removes sensitive data, a nil Redactor keeps everything
+type Redactor struct {
+	rules []rule
+	salt  string
+}
+
+// LoadConfig reads the JSON redaction config file
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to open redaction config: %s", err)
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to parse redaction config: %s", err)
+	}
+	return cfg, nil
+}
+
+// New compiles the detectors of the config
+func New(cfg Config) (*Redactor, error) {
+	if cfg.Mode == "" {
+		cfg.Mode = Mask
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range cfg.Detectors {
+		selected[name] = true
+	}
+	for name := range selected {
+		if !isDetector(name) {
+			return nil, fmt.Errorf("unknown detector: %s", name)
+		}
+	}
+
+	var rules []Rule
+	for _, detector := range Detectors {
+		if len(selected) == 0 || selected[detector.Name] {
+			rules = append(rules, detector)
+		}
+	}
+	rules = append(rules, cfg.Rules...)
+
+	r := &Redactor{salt: cfg.Salt}
+	for _, ru := range rules {
+		mode := ru.Mode
+		if mode == "" {
+			mode = cfg.Mode
+		}
+		if mode != Mask && mode != Hash && mode != Drop {
+			return nil, fmt.Errorf("invalid mode %q of rule %s", mode, ru.Name)
+		}
+		regex, err := regexp.Compile(ru.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of rule %s: %s", ru.Name, err)
+		}
+		if ru.Group < 0 || ru.Group > regex.NumSubexp() {
+			return nil, fmt.Errorf("invalid group %d of rule %s", ru.Group, ru.Name)
+		}
+		r.rules = append(r.rules, rule{name: ru.Name, regex: regex, group: ru.Group, mode: mode})
+	}
+
+	return r, nil
+}
+
+func isDetector(name string) bool {
+	for _, detector := range Detectors {
+		if detector.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// String redacts a text, its lines are separated by newlines
+func (r *Redactor) String(text string) string {
+	if r == nil {
+		return text
+	}
+
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if line, ok := r.line(line); ok {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// CrashLog redacts a raw crash log, its lines start with markers like <4>
+func (r *Redactor) CrashLog(crashLog string) string {
+	if r == nil {
+		return crashLog
+	}
+
+	// Split the crash log before every marker, each segment is a marker and its line
+	var segments []string
+	start := 0
+	for _, marker := range markerRegex.FindAllStringIndex(crashLog, -1) {
+		segments = append(segments, crashLog[start:marker[0]])
+		start = marker[0]
+	}
+	segments = append(segments, crashLog[start:])
+
+	var sb strings.Builder
+	for _, segment := range segments {
+		marker := ""
+		if loc := markerRegex.FindStringIndex(segment); loc != nil && loc[0] == 0 {
+			marker = segment[:loc[1]]
+		}
+		if line, ok := r.line(segment[len(marker):]); ok {
+			sb.WriteString(marker + line)
+		}
+	}
+	return sb.String()
+}
+
+// CrashLogs returns a copy of the crash logs with the sensitive data redacted
+func (r *Redactor) CrashLogs(data []crashlog.CrashLog) []crashlog.CrashLog {
+	if r == nil {
+		return data
+	}
+
+	redacted := make([]crashlog.CrashLog, len(data))
+	for i, log := range data {
+		log.CrashLog = r.CrashLog(log.CrashLog)
+		redacted[i] = log
+	}
+	return redacted
+}
+
+// line redacts one line, false means the line is dropped
+func (r *Redactor) line(line string) (string, bool) {
+	for _, ru := range r.rules {
+		matches := ru.regex.FindAllStringSubmatchIndex(line, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		if ru.mode == Drop {
+			return "", false
+		}
+
+		// Replace from the end, so the earlier indices stay valid
+		for i := len(matches) - 1; i >= 0; i-- {
+			start, end := matches[i][2*ru.group], matches[i][2*ru.group+1]
+			if start < 0 || start == end {
+				continue
+			}
+			line = line[:start] + r.replacement(ru, line[start:end]) + line[end:]
+		}
+	}
+	return line, true
+}
+
+func (r *Redactor) replacement(ru rule, value string) string {
+	if ru.mode == Hash {
+		sum := sha256.Sum256([]byte(r.salt + value))
+		return fmt.Sprintf("[%s:%s]", ru.name, hex.EncodeToString(sum[:])[:8])
+	}
+	return fmt.Sprintf("[redacted:%s]", ru.name)
+}
@@ -0,0 +1,151 @@
+package redact
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{name: "defaults", cfg: Config{}},
+		{name: "selected detectors", cfg: Config{Mode: Hash, Detectors: []string{"mac", "ipv4"}}},
+		{name: "unknown detector", cfg: Config{Detectors: []string{"email"}}, wantErr: "unknown detector: email"},
+		{name: "invalid mode", cfg: Config{Mode: "blur"}, wantErr: `invalid mode "blur"`},
+		{name: "invalid pattern", cfg: Config{Rules: []Rule{{Name: "site", Pattern: "site=("}}}, wantErr: "invalid pattern of rule site"},
+		{name: "invalid group", cfg: Config{Rules: []Rule{{Name: "site", Pattern: `site=(\S+)`, Group: 2}}}, wantErr: "invalid group 2 of rule site"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("New error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		text string
+		want string
+	}{
+		{
+			name: "mask",
+			cfg:  Config{},
+			text: "eth0: link up 00:1A:2b:3c:4d:5e from 192.168.1.20\nhostname=udm-home serial: FCECDA123456",
+			want: "eth0: link up [redacted:mac] from [redacted:ipv4]\nhostname=[redacted:hostname] serial: [redacted:serial]",
+		},
+		{
+			name: "ipv6 and home paths",
+			cfg:  Config{},
+			text: "peer fe80::1c2a:3bff:fe4d:5e6f open /home/alice/core.1234",
+			want: "peer [redacted:ipv6] open /home/[redacted:path]/core.1234",
+		},
+		{
+			name: "selected detectors only",
+			cfg:  Config{Detectors: []string{"ipv4"}},
+			text: "00:1a:2b:3c:4d:5e 10.0.0.1",
+			want: "00:1a:2b:3c:4d:5e [redacted:ipv4]",
+		},
+		{
+			name: "drop",
+			cfg:  Config{Mode: Drop, Detectors: []string{"ipv4"}},
+			text: "first\nfrom 10.0.0.1\nlast",
+			want: "first\nlast",
+		},
+		{
+			name: "rule mode overrides the config",
+			cfg:  Config{Mode: Drop, Detectors: []string{"ipv4"}, Rules: []Rule{{Name: "site", Pattern: `site=(\S+)`, Group: 1, Mode: Mask}}},
+			text: "site=acme\nfrom 10.0.0.1",
+			want: "site=[redacted:site]",
+		},
+		{
+			name: "kernel lines are kept",
+			cfg:  Config{},
+			text: "[  123.456789] pc : blk_update_request+0x1c4/0x3e8",
+			want: "[  123.456789] pc : blk_update_request+0x1c4/0x3e8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.String(tt.text); got != tt.want {
+				t.Errorf("String =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHash(t *testing.T) {
+	hashes := regexp.MustCompile(`\[ipv4:[0-9a-f]{8}\]`)
+	redact := func(salt, text string) []string {
+		r, err := New(Config{Mode: Hash, Salt: salt, Detectors: []string{"ipv4"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hashes.FindAllString(r.String(text), -1)
+	}
+
+	got := redact("s3cret", "10.0.0.1 10.0.0.2 10.0.0.1")
+	if len(got) != 3 || got[0] != got[2] || got[0] == got[1] {
+		t.Errorf("hashes = %v, want the same value hashed the same", got)
+	}
+	if other := redact("pepper", "10.0.0.1"); len(other) != 1 || other[0] == got[0] {
+		t.Errorf("hash %v doesn't depend on the salt", other)
+	}
+}
+
+func TestCrashLog(t *testing.T) {
+	crashLog := "<0>[  12.000300] Kernel panic - not syncing: Fatal exception" +
+		"<4>[  12.000200] br0: port 1(eth0) 00:1a:2b:3c:4d:5e entered disabled state" +
+		"<6>[  12.000100] dhcp lease 10.0.0.1"
+
+	tests := []struct {
+		mode Mode
+		want string
+	}{
+		{Mask, "<0>[  12.000300] Kernel panic - not syncing: Fatal exception" +
+			"<4>[  12.000200] br0: port 1(eth0) [redacted:mac] entered disabled state" +
+			"<6>[  12.000100] dhcp lease [redacted:ipv4]"},
+		{Drop, "<0>[  12.000300] Kernel panic - not syncing: Fatal exception"},
+	}
+	for _, tt := range tests {
+		r, err := New(Config{Mode: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.CrashLog(crashLog); got != tt.want {
+			t.Errorf("%s: CrashLog =\n%s\nwant\n%s", tt.mode, got, tt.want)
+		}
+	}
+
+	// The copy is redacted, not the crash logs passed in
+	r, _ := New(Config{})
+	data := []crashlog.CrashLog{{CrashLog: crashLog}}
+	redacted := r.CrashLogs(data)
+	if data[0].CrashLog != crashLog || redacted[0].CrashLog == crashLog {
+		t.Error("CrashLogs didn't redact a copy")
+	}
+
+	var none *Redactor
+	if none.CrashLog(crashLog) != crashLog || none.String("10.0.0.1") != "10.0.0.1" {
+		t.Error("a nil Redactor changed the text")
+	}
+}
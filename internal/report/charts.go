@@ -0,0 +1,106 @@
+package report
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/uptime"
+	"sort"
+)
+
+// The signatures of the signature and rate charts, the ones with the most crashes
+const ChartSignatures = 15
+
+// Count is the crashes of one label, a point of a chart
+type Count struct {
+	Label   string `json:"label"`
+	Crashes int    `json:"crashes"`
+}
+
+// ChartData is the series the charts of a report are drawn from, except the
+// signature and rate charts which draw the rows of the summary
+type ChartData struct {
+	// Days is the crashes per day, from the first to the last crash day
+	Days []Count `json:"days"`
+	// Uptime is the crashes per uptime bucket, in bucket order
+	Uptime []Count `json:"uptime"`
+	// ShareBy is what Share splits the crashes by: Kernel version, or BOM
+	// revision if every crash runs the same kernel
+	ShareBy string  `json:"share_by"`
+	Share   []Count `json:"share"`
+}
+
+// BuildChartData counts the crashes per day, uptime bucket and kernel version
+func BuildChartData(data []crashlog.CrashLog) ChartData {
+	var charts ChartData
+
+	// Crashes per day, the days without a crash are kept so the line doesn't skip them
+	days := make(map[string]int)
+	if len(data) > 0 {
+		first, last := data[0].SystemTime, data[0].SystemTime
+		for _, log := range data {
+			days[log.SystemTime.Format("2006-01-02")]++
+			if log.SystemTime.Before(first) {
+				first = log.SystemTime
+			}
+			if log.SystemTime.After(last) {
+				last = log.SystemTime
+			}
+		}
+		end := last.Format("2006-01-02")
+		for day := first; ; day = day.AddDate(0, 0, 1) {
+			label := day.Format("2006-01-02")
+			charts.Days = append(charts.Days, Count{Label: label, Crashes: days[label]})
+			if label >= end {
+				break
+			}
+		}
+	}
+
+	// Crashes per uptime bucket
+	buckets := make(map[uptime.Bucket]int)
+	for _, log := range data {
+		d, _ := crashlogutil.Uptime(log)
+		buckets[uptime.Classify(d)]++
+	}
+	for _, bucket := range uptime.Buckets {
+		charts.Uptime = append(charts.Uptime, Count{Label: bucket.String(), Crashes: buckets[bucket]})
+	}
+
+	// Share per kernel version, the BOM revision tells more if there is a single kernel
+	kernels := make(map[string]int)
+	boms := make(map[string]int)
+	for _, log := range data {
+		kernels[shareLabel(log.KernelVersion)]++
+		boms[shareLabel(log.BomRev)]++
+	}
+	share := kernels
+	charts.ShareBy = "Kernel version"
+	if len(kernels) == 1 && len(boms) > 1 {
+		share = boms
+		charts.ShareBy = "BOM revision"
+	}
+	for label, crashes := range share {
+		charts.Share = append(charts.Share, Count{Label: label, Crashes: crashes})
+	}
+	sortCounts(charts.Share)
+
+	return charts
+}
+
+// shareLabel labels the crash logs without a kernel version or BOM revision as unknown
+func shareLabel(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// sortCounts sorts the counts by crashes, most first, the label breaks the ties
+func sortCounts(counts []Count) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Crashes != counts[j].Crashes {
+			return counts[i].Crashes > counts[j].Crashes
+		}
+		return counts[i].Label < counts[j].Label
+	})
+}
@@ -0,0 +1,63 @@
+package report
+
+import (
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"time"
+)
+
+// Metadata returns the key/value rows describing one crash instance, written
+// above its crash log lines
+func Metadata(log crashlog.CrashLog) [][]interface{} {
+	return [][]interface{}{
+		{"AnonymousDeviceID", log.AnonymousDeviceID},
+		{"System time", formatTime(log.SystemTime)},
+		{"Model", log.Model},
+		{"Version", log.Version},
+		{"BOM revision", log.BomRev},
+		{"Kernel version", log.KernelVersion},
+		{"Architecture", log.Architecture},
+		{"Boot time", formatTime(log.BootTime)},
+		{"Uptime", formatUptime(log)},
+		{"Load average", log.LoadAverage},
+		{"Signal", log.Signal},
+		{"Internal", log.IsInternal},
+		{"Default", fmt.Sprint(log.IsDefault)},
+	}
+}
+
+// InstanceColumns is the header of the instance table, the keys of Metadata
+var InstanceColumns = []interface{}{"AnonymousDeviceID", "System time", "Model", "Version", "BOM revision", "Kernel version", "Architecture", "Boot time", "Uptime", "Load average", "Signal", "Internal", "Default"}
+
+// Instances returns a table of the crash instances of a group, one row per
+// crash with the same fields as Metadata
+func Instances(logs []crashlog.CrashLog) [][]interface{} {
+	rows := [][]interface{}{InstanceColumns}
+	for _, log := range logs {
+		row := make([]interface{}, 0, len(InstanceColumns))
+		for _, field := range Metadata(log) {
+			row = append(row, field[1])
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// formatUptime prefers the uptime the device reported, ex: 2 days, 3:04
+func formatUptime(log crashlog.CrashLog) string {
+	if log.HumanReadableUptime != "" {
+		return log.HumanReadableUptime
+	}
+	if d, ok := crashlogutil.Uptime(log); ok {
+		return d.String()
+	}
+	return "-"
+}
@@ -0,0 +1,107 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// The file name of a report if the template is not set, without the extension
+const DefaultFileName = "CrashLogs-{{.Model}}-{{.Version}}-{{.Date}}"
+
+// Output is where a file writer saves the report
+type Output struct {
+	// Dir is the directory of the report, empty means the working directory
+	Dir string
+	// FileName is a text/template of the file name without the extension,
+	// ex: CrashLogs-{{.Model}}-{{.Version}}-{{.Week}}
+	FileName string
+	// Merge appends the crashes not recorded yet into the existing report
+	// of the same name instead of overwriting it
+	Merge bool
+}
+
+// FileNameData is the fields available to the file name template
+type FileNameData struct {
+	ProductLine string
+	Model       string
+	Version     string
+	// Date is the day of the first crash, ex: 2023-06-15
+	Date string
+	// Week is the ISO week of the first crash, ex: 2023-W24
+	Week string
+}
+
+// Path returns the path of the report of the crash logs, ext is the file
+// extension including the dot, ex: .xlsx
+func (o Output) Path(data []crashlog.CrashLog, query Query, ext string) (string, error) {
+	if len(data) == 0 {
+		return "", fmt.Errorf("data slice is empty")
+	}
+
+	// Extract the version number from the first crash log entry
+	version, err := crashlogutil.ExtractVersion(data[0].Version)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract version: %s", err)
+	}
+
+	name := o.FileName
+	if name == "" {
+		name = DefaultFileName
+	}
+	tmpl, err := template.New("file").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse file name template: %s", err)
+	}
+
+	first := data[0].SystemTime
+	year, week := first.ISOWeek()
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, FileNameData{
+		ProductLine: query.ProductLine,
+		Model:       data[0].Model,
+		Version:     version,
+		Date:        first.Format("2006-01-02"),
+		Week:        fmt.Sprintf("%d-W%02d", year, week),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to execute file name template: %s", err)
+	}
+
+	return filepath.Join(o.Dir, buf.String()+ext), nil
+}
+
+// Merge appends the crash logs not recorded yet to the recorded ones. A crash
+// is recorded if its Elasticsearch ID is, or a crash of the same device, time
+// and fingerprint is, the records of older workbooks have no ID. The crash logs
+// of data are not deduplicated against each other, the dedup policy does that.
+// It returns the merged crash logs and how many of data were appended.
+func Merge(recorded, data []crashlog.CrashLog) ([]crashlog.CrashLog, int) {
+	fingerprints := make(crashlogutil.FingerprintCache)
+	key := func(log crashlog.CrashLog) string {
+		return log.AnonymousDeviceID + "|" + log.SystemTime.UTC().Format(time.RFC3339Nano) + "|" + fingerprints.Fingerprint(log.CrashLog)
+	}
+
+	seen := make(map[string]bool, 2*len(recorded))
+	for _, log := range recorded {
+		seen[key(log)] = true
+		if log.ID != "" {
+			seen["id|"+log.ID] = true
+		}
+	}
+
+	merged := append([]crashlog.CrashLog(nil), recorded...)
+	added := 0
+	for _, log := range data {
+		if (log.ID != "" && seen["id|"+log.ID]) || seen[key(log)] {
+			continue
+		}
+		merged = append(merged, log)
+		added++
+	}
+	return merged, added
+}
@@ -0,0 +1,83 @@
+package report
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	recorded := []crashlog.CrashLog{
+		crash("a", 1, "memcpy"),
+		crash("b", 2, "memcpy"),
+	}
+	recorded[1].ID = "es-b-2"
+
+	// The same crash of a fetched again
+	again := recorded[0]
+	// The same signature on a later day is another crash
+	later := crash("a", 1, "memcpy")
+	later.SystemTime = later.SystemTime.Add(24 * time.Hour)
+	// The ES ID wins over the time
+	byID := crash("b", 2, "memcpy")
+	byID.ID = "es-b-2"
+	byID.SystemTime = byID.SystemTime.Add(time.Second)
+	// An older record has no ID yet
+	noID := crash("b", 2, "memcpy")
+	noID.ID = ""
+	withID := recorded[0]
+	withID.ID = "es-a-1"
+
+	tests := []struct {
+		name string
+		data []crashlog.CrashLog
+		want int
+	}{
+		{"recorded crash", []crashlog.CrashLog{again}, 0},
+		{"same signature, later day", []crashlog.CrashLog{later}, 1},
+		{"recorded by ID", []crashlog.CrashLog{byID}, 0},
+		{"recorded without ID", []crashlog.CrashLog{withID, noID}, 0},
+		{"new device", []crashlog.CrashLog{crash("c", 1, "memcpy")}, 1},
+		{"new signature", []crashlog.CrashLog{crash("a", 1, "ext4_writepages")}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, added := Merge(recorded, tt.data)
+			if added != tt.want {
+				t.Errorf("added = %d, want %d", added, tt.want)
+			}
+			if len(merged) != len(recorded)+added {
+				t.Errorf("got %d merged crash logs, want %d", len(merged), len(recorded)+added)
+			}
+		})
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	data := []crashlog.CrashLog{{Model: "UDMPRO", Version: "v3.1.9-rc.2", SystemTime: time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC)}}
+	query := Query{ProductLine: "network"}
+
+	tests := []struct {
+		name    string
+		output  Output
+		want    string
+		wantErr bool
+	}{
+		{"default", Output{}, "CrashLogs-UDMPRO-3.1.9-2023-06-15.xlsx", false},
+		{"week in a directory", Output{Dir: "reports", FileName: "{{.ProductLine}}-{{.Model}}-{{.Week}}"}, filepath.Join("reports", "network-UDMPRO-2023-W24.xlsx"), false},
+		{"unknown field", Output{FileName: "{{.Serial}}"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.output.Path(data, query, ".xlsx")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Path error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Path = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
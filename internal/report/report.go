@@ -0,0 +1,328 @@
+package report
+
+import (
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/bootloop"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/installbase"
+	"grafana-extract-go/internal/ownership"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy decides which crash logs of a group are written, the others are only counted
+type Policy string
+
+const (
+	// DedupNone writes every crash log
+	DedupNone Policy = "none"
+	// DedupDevice writes one crash log per device across the report
+	DedupDevice Policy = "device"
+	// DedupDeviceSignature writes one crash log per device and signature
+	DedupDeviceSignature Policy = "device-signature"
+	// DedupSamples writes the first Samples crash logs per signature
+	DedupSamples Policy = "samples"
+)
+
+// The samples per signature of DedupSamples if not set
+const DefaultSamples = 3
+
+// Dedup is the deduplication policy of a report
+type Dedup struct {
+	Policy  Policy `json:"policy"`
+	Samples int    `json:"samples,omitempty"`
+}
+
+// ParsePolicy parses the policy name, empty means DedupNone
+func ParsePolicy(name string) (Policy, error) {
+	switch policy := Policy(name); policy {
+	case "":
+		return DedupNone, nil
+	case DedupNone, DedupDevice, DedupDeviceSignature, DedupSamples:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown dedup policy: %s, ex: none, device, device-signature or samples", name)
+	}
+}
+
+// Options holds the settings shared by every report writer
+type Options struct {
+	// Dedup decides which crash logs are written, the suppressed ones are still counted
+	Dedup Dedup
+	// InstallBase normalizes the crash counts per 1k devices, nil skips the rates
+	InstallBase *installbase.InstallBase
+	// Owners maps the crashes to their owning teams, nil leaves them unassigned
+	Owners *ownership.Owners
+	// Query is what the crash logs were fetched with, shown on the summary
+	Query Query
+	// Output is where the file writers save the report
+	Output Output
+}
+
+// Query is the parameters the crash logs were fetched with
+type Query struct {
+	ProductLine string `json:"product_line"`
+	Date        string `json:"date"`
+	To          string `json:"to,omitempty"`
+	Version     string `json:"version"`
+	Model       string `json:"model"`
+	Size        int    `json:"size"`
+}
+
+// Group is the crashes sharing one signature, each group is written into its own sheet
+type Group struct {
+	Sheet          string    `json:"sheet"`
+	Reason         string    `json:"reason"`
+	Fingerprint    string    `json:"fingerprint"`
+	Owner          string    `json:"owner"`
+	Crashes        int       `json:"crashes"`
+	Devices        int       `json:"devices"`
+	FirstSeen      time.Time `json:"first_seen"`
+	LastSeen       time.Time `json:"last_seen"`
+	KernelVersions []string  `json:"kernel_versions"`
+	// CrashLog is the crash log of the first crash, it stands for the signature
+	CrashLog string              `json:"crash_log"`
+	Logs     []crashlog.CrashLog `json:"-"`
+	// Written is the crash logs the dedup policy keeps, Suppressed counts the others
+	Written    []crashlog.CrashLog `json:"-"`
+	Suppressed int                 `json:"suppressed"`
+}
+
+// Groups groups the crash logs by their fingerprint, the most crashes first,
+// and applies the dedup policy of the options
+func Groups(data []crashlog.CrashLog, opts Options) []Group {
+	owners := opts.Owners
+
+	// Bucket the crash logs in one pass, in their original order
+	fingerprints := make(crashlogutil.FingerprintCache)
+	var order []string
+	byFingerprint := make(map[string][]crashlog.CrashLog)
+	for _, log := range data {
+		fingerprint := fingerprints.Fingerprint(log.CrashLog)
+		if _, ok := byFingerprint[fingerprint]; !ok {
+			order = append(order, fingerprint)
+		}
+		byFingerprint[fingerprint] = append(byFingerprint[fingerprint], log)
+	}
+	// The order doesn't depend on the order the crash logs were fetched in
+	sort.Slice(order, func(i, j int) bool {
+		a, b := byFingerprint[order[i]], byFingerprint[order[j]]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return order[i] < order[j]
+	})
+
+	groups := make([]Group, 0, len(order))
+	sheets := make(map[string]bool)
+	for _, fingerprint := range order {
+		logs := byFingerprint[fingerprint]
+		first := logs[0]
+		for _, log := range logs[1:] {
+			if log.SystemTime.Before(first.SystemTime) || (log.SystemTime.Equal(first.SystemTime) && log.CrashLog < first.CrashLog) {
+				first = log
+			}
+		}
+		reason := crashlogutil.Reason(first.CrashLog)
+		group := Group{
+			Sheet:       SheetName(reason, fingerprint, sheets),
+			Reason:      reason,
+			Fingerprint: fingerprint,
+			Owner:       ownership.Attribute(first.CrashLog, owners).Owner,
+			Crashes:     len(logs),
+			FirstSeen:   first.SystemTime,
+			CrashLog:    first.CrashLog,
+			Logs:        logs,
+		}
+
+		devices := make(map[string]bool)
+		kernels := make(map[string]bool)
+		for _, log := range logs {
+			devices[log.AnonymousDeviceID] = true
+			if log.KernelVersion != "" && !kernels[log.KernelVersion] {
+				kernels[log.KernelVersion] = true
+				group.KernelVersions = append(group.KernelVersions, log.KernelVersion)
+			}
+			if log.SystemTime.After(group.LastSeen) {
+				group.LastSeen = log.SystemTime
+			}
+		}
+		group.Devices = len(devices)
+		sort.Strings(group.KernelVersions)
+
+		groups = append(groups, group)
+	}
+
+	opts.Dedup.apply(groups)
+	return groups
+}
+
+// The longest sheet name Excel accepts
+const maxSheetName = 31
+
+// Excel doesn't accept these characters in a sheet name
+var sheetNameReplacer = strings.NewReplacer(":", " ", "\\", " ", "/", " ", "?", " ", "*", " ", "[", " ", "]", " ", "'", " ")
+
+// SheetName names the sheet of a crash signature from its reason and
+// fingerprint, ex: Fatal exception 1a2b3c4d5e6f, so the same signature gets
+// the same sheet every run. The fingerprint is never cut, so only a name
+// already in taken, ex: a fingerprint named twice, gets a ~2, ~3... suffix.
+// The new name is added to taken.
+func SheetName(reason, fingerprint string, taken map[string]bool) string {
+	// The panic message mostly starts with "not syncing:", it tells nothing
+	reason = strings.TrimSpace(reason)
+	reason = strings.TrimSpace(strings.TrimPrefix(reason, "not syncing:"))
+	reason = strings.Join(strings.Fields(sheetNameReplacer.Replace(reason)), " ")
+
+	for n := 1; ; n++ {
+		suffix := fingerprint
+		if n > 1 {
+			suffix = fmt.Sprintf("%s~%d", fingerprint, n)
+		}
+		name := suffix
+		if room := maxSheetName - len(suffix) - 1; room > 0 && reason != "" {
+			runes := []rune(reason)
+			if len(runes) > room {
+				runes = runes[:room]
+			}
+			name = strings.TrimSpace(string(runes)) + " " + suffix
+		}
+		// Sheet names are case insensitive
+		if key := strings.ToLower(name); !taken[key] {
+			taken[key] = true
+			return name
+		}
+	}
+}
+
+// apply splits the crash logs of every group into written and suppressed ones
+func (d Dedup) apply(groups []Group) {
+	samples := d.Samples
+	if samples <= 0 {
+		samples = DefaultSamples
+	}
+
+	seen := make(map[string]int)
+	for i := range groups {
+		group := &groups[i]
+		group.Written = nil
+		for _, log := range group.Logs {
+			var key string
+			switch d.Policy {
+			case DedupDevice:
+				key = log.AnonymousDeviceID
+			case DedupDeviceSignature:
+				key = log.AnonymousDeviceID + "|" + group.Fingerprint
+			case DedupSamples:
+				key = group.Fingerprint
+			}
+
+			limit := 1
+			if d.Policy == DedupSamples {
+				limit = samples
+			}
+			if key != "" && seen[key] >= limit {
+				continue
+			}
+			if key != "" {
+				seen[key]++
+			}
+			group.Written = append(group.Written, log)
+		}
+		group.Suppressed = len(group.Logs) - len(group.Written)
+	}
+}
+
+// Summary is the content of the summary sheet
+type Summary struct {
+	Rows [][]interface{}
+	// GroupRows maps a group sheet to the index of its row in Rows, the
+	// first cell of the row holds the sheet name and is where the link goes
+	GroupRows map[string]int
+	// GroupHeader is the index of the header row of the group table in Rows
+	GroupHeader int
+	// RateHeader is the index of the header row of the per-signature rate
+	// table in Rows, followed by RateRows rows. RateRows is 0 without an install base.
+	RateHeader int
+	RateRows   int
+}
+
+// BuildSummary lays out the summary sheet: the query, the totals, the boot
+// looping devices, one row per crash group and the crash rates
+func BuildSummary(data []crashlog.CrashLog, groups []Group, opts Options, generated time.Time) Summary {
+	summary := Summary{GroupRows: make(map[string]int)}
+	add := func(row ...interface{}) {
+		summary.Rows = append(summary.Rows, row)
+	}
+
+	query := opts.Query
+	add("Crash report")
+	add("Product line", query.ProductLine)
+	add("Date", query.Date)
+	if query.To != "" {
+		add("To", query.To)
+	}
+	add("Version", query.Version)
+	add("Model", query.Model)
+	add("Size", query.Size)
+	add("Generated", generated.Format(time.RFC3339))
+	add()
+
+	devices := make(map[string]bool)
+	for _, log := range data {
+		devices[log.AnonymousDeviceID] = true
+	}
+	add("Total crashes", len(data))
+	add("Distinct devices", len(devices))
+	add("Crash groups", len(groups))
+	suppressed := 0
+	for _, group := range groups {
+		suppressed += group.Suppressed
+	}
+	policy := opts.Dedup.Policy
+	if policy == "" {
+		policy = DedupNone
+	}
+	add("Dedup policy", string(policy))
+	add("Suppressed entries", suppressed)
+	add()
+
+	// Devices stuck in crash/reboot loops are the most urgent, they come before the groups
+	if loops := bootloop.Detect(data, bootloop.DefaultOptions); len(loops) > 0 {
+		summary.Rows = append(summary.Rows, bootloop.Table(loops)...)
+		add()
+	}
+
+	summary.GroupHeader = len(summary.Rows)
+	add("Sheet", "Reason", "Fingerprint", "Owner", "Crashes", "Devices", "Written", "Suppressed", "First seen", "Last seen", "Kernel versions")
+	for _, group := range groups {
+		summary.GroupRows[group.Sheet] = len(summary.Rows)
+		add(
+			group.Sheet,
+			group.Reason,
+			group.Fingerprint,
+			group.Owner,
+			group.Crashes,
+			group.Devices,
+			len(group.Written),
+			group.Suppressed,
+			group.FirstSeen.Format(time.RFC3339),
+			group.LastSeen.Format(time.RFC3339),
+			strings.Join(group.KernelVersions, ", "),
+		)
+	}
+
+	// The crash rates per model and per version, then per signature
+	if opts.InstallBase != nil {
+		add()
+		summary.Rows = append(summary.Rows, installbase.Table(installbase.ComputeBreakdown(data, opts.InstallBase))...)
+		add()
+		rates := installbase.ComputeRates(data, opts.InstallBase, opts.Owners)
+		summary.RateHeader, summary.RateRows = len(summary.Rows), len(rates)
+		summary.Rows = append(summary.Rows, installbase.Table(rates)...)
+	}
+
+	return summary
+}
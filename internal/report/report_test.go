@@ -0,0 +1,161 @@
+package report
+
+import (
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"strings"
+	"testing"
+	"time"
+)
+
+var day = time.Date(2023, 6, 15, 0, 0, 0, 0, time.UTC)
+
+// crash returns a crash of the device at the minute, the timestamp and the
+// address of the crash log differ per crash but its signature doesn't
+func crash(device string, minute int, symbol string) crashlog.CrashLog {
+	printed := []string{
+		fmt.Sprintf("pc : %s+0x%x/0x3e8", symbol, 0x10+minute),
+		"Call trace:",
+		fmt.Sprintf(" %s+0x%x/0x3e8", symbol, 0x10+minute),
+		" kthread+0x100/0x130",
+		"Kernel panic - not syncing: Fatal exception in " + symbol,
+	}
+	var sb strings.Builder
+	for i := len(printed) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "<4>[%5d.%06d] %s", 100+minute, i, printed[i])
+	}
+	return crashlog.CrashLog{
+		AnonymousDeviceID: device,
+		SystemTime:        day.Add(time.Duration(minute) * time.Minute),
+		KernelVersion:     "5.4.0",
+		CrashLog:          sb.String(),
+	}
+}
+
+func TestGroups(t *testing.T) {
+	data := []crashlog.CrashLog{
+		crash("a", 3, "memcpy"),
+		crash("b", 1, "ext4_writepages"),
+		crash("c", 2, "memcpy"),
+		crash("a", 5, "memcpy"),
+	}
+
+	groups := Groups(data, Options{})
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want one per signature: %+v", len(groups), groups)
+	}
+	memcpy := groups[0]
+	if memcpy.Crashes != 3 || memcpy.Devices != 2 || len(memcpy.Logs) != 3 {
+		t.Errorf("memcpy group = %d crashes, %d devices, want 3, 2", memcpy.Crashes, memcpy.Devices)
+	}
+	if !memcpy.FirstSeen.Equal(day.Add(2*time.Minute)) || !memcpy.LastSeen.Equal(day.Add(5*time.Minute)) {
+		t.Errorf("memcpy group seen %v - %v", memcpy.FirstSeen, memcpy.LastSeen)
+	}
+	if memcpy.CrashLog != data[2].CrashLog {
+		t.Error("the group crash log isn't the one of the first crash")
+	}
+	if strings.Contains(memcpy.Sheet, "~") || !strings.HasSuffix(memcpy.Sheet, memcpy.Fingerprint) {
+		t.Errorf("sheet = %q, want the reason and %s", memcpy.Sheet, memcpy.Fingerprint)
+	}
+
+	// The same signatures get the same sheets whatever the fetch order
+	reversed := make([]crashlog.CrashLog, len(data))
+	for i, log := range data {
+		reversed[len(data)-1-i] = log
+	}
+	for i, group := range Groups(reversed, Options{}) {
+		if group.Sheet != groups[i].Sheet || group.CrashLog != groups[i].CrashLog {
+			t.Errorf("group %d = %q, want %q", i, group.Sheet, groups[i].Sheet)
+		}
+	}
+}
+
+func TestSheetName(t *testing.T) {
+	tests := []struct {
+		name, reason, fingerprint string
+		taken                     []string
+		want                      string
+	}{
+		{"reason and fingerprint", "not syncing: Fatal exception", "3f2a9c1be07d", nil, "Fatal exception 3f2a9c1be07d"},
+		{"invalid characters", "not syncing: Attempted to kill init! exitcode=0x0000000b [x]", "3f2a9c1be07d", nil, "Attempted to kill 3f2a9c1be07d"},
+		{"no reason", "", "3f2a9c1be07d", nil, "3f2a9c1be07d"},
+		{"taken", "Fatal exception", "3f2a9c1be07d", []string{"fatal exception 3f2a9c1be07d"}, "Fatal exception 3f2a9c1be07d~2"},
+		{"taken twice", "Fatal exception", "3f2a9c1be07d", []string{"fatal exception 3f2a9c1be07d", "fatal exception 3f2a9c1be07d~2"}, "Fatal exception 3f2a9c1be07d~3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taken := make(map[string]bool)
+			for _, name := range tt.taken {
+				taken[name] = true
+			}
+			got := SheetName(tt.reason, tt.fingerprint, taken)
+			if got != tt.want {
+				t.Errorf("SheetName = %q, want %q", got, tt.want)
+			}
+			if len(got) > maxSheetName {
+				t.Errorf("SheetName %q is longer than %d", got, maxSheetName)
+			}
+			if !taken[strings.ToLower(got)] {
+				t.Error("the name isn't added to taken")
+			}
+		})
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Policy
+		wantErr bool
+	}{
+		{"", DedupNone, false},
+		{"none", DedupNone, false},
+		{"device", DedupDevice, false},
+		{"device-signature", DedupDeviceSignature, false},
+		{"samples", DedupSamples, false},
+		{"unique", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePolicy(tt.name)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParsePolicy(%q) = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDedupApply(t *testing.T) {
+	logs := func(devices ...string) []crashlog.CrashLog {
+		var logs []crashlog.CrashLog
+		for i, device := range devices {
+			logs = append(logs, crashlog.CrashLog{AnonymousDeviceID: device, SystemTime: day.Add(time.Duration(i) * time.Minute)})
+		}
+		return logs
+	}
+
+	tests := []struct {
+		dedup Dedup
+		// written is the crash logs written per group, the others are suppressed
+		written []int
+	}{
+		{Dedup{Policy: DedupNone}, []int{4, 3}},
+		{Dedup{}, []int{4, 3}},
+		// a and b are written by the first group already
+		{Dedup{Policy: DedupDevice}, []int{3, 0}},
+		{Dedup{Policy: DedupDeviceSignature}, []int{3, 2}},
+		{Dedup{Policy: DedupSamples, Samples: 2}, []int{2, 2}},
+		{Dedup{Policy: DedupSamples}, []int{DefaultSamples, 3}},
+	}
+	for _, tt := range tests {
+		groups := []Group{
+			{Fingerprint: "f1", Logs: logs("a", "a", "b", "c")},
+			{Fingerprint: "f2", Logs: logs("a", "b", "b")},
+		}
+		tt.dedup.apply(groups)
+		for i, group := range groups {
+			if len(group.Written) != tt.written[i] || group.Suppressed != len(group.Logs)-tt.written[i] {
+				t.Errorf("%+v: group %d written %d, suppressed %d, want %d written", tt.dedup, i, len(group.Written), group.Suppressed, tt.written[i])
+			}
+		}
+	}
+}
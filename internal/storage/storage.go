@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The NVR and NAS models the storage analysis runs for
+var Models = []string{"UNVR", "UNVRPRO", "UNASPRO"}
+
+// Error classes
+const (
+	MediumError     = "medium error"
+	TargetError     = "target error"
+	IOError         = "I/O error"
+	IOTimeout       = "I/O timeout"
+	ATALinkReset    = "ata link reset"
+	FilesystemError = "filesystem error"
+	RAIDError       = "RAID error"
+)
+
+// The number of sectors and RAID messages kept per aggregation
+const maxSamples = 5
+
+var (
+	// ex: blk_update_request: critical target error, dev sda, sector 123456
+	// ex: print_req_error: I/O error, dev sdb, sector 2048 op 0x0:(READ)
+	blockErrorRegex = regexp.MustCompile(`(?:blk_update_request|print_req_error):\s*(?:critical\s+)?(.+?)\s+error, dev (\w+), sector (\d+)`)
+	// ex: sd 0:0:0:0: [sda] tag#0 Sense Key : Medium Error [current]
+	senseKeyRegex = regexp.MustCompile(`\[(sd[a-z]+)\].*Sense Key\s*:\s*(Medium Error|Hardware Error|Aborted Command)`)
+	// ex: sd 0:0:0:0: [sda] tag#3 timing out command, waited 180s
+	timeoutRegex = regexp.MustCompile(`\[(sd[a-z]+)\].*(?:timing out command|timed out|cmd_timeout)`)
+	// ex: ata1.00: failed command: READ FPDMA QUEUED ... ata1.00: exception Emask 0x0 SAct 0x0 SErr 0x0 action 0x6 frozen
+	ataTimeoutRegex = regexp.MustCompile(`(ata\d+)(?:\.\d+)?: (?:exception Emask.*frozen|.*\btimeout\b)`)
+	// ex: ata1: hard resetting link, ata1: link is slow to respond, ata1: SATA link down
+	ataLinkRegex = regexp.MustCompile(`(ata\d+)(?:\.\d+)?: (?:hard resetting link|soft resetting link|link is slow to respond|SATA link down|COMRESET failed)`)
+	// ex: ata1.00: error: { UNC } ... LBA 123456
+	lbaRegex = regexp.MustCompile(`\b(?:LBA|lba)[: ]+(\d+)`)
+	// ex: EXT4-fs error (device sda1): ..., BTRFS error (device md1): ..., UBIFS error (ubi0:0 pid 1): ...
+	filesystemRegex = regexp.MustCompile(`\b(EXT4-fs|BTRFS|UBIFS)(?: (?:error|warning|critical|info))? \((?:device )?([\w:]+)`)
+	// ex: md/raid1:md0: Disk failure on sdb1, disabling device. ex: md: md0: recovery interrupted.
+	raidRegex = regexp.MustCompile(`\bmd(?:/raid\d*)?:\s*(md\d+)?`)
+)
+
+// Event is one storage error found in a crash log
+type Event struct {
+	BlockDevice string `json:"block_device"`
+	Sector      string `json:"sector"`
+	Class       string `json:"class"`
+	Filesystem  string `json:"filesystem"`
+	Line        string `json:"line"`
+}
+
+// Result is what the analyzer extracts from one crash log
+type Result struct {
+	Events []Event  `json:"events"`
+	RAID   []string `json:"raid"`
+}
+
+// IsStorageModel reports if the model is an NVR or a NAS
+func IsStorageModel(model string) bool {
+	for _, m := range Models {
+		if strings.EqualFold(m, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// Analyze extracts the storage errors from the crash log
+func Analyze(crashLog string) Result {
+	return AnalyzeLines(crashlogutil.CleanLines(crashLog))
+}
+
+// AnalyzeLines extracts the storage errors from the crash log lines
+func AnalyzeLines(lines []string) Result {
+	var result Result
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+
+		if match := blockErrorRegex.FindStringSubmatch(line); match != nil {
+			result.Events = append(result.Events, Event{
+				BlockDevice: match[2],
+				Sector:      match[3],
+				Class:       blockErrorClass(match[1]),
+				Line:        line,
+			})
+			continue
+		}
+		if match := senseKeyRegex.FindStringSubmatch(line); match != nil {
+			class := TargetError
+			if match[2] == "Medium Error" {
+				class = MediumError
+			}
+			result.Events = append(result.Events, Event{BlockDevice: match[1], Class: class, Line: line})
+			continue
+		}
+		if match := timeoutRegex.FindStringSubmatch(line); match != nil {
+			result.Events = append(result.Events, Event{BlockDevice: match[1], Class: IOTimeout, Line: line})
+			continue
+		}
+		if match := ataLinkRegex.FindStringSubmatch(line); match != nil {
+			result.Events = append(result.Events, Event{BlockDevice: match[1], Class: ATALinkReset, Line: line})
+			continue
+		}
+		if match := ataTimeoutRegex.FindStringSubmatch(line); match != nil {
+			event := Event{BlockDevice: match[1], Class: IOTimeout, Line: line}
+			if lba := lbaRegex.FindStringSubmatch(line); lba != nil {
+				event.Sector = lba[1]
+			}
+			result.Events = append(result.Events, event)
+			continue
+		}
+		if match := filesystemRegex.FindStringSubmatch(line); match != nil {
+			result.Events = append(result.Events, Event{
+				BlockDevice: match[2],
+				Class:       FilesystemError,
+				Filesystem:  filesystemName(match[1]),
+				Line:        line,
+			})
+			continue
+		}
+		if raidRegex.MatchString(line) {
+			result.RAID = append(result.RAID, line)
+		}
+	}
+
+	// Attach the filesystem to the block errors of the same disk, ex: sda1 on sda
+	for _, fs := range result.Events {
+		if fs.Filesystem == "" {
+			continue
+		}
+		for i := range result.Events {
+			event := &result.Events[i]
+			if event.Filesystem == "" && event.BlockDevice != "" && strings.HasPrefix(fs.BlockDevice, event.BlockDevice) {
+				event.Filesystem = fs.Filesystem
+			}
+		}
+	}
+
+	return result
+}
+
+func blockErrorClass(kind string) string {
+	kind = strings.ToLower(kind)
+	switch {
+	case strings.Contains(kind, "medium"):
+		return MediumError
+	case strings.Contains(kind, "target"):
+		return TargetError
+	case strings.Contains(kind, "timeout"):
+		return IOTimeout
+	default:
+		return IOError
+	}
+}
+
+func filesystemName(prefix string) string {
+	switch prefix {
+	case "EXT4-fs":
+		return "ext4"
+	case "BTRFS":
+		return "btrfs"
+	default:
+		return "ubifs"
+	}
+}
+
+// Summary aggregates the storage errors of one key, ex: a device and its disk
+type Summary struct {
+	Model       string         `json:"model"`
+	DeviceID    string         `json:"device_id,omitempty"`
+	BlockDevice string         `json:"block_device,omitempty"`
+	Crashes     int            `json:"crashes"`
+	Devices     int            `json:"devices"`
+	Classes     map[string]int `json:"classes"`
+	Filesystems []string       `json:"filesystems"`
+	Sectors     []string       `json:"sectors"`
+	RAID        []string       `json:"raid"`
+	deviceIDs   map[string]bool
+}
+
+// PerDevice aggregates the storage errors per device and block device,
+// only the crash logs of the storage models are included
+func PerDevice(data []crashlog.CrashLog) []Summary {
+	return aggregate(data, func(log crashlog.CrashLog, event Event) string {
+		return log.AnonymousDeviceID + "|" + event.BlockDevice
+	}, true)
+}
+
+// PerModel aggregates the storage errors per model,
+// only the crash logs of the storage models are included
+func PerModel(data []crashlog.CrashLog) []Summary {
+	return aggregate(data, func(log crashlog.CrashLog, event Event) string {
+		return log.Model
+	}, false)
+}
+
+func aggregate(data []crashlog.CrashLog, keyOf func(crashlog.CrashLog, Event) string, perDevice bool) []Summary {
+	summaries := make(map[string]*Summary)
+	// Many crashes share the same crash log, it is analyzed once
+	results := make(map[string]Result)
+	for _, log := range data {
+		if !IsStorageModel(log.Model) {
+			continue
+		}
+		result, ok := results[log.CrashLog]
+		if !ok {
+			result = Analyze(log.CrashLog)
+			results[log.CrashLog] = result
+		}
+
+		// A crash log with only md messages is counted on its RAID device
+		events := result.Events
+		if len(events) == 0 {
+			events = raidEvents(result.RAID)
+		}
+
+		// Count every crash once per key
+		counted := make(map[string]bool)
+		for _, event := range events {
+			key := keyOf(log, event)
+			s, ok := summaries[key]
+			if !ok {
+				s = &Summary{Model: log.Model, Classes: make(map[string]int), deviceIDs: make(map[string]bool)}
+				if perDevice {
+					s.DeviceID = log.AnonymousDeviceID
+					s.BlockDevice = event.BlockDevice
+				}
+				summaries[key] = s
+			}
+			if !counted[key] {
+				counted[key] = true
+				s.Crashes++
+				s.deviceIDs[log.AnonymousDeviceID] = true
+				for _, raid := range result.RAID {
+					s.RAID = appendSample(s.RAID, crashlogutil.NormalizeLine(raid))
+				}
+			}
+			s.Classes[event.Class]++
+			if event.Filesystem != "" {
+				s.Filesystems = appendSample(s.Filesystems, event.Filesystem)
+			}
+			if event.Sector != "" {
+				s.Sectors = appendSample(s.Sectors, event.Sector)
+			}
+		}
+	}
+
+	result := make([]Summary, 0, len(summaries))
+	for _, s := range summaries {
+		s.Devices = len(s.deviceIDs)
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Crashes != result[j].Crashes {
+			return result[i].Crashes > result[j].Crashes
+		}
+		if result[i].Model != result[j].Model {
+			return result[i].Model < result[j].Model
+		}
+		if result[i].DeviceID != result[j].DeviceID {
+			return result[i].DeviceID < result[j].DeviceID
+		}
+		return result[i].BlockDevice < result[j].BlockDevice
+	})
+
+	return result
+}
+
+// raidEvents converts the md messages into events of their RAID device, ex: md0
+func raidEvents(lines []string) []Event {
+	events := make([]Event, 0, len(lines))
+	for _, line := range lines {
+		event := Event{Class: RAIDError, Line: line}
+		if match := raidRegex.FindStringSubmatch(line); match != nil {
+			event.BlockDevice = match[1]
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// appendSample appends the value if it is new and there is room left
+func appendSample(values []string, value string) []string {
+	if len(values) == maxSamples {
+		return values
+	}
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// FormatClasses formats the error counts per class, ex: medium error: 2, ata link reset: 1
+func FormatClasses(classes map[string]int) string {
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s: %d", name, classes[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Table converts the per model and per device summaries into rows, ready to be written into a sheet
+func Table(perModel, perDevice []Summary) [][]interface{} {
+	rows := [][]interface{}{
+		{"Model", "Crashes", "Devices", "Errors", "Filesystems", "RAID"},
+	}
+	for _, s := range perModel {
+		rows = append(rows, []interface{}{s.Model, s.Crashes, s.Devices, FormatClasses(s.Classes), join(s.Filesystems), join(s.RAID)})
+	}
+
+	rows = append(rows, []interface{}{})
+	rows = append(rows, []interface{}{"AnonymousDeviceID", "Model", "Block device", "Crashes", "Errors", "Sectors", "Filesystems", "RAID"})
+	for _, s := range perDevice {
+		rows = append(rows, []interface{}{s.DeviceID, s.Model, s.BlockDevice, s.Crashes, FormatClasses(s.Classes), join(s.Sectors), join(s.Filesystems), join(s.RAID)})
+	}
+	return rows
+}
+
+// join joins the values, "-" stands for none
+func join(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	return strings.Join(values, ", ")
+}
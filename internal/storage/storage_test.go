@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"testing"
+)
+
+func TestAnalyzeLines(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Event
+		raid bool
+	}{
+		{
+			name: "blk_update_request medium error",
+			line: "blk_update_request: critical medium error, dev sdb, sector 2048",
+			want: Event{BlockDevice: "sdb", Sector: "2048", Class: MediumError},
+		},
+		{
+			name: "blk_update_request target error",
+			line: "blk_update_request: critical target error, dev sda, sector 123456",
+			want: Event{BlockDevice: "sda", Sector: "123456", Class: TargetError},
+		},
+		{
+			name: "print_req_error I/O error",
+			line: "print_req_error: I/O error, dev sdc, sector 99 op 0x0:(READ)",
+			want: Event{BlockDevice: "sdc", Sector: "99", Class: IOError},
+		},
+		{
+			name: "Sense Key medium error",
+			line: "sd 0:0:0:0: [sdd] tag#0 Sense Key : Medium Error [current]",
+			want: Event{BlockDevice: "sdd", Class: MediumError},
+		},
+		{
+			name: "Sense Key hardware error",
+			line: "sd 0:0:1:0: [sde] tag#2 Sense Key : Hardware Error [current]",
+			want: Event{BlockDevice: "sde", Class: TargetError},
+		},
+		{
+			name: "command timeout",
+			line: "sd 0:0:0:0: [sdf] tag#3 timing out command, waited 180s",
+			want: Event{BlockDevice: "sdf", Class: IOTimeout},
+		},
+		{
+			name: "ata link reset",
+			line: "ata3: hard resetting link",
+			want: Event{BlockDevice: "ata3", Class: ATALinkReset},
+		},
+		{
+			name: "ata link down",
+			line: "ata4.00: SATA link down (SStatus 0 SControl 300)",
+			want: Event{BlockDevice: "ata4", Class: ATALinkReset},
+		},
+		{
+			name: "ata timeout",
+			line: "ata2.00: cmd 60/08:00 tag 0 ncq dma 4096 in res 40/00 Emask 0x4 (timeout) LBA 777",
+			want: Event{BlockDevice: "ata2", Sector: "777", Class: IOTimeout},
+		},
+		{
+			name: "ata frozen",
+			line: "ata1.00: exception Emask 0x0 SAct 0x0 SErr 0x0 action 0x6 frozen",
+			want: Event{BlockDevice: "ata1", Class: IOTimeout},
+		},
+		{
+			name: "EXT4 error",
+			line: "EXT4-fs error (device sdb1): ext4_find_entry:1455: inode #2: reading directory lblock 0",
+			want: Event{BlockDevice: "sdb1", Class: FilesystemError, Filesystem: "ext4"},
+		},
+		{
+			name: "BTRFS error",
+			line: "BTRFS error (device md1): bdev /dev/md1 errs: wr 0, rd 1",
+			want: Event{BlockDevice: "md1", Class: FilesystemError, Filesystem: "btrfs"},
+		},
+		{
+			name: "UBIFS error",
+			line: "UBIFS error (ubi0:0 pid 1): ubifs_read_node: bad node type",
+			want: Event{BlockDevice: "ubi0:0", Class: FilesystemError, Filesystem: "ubifs"},
+		},
+		{
+			name: "md degraded",
+			line: "md/raid1:md0: Disk failure on sdb1, disabling device.",
+			raid: true,
+		},
+		{
+			name: "md resync",
+			line: "md: md0: resync done.",
+			raid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := AnalyzeLines([]string{tt.line})
+			if tt.raid {
+				if len(result.Events) != 0 || len(result.RAID) != 1 || result.RAID[0] != tt.line {
+					t.Errorf("AnalyzeLines = %+v, want the RAID message only", result)
+				}
+				return
+			}
+			if len(result.Events) != 1 || len(result.RAID) != 0 {
+				t.Fatalf("AnalyzeLines = %+v, want one event", result)
+			}
+			tt.want.Line = tt.line
+			if got := result.Events[0]; got != tt.want {
+				t.Errorf("event = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnalyzeLinesFilesystem(t *testing.T) {
+	result := AnalyzeLines([]string{
+		"blk_update_request: critical medium error, dev sdb, sector 2048",
+		"EXT4-fs error (device sdb1): ext4_find_entry:1455: inode #2",
+	})
+	if len(result.Events) != 2 || result.Events[0].Filesystem != "ext4" {
+		t.Errorf("events = %+v, want the block error on the ext4 disk", result.Events)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	data := []crashlog.CrashLog{
+		{AnonymousDeviceID: "a", Model: "UNVR", CrashLog: "<3>[  12.000200] blk_update_request: critical medium error, dev sdb, sector 2048" +
+			"<3>[  12.000100] blk_update_request: critical medium error, dev sdb, sector 4096"},
+		{AnonymousDeviceID: "b", Model: "UNVR", CrashLog: "<3>[  12.000200] md/raid1:md0: Disk failure on sdb1, disabling device." +
+			"<6>[  12.000100] md: md0: recovery interrupted."},
+		{AnonymousDeviceID: "c", Model: "UDMPRO", CrashLog: "<3>[  12.000100] blk_update_request: critical medium error, dev sda, sector 1"},
+	}
+
+	perModel := PerModel(data)
+	if len(perModel) != 1 {
+		t.Fatalf("PerModel = %+v, want UNVR only", perModel)
+	}
+	unvr := perModel[0]
+	if unvr.Crashes != 2 || unvr.Devices != 2 || unvr.Classes[MediumError] != 2 || unvr.Classes[RAIDError] != 2 || len(unvr.RAID) != 2 {
+		t.Errorf("UNVR = %+v", unvr)
+	}
+
+	perDevice := PerDevice(data)
+	if len(perDevice) != 2 {
+		t.Fatalf("PerDevice = %+v, want 2 summaries", perDevice)
+	}
+	byDevice := make(map[string]Summary)
+	for _, s := range perDevice {
+		byDevice[s.DeviceID] = s
+	}
+	if a := byDevice["a"]; a.BlockDevice != "sdb" || a.Crashes != 1 || len(a.Sectors) != 2 {
+		t.Errorf("device a = %+v", a)
+	}
+	// The crash with only md messages is counted on its RAID device
+	if b := byDevice["b"]; b.BlockDevice != "md0" || b.Crashes != 1 || b.Classes[RAIDError] != 2 {
+		t.Errorf("device b = %+v", b)
+	}
+}
@@ -0,0 +1,383 @@
+package store
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/ownership"
+	"grafana-extract-go/internal/report"
+	"io"
+	"strings"
+	"time"
+
+	// The pure-Go SQLite driver, no cgo needed
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// The date layout of the daily indexes, the dates are stored and compared in it
+	dateLayout = "2006_01_02"
+	// The times are stored in UTC with a fixed width, so they sort as text
+	timeLayout = "2006-01-02T15:04:05.000000000Z"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	started_at TEXT NOT NULL,
+	mode TEXT NOT NULL,
+	product_line TEXT NOT NULL,
+	date TEXT NOT NULL,
+	to_date TEXT NOT NULL,
+	version TEXT NOT NULL,
+	model TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	crashes INTEGER NOT NULL,
+	new_crashes INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS crashes (
+	id TEXT PRIMARY KEY,
+	device TEXT NOT NULL,
+	system_time TEXT NOT NULL,
+	date TEXT NOT NULL,
+	product_line TEXT NOT NULL,
+	model TEXT NOT NULL,
+	version TEXT NOT NULL,
+	kernel_version TEXT NOT NULL,
+	uptime_seconds INTEGER NOT NULL,
+	fingerprint TEXT NOT NULL,
+	record TEXT NOT NULL,
+	first_run INTEGER NOT NULL REFERENCES runs(id),
+	last_run INTEGER NOT NULL REFERENCES runs(id)
+);
+CREATE INDEX IF NOT EXISTS crashes_model_version ON crashes(model, version);
+CREATE INDEX IF NOT EXISTS crashes_date ON crashes(date);
+CREATE INDEX IF NOT EXISTS crashes_device ON crashes(device);
+CREATE INDEX IF NOT EXISTS crashes_fingerprint ON crashes(fingerprint);
+CREATE TABLE IF NOT EXISTS signatures (
+	fingerprint TEXT PRIMARY KEY,
+	reason TEXT NOT NULL,
+	category TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	subsystem TEXT NOT NULL,
+	module TEXT NOT NULL,
+	symbol TEXT NOT NULL,
+	crash_log TEXT NOT NULL,
+	updated_run INTEGER NOT NULL REFERENCES runs(id)
+);
+`
+
+// Store keeps the fetched crashes, their analysis and the report runs in a SQLite file
+type Store struct {
+	db *sql.DB
+}
+
+// Run is one fetch of crash logs, ex: an excel mode run or a webhook request
+type Run struct {
+	ID         int64
+	StartedAt  time.Time
+	Mode       string
+	Query      report.Query
+	Crashes    int
+	NewCrashes int
+}
+
+// Filter selects the stored crashes, the empty fields match everything.
+// From and To are dates like the daily indexes, ex: 2023_06_15. A version
+// ending with * matches it as a prefix, like the Elasticsearch queries.
+type Filter struct {
+	Model       string
+	Version     string
+	From        string
+	To          string
+	Device      string
+	Fingerprint string
+	Limit       int
+}
+
+// Signature is a crash signature, its analysis and its counts within a filter
+type Signature struct {
+	Fingerprint string
+	Reason      string
+	Category    string
+	Owner       string
+	Subsystem   string
+	Module      string
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Crashes     int
+	Devices     int
+}
+
+// Point is the crashes of a signature on one day
+type Point struct {
+	Date        string
+	Fingerprint string
+	Crashes     int
+	Devices     int
+}
+
+// Open opens the SQLite file, creating it and its tables if needed
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %s", err)
+	}
+	// One writer at a time, SQLite locks the whole file
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("PRAGMA journal_mode=WAL; PRAGMA busy_timeout=5000;" + schema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create store tables: %s", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the SQLite file
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// ID returns the stored ID of the crash log, its Elasticsearch _id, or a hash
+// of the device, time and crash log if it wasn't fetched from Elasticsearch
+func ID(log crashlog.CrashLog) string {
+	if log.ID != "" {
+		return log.ID
+	}
+	h := sha1.New()
+	io.WriteString(h, log.AnonymousDeviceID+"\n"+log.SystemTime.UTC().Format(time.RFC3339Nano)+"\n"+log.CrashLog)
+	return "sha1:" + hex.EncodeToString(h.Sum(nil))[:20]
+}
+
+// SaveRun records the run and its crash logs, the crashes already stored
+// are only marked as seen again. It returns the run with its ID and counts.
+func (s *Store) SaveRun(run Run, data []crashlog.CrashLog, owners *ownership.Owners) (Run, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return run, fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if run.StartedAt.IsZero() {
+		run.StartedAt = time.Now()
+	}
+	query := run.Query
+	result, err := tx.Exec(`INSERT INTO runs (started_at, mode, product_line, date, to_date, version, model, size, crashes, new_crashes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0)`,
+		run.StartedAt.UTC().Format(time.RFC3339), run.Mode, query.ProductLine, query.Date, query.To, query.Version, query.Model, query.Size, len(data))
+	if err != nil {
+		return run, fmt.Errorf("failed to insert run: %s", err)
+	}
+	run.ID, err = result.LastInsertId()
+	if err != nil {
+		return run, fmt.Errorf("failed to get run ID: %s", err)
+	}
+	run.Crashes = len(data)
+
+	insertCrash, err := tx.Prepare(`INSERT INTO crashes (id, device, system_time, date, product_line, model, version, kernel_version, uptime_seconds, fingerprint, record, first_run, last_run)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET last_run = excluded.last_run`)
+	if err != nil {
+		return run, fmt.Errorf("failed to prepare crash insert: %s", err)
+	}
+	defer insertCrash.Close()
+
+	upsertSignature, err := tx.Prepare(`INSERT INTO signatures (fingerprint, reason, category, owner, subsystem, module, symbol, crash_log, updated_run)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(fingerprint) DO UPDATE SET reason = excluded.reason, category = excluded.category, owner = excluded.owner,
+		subsystem = excluded.subsystem, module = excluded.module, symbol = excluded.symbol, updated_run = excluded.updated_run`)
+	if err != nil {
+		return run, fmt.Errorf("failed to prepare signature upsert: %s", err)
+	}
+	defer upsertSignature.Close()
+
+	// Analyze every distinct crash log once, the owners may have changed since the last run
+	fingerprints := make(crashlogutil.FingerprintCache)
+	analyzed := make(map[string]bool)
+	for _, log := range data {
+		fingerprint := fingerprints.Fingerprint(log.CrashLog)
+		if !analyzed[fingerprint] {
+			analyzed[fingerprint] = true
+			attribution := ownership.Attribute(log.CrashLog, owners)
+			_, err = upsertSignature.Exec(fingerprint, crashlogutil.Reason(log.CrashLog), crashlogutil.Category(log.CrashLog),
+				attribution.Owner, attribution.Subsystem, attribution.Module, attribution.Symbol, log.CrashLog, run.ID)
+			if err != nil {
+				return run, fmt.Errorf("failed to save signature %s: %s", fingerprint, err)
+			}
+		}
+
+		record, err := json.Marshal(log)
+		if err != nil {
+			return run, fmt.Errorf("failed to marshal crash log: %s", err)
+		}
+		systemTime := log.SystemTime.UTC()
+		// Zero is an unknown uptime
+		uptime, _ := crashlogutil.Uptime(log)
+		_, err = insertCrash.Exec(ID(log), log.AnonymousDeviceID, systemTime.Format(timeLayout), systemTime.Format(dateLayout),
+			log.ProductLine, log.Model, crashlogutil.NormalizeVersion(log.Version), log.KernelVersion,
+			int64(uptime.Seconds()), fingerprint, string(record), run.ID, run.ID)
+		if err != nil {
+			return run, fmt.Errorf("failed to save crash log: %s", err)
+		}
+	}
+
+	// The crashes first stored by this run are the new ones
+	err = tx.QueryRow("SELECT COUNT(*) FROM crashes WHERE first_run = ?", run.ID).Scan(&run.NewCrashes)
+	if err != nil {
+		return run, fmt.Errorf("failed to count new crashes: %s", err)
+	}
+	_, err = tx.Exec("UPDATE runs SET new_crashes = ? WHERE id = ?", run.NewCrashes, run.ID)
+	if err != nil {
+		return run, fmt.Errorf("failed to update run: %s", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return run, fmt.Errorf("failed to commit run: %s", err)
+	}
+	return run, nil
+}
+
+// where returns the WHERE clause of the filter and its arguments
+func (f Filter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, value string) {
+		if value != "" {
+			conditions = append(conditions, condition)
+			args = append(args, value)
+		}
+	}
+	add("c.model = ?", f.Model)
+	if version := crashlogutil.NormalizeVersion(f.Version); strings.HasSuffix(version, "*") {
+		add(`c.version LIKE ? ESCAPE '\'`, likeEscaper.Replace(strings.TrimSuffix(version, "*"))+"%")
+	} else {
+		add("c.version = ?", version)
+	}
+	add("c.date >= ?", f.From)
+	add("c.date <= ?", f.To)
+	add("c.device = ?", f.Device)
+	add("c.fingerprint = ?", f.Fingerprint)
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// likeEscaper escapes the LIKE wildcards, a version is matched as written
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// limit returns the LIMIT clause of the filter
+func (f Filter) limit() string {
+	if f.Limit <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" LIMIT %d", f.Limit)
+}
+
+// Crashes returns the stored crash logs matching the filter, oldest first
+func (s *Store) Crashes(f Filter) ([]crashlog.CrashLog, error) {
+	where, args := f.where()
+	rows, err := s.db.Query("SELECT c.record FROM crashes c"+where+" ORDER BY c.system_time"+f.limit(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query crashes: %s", err)
+	}
+	defer rows.Close()
+
+	var crashLogs []crashlog.CrashLog
+	for rows.Next() {
+		var record string
+		err = rows.Scan(&record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read crash: %s", err)
+		}
+		var log crashlog.CrashLog
+		err = json.Unmarshal([]byte(record), &log)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal crash: %s", err)
+		}
+		crashLogs = append(crashLogs, log)
+	}
+	return crashLogs, rows.Err()
+}
+
+// Signatures returns the signatures of the crashes matching the filter with
+// their first and last seen times, the most crashing devices first
+func (s *Store) Signatures(f Filter) ([]Signature, error) {
+	where, args := f.where()
+	rows, err := s.db.Query(`SELECT c.fingerprint, s.reason, s.category, s.owner, s.subsystem, s.module,
+		MIN(c.system_time), MAX(c.system_time), COUNT(*), COUNT(DISTINCT c.device)
+		FROM crashes c JOIN signatures s ON s.fingerprint = c.fingerprint`+where+`
+		GROUP BY c.fingerprint ORDER BY COUNT(DISTINCT c.device) DESC, COUNT(*) DESC, c.fingerprint`+f.limit(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query signatures: %s", err)
+	}
+	defer rows.Close()
+
+	var signatures []Signature
+	for rows.Next() {
+		var sig Signature
+		var firstSeen, lastSeen string
+		err = rows.Scan(&sig.Fingerprint, &sig.Reason, &sig.Category, &sig.Owner, &sig.Subsystem, &sig.Module,
+			&firstSeen, &lastSeen, &sig.Crashes, &sig.Devices)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signature: %s", err)
+		}
+		sig.FirstSeen, _ = time.Parse(timeLayout, firstSeen)
+		sig.LastSeen, _ = time.Parse(timeLayout, lastSeen)
+		signatures = append(signatures, sig)
+	}
+	return signatures, rows.Err()
+}
+
+// Trend returns the daily crashes and devices of every signature matching the filter
+func (s *Store) Trend(f Filter) ([]Point, error) {
+	where, args := f.where()
+	rows, err := s.db.Query(`SELECT c.date, c.fingerprint, COUNT(*), COUNT(DISTINCT c.device)
+		FROM crashes c`+where+`
+		GROUP BY c.date, c.fingerprint ORDER BY c.date, COUNT(*) DESC, c.fingerprint`+f.limit(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trend: %s", err)
+	}
+	defer rows.Close()
+
+	var points []Point
+	for rows.Next() {
+		var p Point
+		err = rows.Scan(&p.Date, &p.Fingerprint, &p.Crashes, &p.Devices)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trend: %s", err)
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// Runs returns the latest runs first, limit zero means all of them
+func (s *Store) Runs(limit int) ([]Run, error) {
+	rows, err := s.db.Query(`SELECT id, started_at, mode, product_line, date, to_date, version, model, size, crashes, new_crashes
+		FROM runs ORDER BY id DESC` + Filter{Limit: limit}.limit())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query runs: %s", err)
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		var run Run
+		var startedAt string
+		q := &run.Query
+		err = rows.Scan(&run.ID, &startedAt, &run.Mode, &q.ProductLine, &q.Date, &q.To, &q.Version, &q.Model, &q.Size, &run.Crashes, &run.NewCrashes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read run: %s", err)
+		}
+		run.StartedAt, _ = time.Parse(time.RFC3339, startedAt)
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
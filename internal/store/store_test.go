@@ -0,0 +1,241 @@
+package store
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/report"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The crash logs of two signatures
+const (
+	panicLog = "<0>[  12.000200] Kernel panic - not syncing: Fatal exception" +
+		"<4>[  12.000100] pc : blk_update_request+0x1c4/0x3e8"
+	oopsLog = "<0>[  13.000200] Kernel panic - not syncing: Attempted to kill init!" +
+		"<4>[  13.000100] pc : ext4_writepages+0x10/0x80"
+)
+
+// crash returns a crash of June 2023 at the day and hour
+func crash(id, device, model, version string, day, hour int, crashLog string) crashlog.CrashLog {
+	return crashlog.CrashLog{
+		ID:                id,
+		AnonymousDeviceID: device,
+		SystemTime:        time.Date(2023, 6, day, hour, 0, 0, 0, time.UTC),
+		ProductLine:       "protect",
+		Model:             model,
+		Version:           version,
+		CrashLog:          crashLog,
+	}
+}
+
+func open(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "crashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSaveRun(t *testing.T) {
+	s := open(t)
+
+	first, err := s.SaveRun(Run{Mode: "excel"}, []crashlog.CrashLog{
+		crash("1", "a", "UNVR", "v3.1.9", 15, 10, panicLog),
+		crash("2", "b", "UNVR", "v3.1.9", 15, 11, panicLog),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Crashes != 2 || first.NewCrashes != 2 {
+		t.Errorf("first run = %+v, want 2 crashes, 2 new", first)
+	}
+
+	// The second run fetches the crash 2 again, only the crash 3 is new
+	second, err := s.SaveRun(Run{Mode: "webhook"}, []crashlog.CrashLog{
+		crash("2", "b", "UNVR", "v3.1.9", 15, 11, panicLog),
+		crash("3", "c", "UNVR", "v3.1.9", 16, 9, panicLog),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID == first.ID || second.Crashes != 2 || second.NewCrashes != 1 {
+		t.Errorf("second run = %+v, want 2 crashes, 1 new", second)
+	}
+
+	// A crash seen again keeps its first run and moves its last run
+	tests := []struct {
+		id                string
+		firstRun, lastRun int64
+	}{
+		{"1", first.ID, first.ID},
+		{"2", first.ID, second.ID},
+		{"3", second.ID, second.ID},
+	}
+	for _, tt := range tests {
+		var firstRun, lastRun int64
+		err = s.db.QueryRow("SELECT first_run, last_run FROM crashes WHERE id = ?", tt.id).Scan(&firstRun, &lastRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if firstRun != tt.firstRun || lastRun != tt.lastRun {
+			t.Errorf("crash %s: runs %d to %d, want %d to %d", tt.id, firstRun, lastRun, tt.firstRun, tt.lastRun)
+		}
+	}
+
+	crashes, err := s.Crashes(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crashes) != 3 {
+		t.Errorf("got %d stored crashes, want 3", len(crashes))
+	}
+}
+
+func TestFilter(t *testing.T) {
+	s := open(t)
+	_, err := s.SaveRun(Run{Mode: "excel"}, []crashlog.CrashLog{
+		crash("1", "a", "UNVR", "v3.1.9", 14, 10, panicLog),
+		crash("2", "a", "UNVR", "v3.1.10", 15, 10, oopsLog),
+		crash("3", "b", "UNVR", "v3.2.1", 16, 10, panicLog),
+		crash("4", "c", "UDMPRO", "v3.1.9", 17, 10, panicLog),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatures, err := s.Signatures(Filter{Device: "a", Version: "3.1.10"})
+	if err != nil || len(signatures) != 1 {
+		t.Fatalf("Signatures = %v, %v", signatures, err)
+	}
+	oops := signatures[0].Fingerprint
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"everything", Filter{}, []string{"1", "2", "3", "4"}},
+		{"model", Filter{Model: "UNVR"}, []string{"1", "2", "3"}},
+		{"version", Filter{Version: "v3.1.9"}, []string{"1", "4"}},
+		{"version prefix", Filter{Version: "v3.1*"}, []string{"1", "2", "4"}},
+		{"version prefix without v", Filter{Version: "3.1.1*"}, []string{"2"}},
+		{"from", Filter{From: "2023_06_16"}, []string{"3", "4"}},
+		{"to", Filter{To: "2023_06_15"}, []string{"1", "2"}},
+		{"from and to", Filter{From: "2023_06_15", To: "2023_06_16"}, []string{"2", "3"}},
+		{"device", Filter{Device: "a"}, []string{"1", "2"}},
+		{"fingerprint", Filter{Fingerprint: oops}, []string{"2"}},
+		{"combined", Filter{Model: "UNVR", Version: "v3.1*", Device: "a", From: "2023_06_15"}, []string{"2"}},
+		{"limit", Filter{Limit: 2}, []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crashes, err := s.Crashes(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, log := range crashes {
+				got = append(got, log.ID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Crashes = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Crashes = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	s := open(t)
+	_, err := s.SaveRun(Run{Mode: "excel"}, []crashlog.CrashLog{
+		// The panic crashes 3 times on one device, the oops once on each of 2 devices
+		crash("1", "a", "UNVR", "v3.1.9", 14, 10, panicLog),
+		crash("2", "a", "UNVR", "v3.1.9", 15, 8, panicLog),
+		crash("3", "a", "UNVR", "v3.1.9", 16, 20, panicLog),
+		crash("4", "b", "UNVR", "v3.1.9", 15, 12, oopsLog),
+		crash("5", "c", "UNVR", "v3.1.9", 17, 6, oopsLog),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signatures, err := s.Signatures(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		reason              string
+		crashes, devices    int
+		firstSeen, lastSeen time.Time
+	}{
+		// The most crashing devices come first, not the most crashes
+		{"not syncing: Attempted to kill init!", 2, 2, time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC), time.Date(2023, 6, 17, 6, 0, 0, 0, time.UTC)},
+		{"not syncing: Fatal exception", 3, 1, time.Date(2023, 6, 14, 10, 0, 0, 0, time.UTC), time.Date(2023, 6, 16, 20, 0, 0, 0, time.UTC)},
+	}
+	if len(signatures) != len(tests) {
+		t.Fatalf("got %d signatures, want %d", len(signatures), len(tests))
+	}
+	for i, tt := range tests {
+		sig := signatures[i]
+		if sig.Reason != tt.reason || sig.Crashes != tt.crashes || sig.Devices != tt.devices {
+			t.Errorf("signature %d = %s, %d crashes, %d devices, want %s, %d crashes, %d devices",
+				i, sig.Reason, sig.Crashes, sig.Devices, tt.reason, tt.crashes, tt.devices)
+		}
+		if !sig.FirstSeen.Equal(tt.firstSeen) || !sig.LastSeen.Equal(tt.lastSeen) {
+			t.Errorf("signature %d seen %s to %s, want %s to %s", i, sig.FirstSeen, sig.LastSeen, tt.firstSeen, tt.lastSeen)
+		}
+	}
+
+	// The filter narrows the counts and the seen times, on one device each
+	// the most crashes come first
+	signatures, err = s.Signatures(Filter{To: "2023_06_15"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != 2 || signatures[0].Crashes != 2 || !signatures[0].LastSeen.Equal(time.Date(2023, 6, 15, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("signatures up to June 15 = %+v", signatures)
+	}
+}
+
+func TestRuns(t *testing.T) {
+	s := open(t)
+	start := time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC)
+	for i, date := range []string{"2023_06_13", "2023_06_14", "2023_06_15"} {
+		_, err := s.SaveRun(Run{Mode: "excel", StartedAt: start.Add(time.Duration(i) * time.Hour), Query: report.Query{ProductLine: "protect", Date: date}},
+			[]crashlog.CrashLog{crash(date, "a", "UNVR", "v3.1.9", 13+i, 10, panicLog)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		limit int
+		want  []string
+	}{
+		{0, []string{"2023_06_15", "2023_06_14", "2023_06_13"}},
+		{2, []string{"2023_06_15", "2023_06_14"}},
+	}
+	for _, tt := range tests {
+		runs, err := s.Runs(tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) != len(tt.want) {
+			t.Fatalf("Runs(%d) returned %d runs, want %d", tt.limit, len(runs), len(tt.want))
+		}
+		for i, run := range runs {
+			if run.Query.Date != tt.want[i] || run.Query.ProductLine != "protect" || run.Crashes != 1 || run.NewCrashes != 1 {
+				t.Errorf("Runs(%d)[%d] = %+v, want the run of %s", tt.limit, i, run, tt.want[i])
+			}
+		}
+		if !runs[0].StartedAt.Equal(start.Add(2 * time.Hour)) {
+			t.Errorf("latest run started at %s", runs[0].StartedAt)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package ticket
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// Matches a run of backticks, a Markdown fence must be longer than any of them
+	backticksRegex = regexp.MustCompile("`+")
+	// Matches a Jira code macro, ex: {code} or {code:java}, it would end the code block
+	codeMacroRegex = regexp.MustCompile(`(?i)\{code(?::[^}]*)?\}`)
+)
+
+// markup writes headings, tables and code blocks in one format
+type markup struct {
+	format Format
+	b      strings.Builder
+}
+
+func newMarkup(format Format) *markup {
+	return &markup{format: format}
+}
+
+func (m *markup) String() string {
+	return m.b.String()
+}
+
+func (m *markup) heading(level int, text string) {
+	if m.format == Jira {
+		m.b.WriteString("h" + string(rune('0'+level)) + ". " + m.escape(text) + "\n\n")
+		return
+	}
+	m.b.WriteString(strings.Repeat("#", level) + " " + m.escape(text) + "\n\n")
+}
+
+func (m *markup) table(header []string, rows [][]string) {
+	if m.format == Jira {
+		m.b.WriteString("||" + strings.Join(m.escapeCells(header), "||") + "||\n")
+		for _, row := range rows {
+			m.b.WriteString("|" + strings.Join(m.escapeCells(row), "|") + "|\n")
+		}
+		m.b.WriteString("\n")
+		return
+	}
+
+	m.b.WriteString("| " + strings.Join(m.escapeCells(header), " | ") + " |\n")
+	m.b.WriteString("|" + strings.Repeat(" --- |", len(header)) + "\n")
+	for _, row := range rows {
+		m.b.WriteString("| " + strings.Join(m.escapeCells(row), " | ") + " |\n")
+	}
+	m.b.WriteString("\n")
+}
+
+// code writes the lines as they are, nothing in them can end the block: the
+// Jira code macros are stripped and the Markdown fence is longer than any
+// backtick run
+func (m *markup) code(lines []string) {
+	text := strings.Join(lines, "\n")
+	if m.format == Jira {
+		m.b.WriteString("{code}\n" + codeMacroRegex.ReplaceAllString(text, "") + "\n{code}\n\n")
+		return
+	}
+
+	fence := "```"
+	for _, run := range backticksRegex.FindAllString(text, -1) {
+		if len(run) >= len(fence) {
+			fence = strings.Repeat("`", len(run)+1)
+		}
+	}
+	m.b.WriteString(fence + "\n" + text + "\n" + fence + "\n\n")
+}
+
+// The characters escaped in the headings and cells, both formats split the
+// cells on the pipes and Jira reads links and macros in the brackets and braces
+var (
+	markdownCellReplacer = strings.NewReplacer("|", `\|`)
+	jiraCellReplacer     = strings.NewReplacer("|", `\|`, "[", `\[`, "]", `\]`, "{", `\{`, "}", `\}`)
+)
+
+// escape keeps the text on one line and escapes what the format would read as markup
+func (m *markup) escape(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if m.format == Jira {
+		return jiraCellReplacer.Replace(text)
+	}
+	return markdownCellReplacer.Replace(text)
+}
+
+// escapeCells escapes every cell, an empty cell is a space so the table keeps its columns
+func (m *markup) escapeCells(cells []string) []string {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		escaped[i] = m.escape(cell)
+		if escaped[i] == "" {
+			escaped[i] = " "
+		}
+	}
+	return escaped
+}
@@ -0,0 +1,157 @@
+package ticket
+
+import (
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/ownership"
+	"grafana-extract-go/internal/report"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format is the markup of a ticket
+type Format string
+
+const (
+	// Markdown is GitHub-flavored Markdown
+	Markdown Format = "markdown"
+	// Jira is the Jira wiki markup
+	Jira Format = "jira"
+)
+
+// The crash log lines of the code block, the panic and the call trace are
+// printed last so the last lines are kept
+const MaxLogLines = 40
+
+// ParseFormat parses the format name, ex: markdown, md or jira
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "markdown", "md", "":
+		return Markdown, nil
+	case "jira":
+		return Jira, nil
+	default:
+		return "", fmt.Errorf("unknown ticket format: %s, ex: markdown or jira", name)
+	}
+}
+
+// FindGroups returns the groups whose fingerprint or sheet name is the selector
+func FindGroups(groups []report.Group, selector string) []report.Group {
+	var found []report.Group
+	for _, group := range groups {
+		if group.Fingerprint == selector || strings.EqualFold(group.Sheet, selector) {
+			found = append(found, group)
+		}
+	}
+	return found
+}
+
+// Group renders one crash group: a metadata table, the counts, the affected
+// versions and the normalized crash log
+func Group(group report.Group, format Format, owners *ownership.Owners) string {
+	m := newMarkup(format)
+	writeGroup(m, group, owners, 2)
+	return m.String()
+}
+
+// Report renders the whole report: the query, the totals, a table of the groups and every group
+func Report(data []crashlog.CrashLog, opts report.Options, format Format) string {
+	groups := report.Groups(data, opts)
+	m := newMarkup(format)
+
+	query := opts.Query
+	m.heading(1, "Kernel crash report")
+	period := query.Date
+	if query.To != "" {
+		period += " to " + query.To
+	}
+	devices := make(map[string]bool)
+	for _, log := range data {
+		devices[log.AnonymousDeviceID] = true
+	}
+	m.table([]string{"Product line", "Period", "Model", "Version", "Crashes", "Devices", "Crash groups"}, [][]string{{
+		dash(query.ProductLine), dash(period), dash(query.Model), dash(query.Version),
+		fmt.Sprint(len(data)), fmt.Sprint(len(devices)), fmt.Sprint(len(groups)),
+	}})
+
+	rows := make([][]string, 0, len(groups))
+	for _, group := range groups {
+		rows = append(rows, []string{group.Sheet, group.Reason, group.Fingerprint, group.Owner, fmt.Sprint(group.Crashes), fmt.Sprint(group.Devices)})
+	}
+	m.heading(2, "Crash groups")
+	m.table([]string{"Sheet", "Reason", "Fingerprint", "Owner", "Crashes", "Devices"}, rows)
+
+	for _, group := range groups {
+		writeGroup(m, group, opts.Owners, 2)
+	}
+	return m.String()
+}
+
+func writeGroup(m *markup, group report.Group, owners *ownership.Owners, level int) {
+	attribution := ownership.Attribute(group.CrashLog, owners)
+	m.heading(level, "Kernel crash: "+group.Reason)
+
+	models, versions, boms := distinct(group.Logs)
+	m.table([]string{"Field", "Value"}, [][]string{
+		{"Reason", group.Reason},
+		{"Sheet", group.Sheet},
+		{"Fingerprint", group.Fingerprint},
+		{"Owner", fmt.Sprintf("%s (%s)", attribution.Owner, attribution.Subsystem)},
+		{"Symbol", dash(attribution.Symbol)},
+		{"Module", dash(attribution.Module)},
+		{"Crashes", fmt.Sprint(group.Crashes)},
+		{"Devices", fmt.Sprint(group.Devices)},
+		{"First seen", group.FirstSeen.Format(time.RFC3339)},
+		{"Last seen", group.LastSeen.Format(time.RFC3339)},
+		{"Models", dash(strings.Join(models, ", "))},
+		{"Affected versions", dash(strings.Join(versions, ", "))},
+		{"Kernel versions", dash(strings.Join(group.KernelVersions, ", "))},
+		{"BOM revisions", dash(strings.Join(boms, ", "))},
+	})
+
+	m.code(NormalizedLog(group.CrashLog))
+}
+
+// NormalizedLog returns the last MaxLogLines lines of the crash log in printed
+// order, without the timestamps, addresses and numbers that differ per device
+func NormalizedLog(crashLog string) []string {
+	lines := crashlogutil.PrintedLines(crashLog)
+	if len(lines) > MaxLogLines {
+		lines = lines[len(lines)-MaxLogLines:]
+	}
+	normalized := make([]string, 0, len(lines))
+	for _, line := range lines {
+		normalized = append(normalized, crashlogutil.NormalizeLine(line))
+	}
+	return normalized
+}
+
+// distinct returns the sorted models, versions and BOM revisions of the crash logs
+func distinct(logs []crashlog.CrashLog) (models, versions, boms []string) {
+	seen := make(map[string]bool)
+	add := func(values []string, kind, value string) []string {
+		if value == "" || seen[kind+value] {
+			return values
+		}
+		seen[kind+value] = true
+		return append(values, value)
+	}
+	for _, log := range logs {
+		models = add(models, "model", log.Model)
+		versions = add(versions, "version", log.Version)
+		boms = add(boms, "bom", log.BomRev)
+	}
+	sort.Strings(models)
+	sort.Strings(versions)
+	sort.Strings(boms)
+	return models, versions, boms
+}
+
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,140 @@
+package ticket
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/report"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A crash log whose lines try to break out of the cells and the code block
+var hostileLog = "<0>[  12.000300] Kernel panic - not syncing: bad |pipe| [link|http://x] {color:red}" +
+	"<4>[  12.000200] comm: ```` {code} {CODE:java} end" +
+	"<4>[  12.000100] pc : blk_update_request+0x1c4/0x3e8"
+
+func TestGroup(t *testing.T) {
+	data := []crashlog.CrashLog{{
+		AnonymousDeviceID: "a",
+		SystemTime:        time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC),
+		Model:             "UNVR",
+		Version:           "v3.1.9",
+		BomRev:            "113",
+		CrashLog:          hostileLog,
+	}}
+	groups := report.Groups(data, report.Options{})
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups, want 1", len(groups))
+	}
+
+	tests := []struct {
+		format Format
+		want   []string
+	}{
+		{
+			format: Markdown,
+			want: []string{
+				`## Kernel crash: not syncing: bad \|pipe\| [link\|http://x] {color:red}`,
+				``,
+				`| Field | Value |`,
+				`| --- | --- |`,
+				`| Reason | not syncing: bad \|pipe\| [link\|http://x] {color:red} |`,
+				`| Sheet | bad \|pipe\| link\|ht 44ad049c16f4 |`,
+				`| Fingerprint | 44ad049c16f4 |`,
+				`| Owner | Unassigned (block) |`,
+				`| Symbol | blk_update_request |`,
+				`| Module | - |`,
+				`| Crashes | 1 |`,
+				`| Devices | 1 |`,
+				`| First seen | 2023-06-15T10:00:00Z |`,
+				`| Last seen | 2023-06-15T10:00:00Z |`,
+				`| Models | UNVR |`,
+				`| Affected versions | v3.1.9 |`,
+				`| Kernel versions | - |`,
+				`| BOM revisions | 113 |`,
+				``,
+				"`````",
+				`pc : blk_update_request+X/X`,
+				"comm: ```` {code} {CODE:java} end",
+				`Kernel panic - not syncing: bad |pipe| [link|http://x] {color:red}`,
+				"`````",
+				``,
+				``,
+			},
+		},
+		{
+			format: Jira,
+			want: []string{
+				`h2. Kernel crash: not syncing: bad \|pipe\| \[link\|http://x\] \{color:red\}`,
+				``,
+				`||Field||Value||`,
+				`|Reason|not syncing: bad \|pipe\| \[link\|http://x\] \{color:red\}|`,
+				`|Sheet|bad \|pipe\| link\|ht 44ad049c16f4|`,
+				`|Fingerprint|44ad049c16f4|`,
+				`|Owner|Unassigned (block)|`,
+				`|Symbol|blk_update_request|`,
+				`|Module|-|`,
+				`|Crashes|1|`,
+				`|Devices|1|`,
+				`|First seen|2023-06-15T10:00:00Z|`,
+				`|Last seen|2023-06-15T10:00:00Z|`,
+				`|Models|UNVR|`,
+				`|Affected versions|v3.1.9|`,
+				`|Kernel versions|-|`,
+				`|BOM revisions|113|`,
+				``,
+				`{code}`,
+				`pc : blk_update_request+X/X`,
+				"comm: ````   end",
+				`Kernel panic - not syncing: bad |pipe| [link|http://x] {color:red}`,
+				`{code}`,
+				``,
+				``,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			got := Group(groups[0], tt.format, nil)
+			if want := strings.Join(tt.want, "\n"); got != want {
+				t.Errorf("Group =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		format Format
+		lines  []string
+		want   string
+	}{
+		{Markdown, []string{"plain"}, "```\nplain\n```\n\n"},
+		{Markdown, []string{"a `b` c", "`````` six"}, "```````\na `b` c\n`````` six\n```````\n\n"},
+		{Jira, []string{"{code}", "x {Code:c} y {noformat}"}, "{code}\n\nx  y {noformat}\n{code}\n\n"},
+	}
+	for _, tt := range tests {
+		m := newMarkup(tt.format)
+		m.code(tt.lines)
+		if got := m.String(); got != tt.want {
+			t.Errorf("%s code(%q) = %q, want %q", tt.format, tt.lines, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeCells(t *testing.T) {
+	cells := []string{"", "a|b", "[x] {y}", "multi\n  line"}
+	tests := []struct {
+		format Format
+		want   []string
+	}{
+		{Markdown, []string{" ", `a\|b`, "[x] {y}", "multi line"}},
+		{Jira, []string{" ", `a\|b`, `\[x\] \{y\}`, "multi line"}},
+	}
+	for _, tt := range tests {
+		got := newMarkup(tt.format).escapeCells(cells)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s escapeCells = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
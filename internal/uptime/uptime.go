@@ -0,0 +1,187 @@
+package uptime
+
+import (
+	"fmt"
+	"grafana-extract-go/internal/app/crashlog"
+	"grafana-extract-go/internal/crashlogutil"
+	"grafana-extract-go/internal/ownership"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Bucket is an uptime range a crash falls into
+type Bucket int
+
+const (
+	EarlyBoot Bucket = iota
+	UnderHour
+	UnderDay
+	Longer
+	Unknown
+)
+
+// The buckets in report order
+var Buckets = []Bucket{EarlyBoot, UnderHour, UnderDay, Longer, Unknown}
+
+func (b Bucket) String() string {
+	switch b {
+	case EarlyBoot:
+		return "Early boot (<5m)"
+	case UnderHour:
+		return "<1h"
+	case UnderDay:
+		return "<1d"
+	case Longer:
+		return ">=1d"
+	default:
+		return "Unknown"
+	}
+}
+
+// Matches the numbers of a load average, ex: 0.52 0.58 0.59 or load average: 0.52, 0.58, 0.59
+var loadAverageRegex = regexp.MustCompile(`\d+(?:\.\d+)?`)
+
+// Stats is the uptime and load average distribution of one signature
+type Stats struct {
+	Fingerprint string         `json:"fingerprint"`
+	Reason      string         `json:"reason"`
+	Owner       string         `json:"owner"`
+	Crashes     int            `json:"crashes"`
+	Buckets     map[string]int `json:"buckets"`
+	// Median uptime of the crashes with a known uptime
+	MedianUptime time.Duration `json:"median_uptime"`
+	// Mean and max of the 1, 5 and 15 minutes load average, of the crashes with a parsable load average
+	LoadMean [3]float64 `json:"load_mean"`
+	LoadMax  [3]float64 `json:"load_max"`
+	loads    int
+	uptimes  []time.Duration
+}
+
+// Classify returns the bucket of the uptime, zero means unknown
+func Classify(d time.Duration) Bucket {
+	switch {
+	case d <= 0:
+		return Unknown
+	case d < 5*time.Minute:
+		return EarlyBoot
+	case d < time.Hour:
+		return UnderHour
+	case d < 24*time.Hour:
+		return UnderDay
+	default:
+		return Longer
+	}
+}
+
+// ParseLoadAverage parses the 1, 5 and 15 minutes load average
+func ParseLoadAverage(loadAverage string) ([3]float64, error) {
+	var load [3]float64
+	matches := loadAverageRegex.FindAllString(loadAverage, -1)
+	if len(matches) != 3 {
+		return load, fmt.Errorf("invalid load average: %q", loadAverage)
+	}
+	for i, match := range matches {
+		value, err := strconv.ParseFloat(match, 64)
+		if err != nil {
+			return load, fmt.Errorf("invalid load average: %q", loadAverage)
+		}
+		load[i] = value
+	}
+	return load, nil
+}
+
+// Analyze computes the distributions per signature, the signature with most crashes first
+func Analyze(data []crashlog.CrashLog, owners *ownership.Owners) []Stats {
+	stats := make(map[string]*Stats)
+	fingerprints := make(crashlogutil.FingerprintCache)
+	for _, log := range data {
+		fingerprint := fingerprints.Fingerprint(log.CrashLog)
+		s, ok := stats[fingerprint]
+		if !ok {
+			s = &Stats{
+				Fingerprint: fingerprint,
+				Reason:      crashlogutil.Reason(log.CrashLog),
+				Owner:       ownership.Attribute(log.CrashLog, owners).Owner,
+				Buckets:     make(map[string]int),
+			}
+			stats[fingerprint] = s
+		}
+		s.add(log)
+	}
+
+	result := make([]Stats, 0, len(stats))
+	for _, s := range stats {
+		s.finish()
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Crashes != result[j].Crashes {
+			return result[i].Crashes > result[j].Crashes
+		}
+		return result[i].Fingerprint < result[j].Fingerprint
+	})
+
+	return result
+}
+
+func (s *Stats) add(log crashlog.CrashLog) {
+	s.Crashes++
+
+	d, ok := crashlogutil.Uptime(log)
+	s.Buckets[Classify(d).String()]++
+	if ok {
+		s.uptimes = append(s.uptimes, d)
+	}
+
+	load, err := ParseLoadAverage(log.LoadAverage)
+	if err != nil {
+		return
+	}
+	s.loads++
+	for i := range load {
+		s.LoadMean[i] += load[i]
+		if load[i] > s.LoadMax[i] {
+			s.LoadMax[i] = load[i]
+		}
+	}
+}
+
+func (s *Stats) finish() {
+	if s.loads > 0 {
+		for i := range s.LoadMean {
+			s.LoadMean[i] /= float64(s.loads)
+		}
+	}
+	if len(s.uptimes) > 0 {
+		sort.Slice(s.uptimes, func(i, j int) bool { return s.uptimes[i] < s.uptimes[j] })
+		s.MedianUptime = s.uptimes[len(s.uptimes)/2]
+	}
+}
+
+// Table converts the stats into rows with a header, ready to be written into a sheet
+func Table(stats []Stats) [][]interface{} {
+	header := []interface{}{"Fingerprint", "Reason", "Owner", "Crashes"}
+	for _, bucket := range Buckets {
+		header = append(header, bucket.String())
+	}
+	header = append(header, "Median uptime", "Load 1m mean", "Load 1m max", "Load 5m mean", "Load 15m mean")
+
+	rows := [][]interface{}{header}
+	for _, s := range stats {
+		row := []interface{}{s.Fingerprint, s.Reason, s.Owner, s.Crashes}
+		for _, bucket := range Buckets {
+			row = append(row, s.Buckets[bucket.String()])
+		}
+		row = append(row,
+			s.MedianUptime.String(),
+			fmt.Sprintf("%.2f", s.LoadMean[0]),
+			fmt.Sprintf("%.2f", s.LoadMax[0]),
+			fmt.Sprintf("%.2f", s.LoadMean[1]),
+			fmt.Sprintf("%.2f", s.LoadMean[2]),
+		)
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,96 @@
+package uptime
+
+import (
+	"grafana-extract-go/internal/app/crashlog"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		uptime time.Duration
+		want   Bucket
+	}{
+		{0, Unknown},
+		{-time.Second, Unknown},
+		{time.Second, EarlyBoot},
+		{5*time.Minute - time.Second, EarlyBoot},
+		{5 * time.Minute, UnderHour},
+		{time.Hour, UnderDay},
+		{24*time.Hour - time.Second, UnderDay},
+		{24 * time.Hour, Longer},
+	}
+	for _, tt := range tests {
+		if got := Classify(tt.uptime); got != tt.want {
+			t.Errorf("Classify(%v) = %s, want %s", tt.uptime, got, tt.want)
+		}
+	}
+}
+
+func TestParseLoadAverage(t *testing.T) {
+	tests := []struct {
+		loadAverage string
+		want        [3]float64
+		wantErr     bool
+	}{
+		{"0.52 0.58 0.59", [3]float64{0.52, 0.58, 0.59}, false},
+		{"load average: 1.00, 2.5, 12", [3]float64{1, 2.5, 12}, false},
+		{"", [3]float64{}, true},
+		{"0.52 0.58", [3]float64{}, true},
+		{"0.52 0.58 0.59 1/234", [3]float64{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLoadAverage(tt.loadAverage)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLoadAverage(%q) error = %v, want error %v", tt.loadAverage, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseLoadAverage(%q) = %v, want %v", tt.loadAverage, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	crash := func(reason string, uptime int, loadAverage string) crashlog.CrashLog {
+		return crashlog.CrashLog{
+			SystemTime:  time.Date(2023, 6, 15, 10, 0, 0, 0, time.UTC),
+			Uptime:      uptime,
+			LoadAverage: loadAverage,
+			CrashLog:    "<0>[  12.345678] Kernel panic - not syncing: " + reason,
+		}
+	}
+	data := []crashlog.CrashLog{
+		crash("Fatal exception", 60, "1.00 2.00 3.00"),
+		crash("Fatal exception", 7200, "3.00 4.00 5.00"),
+		crash("Fatal exception", 0, "n/a"),
+		crash("Attempted to kill init!", 200000, ""),
+	}
+
+	stats := Analyze(data, nil)
+	if len(stats) != 2 {
+		t.Fatalf("got %d signatures, want 2", len(stats))
+	}
+	top := stats[0]
+	if top.Crashes != 3 || top.Reason != "not syncing: Fatal exception" {
+		t.Errorf("top signature = %d crashes of %q", top.Crashes, top.Reason)
+	}
+	wantBuckets := map[string]int{EarlyBoot.String(): 1, UnderDay.String(): 1, Unknown.String(): 1}
+	for bucket, want := range wantBuckets {
+		if top.Buckets[bucket] != want {
+			t.Errorf("bucket %s = %d, want %d", bucket, top.Buckets[bucket], want)
+		}
+	}
+	// The crash of unknown uptime is left out of the median, the load of the unparsable load average out of the mean
+	if top.MedianUptime != 2*time.Hour {
+		t.Errorf("median uptime = %v, want 2h", top.MedianUptime)
+	}
+	if top.LoadMean != [3]float64{2, 3, 4} || top.LoadMax != [3]float64{3, 4, 5} {
+		t.Errorf("load mean %v, max %v", top.LoadMean, top.LoadMax)
+	}
+
+	rows := Table(stats)
+	if len(rows) != 3 || len(rows[0]) != len(rows[1]) {
+		t.Errorf("table = %v", rows)
+	}
+}